@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
 )
 
 type AddressType int
@@ -22,8 +26,15 @@ type Address struct {
 	name      string
 	Localpart string
 	Domain    string
+	group     string
 	t         AddressType
 	err       error
+
+	// The obsolete source route (RFC 5322 section 4.4) preceding the
+	// address, in the form "@a.example,@b.example", if the address was
+	// parsed by NewAddressParserWithRoutes(). The route is never used when
+	// the address is formatted.
+	Route string
 }
 
 func NewAddress(name, localpart, domain string) Address {
@@ -52,12 +63,28 @@ func NewAddress(name, localpart, domain string) Address {
 // A memberless group is stored as an Address whose localpart() and domain()
 // are both empty.
 func (a *Address) Name(avoidUTF8 bool) string {
+	return displayName(a.name, avoidUTF8)
+}
+
+// Returns the display-name of the group this Address belongs to, or an empty
+// string if it isn't a member of a group.
+func (a *Address) Group() string {
+	return a.group
+}
+
+// Returns \a name as an RFC 2822 display-name, quoted or encoded as necessary.
+//
+// A name consisting of atext and spaces is returned as-is. Any other name,
+// such as one containing a comma, a period or a quote, is returned as a
+// quoted-string. UTF-8 counts as atext unless \a avoidUTF8 is true, in which
+// case a non-ASCII name is returned as a sequence of RFC 2047 encoded-words.
+func displayName(name string, avoidUTF8 bool) string {
 	atom := true
 	ascii := true
 
 	i := 0
-	for i < len(a.name) {
-		c := a.name[i]
+	for i < len(name) {
+		c := name[i]
 
 		// source: 2822 section 3.2.4
 		if (c >= 'a' && c <= 'z') ||
@@ -84,14 +111,14 @@ func (a *Address) Name(avoidUTF8 bool) string {
 	}
 
 	if atom || i == 0 {
-		return a.name
+		return name
 	}
 
 	if ascii || !avoidUTF8 {
-		return quote(a.name, '"', '\\')
+		return quote(name, '"', '\\')
 	}
 
-	return encodePhrase(a.name)
+	return encodePhrase(name)
 }
 
 // Returns the localpart and domain as a EString. Returns toString() if the
@@ -114,10 +141,21 @@ func (a *Address) lpdomain() string {
 	return r
 }
 
+// Returns an RFC 5322 representation of this address, such as "Jane Doe
+// <jane@example.com>". The display-name and domain may contain UTF-8 (as RFC
+// 6532 permits); see displayName() for how the display-name is quoted.
 func (a *Address) String() string {
 	return a.toString(false)
 }
 
+// Like String(), but the result contains only ASCII: A non-ASCII display-name
+// is RFC 2047 encoded and a non-ASCII domain is converted to punycode. An
+// address whose localpart isn't ASCII cannot be represented, and is replaced
+// by "this-address@needs-unicode.invalid".
+func (a *Address) ASCIIString() string {
+	return a.toString(true)
+}
+
 // Returns an RFC 2822 representation of this address. If \a avoidUTF8 is
 // present and true (the default is false), toString() returns an address which
 // avoids UTF-8 at all costs, even if that loses information.
@@ -155,7 +193,11 @@ func (a *Address) toString(avoidUTF8 bool) string {
 				buf.WriteString(quote(a.Localpart, '"', '\''))
 			}
 			buf.WriteByte('@')
-			buf.WriteString(a.Domain)
+			domain := a.Domain
+			if avoidUTF8 && !isAscii(domain) {
+				domain, _ = a.ASCIIDomain()
+			}
+			buf.WriteString(domain)
 			buf.WriteString(postfix)
 			r = buf.String()
 		}
@@ -163,6 +205,13 @@ func (a *Address) toString(avoidUTF8 bool) string {
 	return r
 }
 
+// Returns true if \a b has the same localpart and domain as this Address.
+// The localpart is compared case-sensitively and the domain
+// case-insensitively. Display-names are ignored.
+func (a Address) Equal(b Address) bool {
+	return a.Localpart == b.Localpart && strings.EqualFold(a.Domain, b.Domain)
+}
+
 // Returns true if this is a sensible-looking localpart, and false if it needs
 // quoting. We should never permit one of our users to need quoting, but we
 // must permit foreign addresses that do.
@@ -174,7 +223,9 @@ func (a *Address) localpartIsSensible() bool {
 	for i < len(a.Localpart) {
 		c := a.Localpart[i]
 		if c == '.' {
-			if a.Localpart[i+1] == '.' {
+			// a dot-atom can't begin or end with a dot, or
+			// contain two in a row
+			if i == 0 || i+1 == len(a.Localpart) || a.Localpart[i+1] == '.' {
 				return false
 			}
 		} else if !((c >= 'a' && c <= 'z') ||
@@ -202,10 +253,70 @@ func (a *Address) localpartIsSensible() bool {
 //
 // Note that the display-name can require unicode even if the address does not.
 func (a *Address) needsUnicode() bool {
-	if isAscii(a.Localpart) && isAscii(a.Domain) {
+	if !isAscii(a.Localpart) {
+		return true
+	}
+	if isAscii(a.Domain) {
 		return false
 	}
-	return true
+	_, err := a.ASCIIDomain()
+	return err != nil
+}
+
+// Returns the domain in the ASCII form used on the wire, converting any
+// internationalized labels to punycode as described by IDNA. Returns an error
+// if the domain cannot be represented in ASCII.
+func (a *Address) ASCIIDomain() (string, error) {
+	return idna.Lookup.ToASCII(a.Domain)
+}
+
+// Returns the domain with any punycode labels converted back to Unicode. If
+// the domain isn't valid IDNA, it is returned unchanged.
+func (a *Address) UnicodeDomain() string {
+	d, err := idna.Lookup.ToUnicode(a.Domain)
+	if err != nil {
+		return a.Domain
+	}
+	return d
+}
+
+// Returns nil if this Address can be used as an SMTP envelope address, and
+// an error describing the first problem otherwise. The limits are those of
+// RFC 5321 section 4.5.3.1: at most 64 characters in the localpart, 255 in
+// the domain and 254 in all. The domain must contain at least one dot or be
+// an address literal. Bounce and empty-group addresses are not valid.
+//
+// Lengths are measured in the ASCII form of the domain if it has one.
+func (a *Address) Validate() error {
+	switch a.t {
+	case BounceAddressType:
+		return fmt.Errorf("bounce address (<>) cannot be used as an envelope address")
+	case EmptyGroupAddressType:
+		return fmt.Errorf("empty group cannot be used as an envelope address: %s", a.toString(false))
+	}
+	if a.Localpart == "" {
+		return fmt.Errorf("localpart is empty: %s", a.lpdomain())
+	}
+	if a.Domain == "" {
+		return fmt.Errorf("domain is empty: %s", a.Localpart)
+	}
+	if len(a.Localpart) > 64 {
+		return fmt.Errorf("localpart too long (%d characters, RFC 5321's maximum is 64): %s", len(a.Localpart), a.lpdomain())
+	}
+	domain := a.Domain
+	if d, err := a.ASCIIDomain(); err == nil {
+		domain = d
+	}
+	if len(domain) > 255 {
+		return fmt.Errorf("domain too long (%d characters, RFC 5321's maximum is 255): %s", len(domain), a.lpdomain())
+	}
+	if !strings.HasPrefix(domain, "[") && !strings.Contains(domain, ".") {
+		return fmt.Errorf("domain is not fully qualified: %s", a.lpdomain())
+	}
+	if n := len(a.Localpart) + 1 + len(domain); n > 254 {
+		return fmt.Errorf("address too long (%d characters, RFC 5321's maximum is 254): %s", n, a.lpdomain())
+	}
+	return nil
 }
 
 type Addresses []Address
@@ -221,7 +332,7 @@ type Addresses []Address
 // AddressParser supports most of RFC 822 and 2822, but mostly omits
 // address groups. An empty address group is translated into a single
 // Address, a nonempty group is translated into the equivalent number
-// of addresses.
+// of addresses, each of which records the group's display-name.
 //
 // AddressParser does not attempt to canonicalize the addresses
 // parsed or get rid of duplicates (To: ams@oryx.com, ams@ory.com),
@@ -234,6 +345,13 @@ type AddressParser struct {
 	recentError error
 	Addresses   Addresses
 	lastComment string
+	utf8        bool
+
+	keepRoutes   bool
+	pendingRoute string
+
+	// reused for each encoded-word; see wordParser()
+	words *parser
 }
 
 /*
@@ -267,7 +385,22 @@ obs-addr-list   =       1*([address] [CFWS] "," [CFWS]) [address]
 // Constructs an Address Parser parsing \a s. After construction, addresses()
 // and error() may be accessed immediately.
 func NewAddressParser(s string) AddressParser {
-	p := AddressParser{s: s}
+	return newAddressParser(s, false, false)
+}
+
+// Like NewAddressParser(), except that obsolete source routes such as the
+// "@a,@b:" in "<@a,@b:user@c>" are kept in each Address's Route instead of
+// being discarded. Gateways which rewrite routes need this; nothing else
+// should.
+func NewAddressParserWithRoutes(s string) AddressParser {
+	return newAddressParser(s, false, true)
+}
+
+// Like NewAddressParser(), except that if \a allowUTF8 is true, display-names
+// may contain raw UTF-8, as RFC 6532 permits, and if \a keepRoutes is true,
+// obsolete source routes are kept as NewAddressParserWithRoutes() describes.
+func newAddressParser(s string, allowUTF8, keepRoutes bool) AddressParser {
+	p := AddressParser{s: s, utf8: allowUTF8, keepRoutes: keepRoutes}
 	i := len(s) - 1
 	j := i + 1
 	colon := strings.Contains(s, ":")
@@ -374,6 +507,31 @@ func NewAddressParser(s string) AddressParser {
 	return p
 }
 
+// Parses \a s as a list of addresses, as NewAddressParser() does, and returns
+// the addresses found. If \a s is so badly broken that the parser's heuristics
+// can't recover any addresses from it, returns the first error seen instead.
+func ParseAddressList(s string) ([]Address, error) {
+	p := NewAddressParser(s)
+	if p.firstError != nil {
+		return nil, p.firstError
+	}
+	return p.Addresses, nil
+}
+
+// Parses \a s as a single regular address (whatever@example.com, perhaps with
+// a display-name) and returns it. Returns an error if \a s can't be parsed or
+// contains anything other than exactly one such address.
+func ParseAddress(s string) (Address, error) {
+	p := NewAddressParser(s)
+	if p.firstError == nil {
+		p.assertSingleAddress()
+	}
+	if p.firstError != nil {
+		return Address{}, p.firstError
+	}
+	return p.Addresses[0], nil
+}
+
 // Finds the point between \a left and \a right which is most likely to be the
 // border between two addresses. Mucho heuristics. Never used for correct
 // addresses, only when we're grasping at straws.
@@ -448,13 +606,18 @@ func (p *AddressParser) findBorder(left, right int) int {
 			b++
 			// see if the next domain component is a top-level domain
 			for _, tld := range tlds {
+				// tlds holds fully qualified names, e.g. "com."
+				tld = strings.TrimSuffix(tld, ".")
+				if tld == "" {
+					continue
+				}
 				l := len(tld)
-				if b+l <= right {
+				if b+l <= right && b+l < len(p.s) {
 					c := p.s[b+l]
 					if !(c >= 'a' && c <= 'z') &&
 						!(c >= 'A' && c <= 'Z') &&
 						!(c >= '0' && c <= '9') {
-						if strings.ToLower(p.s[b:l]) == tld {
+						if strings.ToLower(p.s[b:b+l]) == tld {
 							return b + l
 						}
 					}
@@ -481,7 +644,8 @@ func (p *AddressParser) findBorder(left, right int) int {
 // the case.
 func (p *AddressParser) assertSingleAddress() {
 	normal := 0
-	for _, a := range p.Addresses {
+	for i := range p.Addresses {
+		a := &p.Addresses[i]
 		if a.t == NormalAddressType {
 			normal++
 			if normal > 1 {
@@ -508,6 +672,9 @@ func (p *AddressParser) assertSingleAddress() {
 //
 // \a name is adjusted heuristically.
 func (p *AddressParser) add(name, localpart, domain string) {
+	route := p.pendingRoute
+	p.pendingRoute = ""
+
 	// if the localpart is too long, reject the add()
 	if len(localpart) > 256 {
 		p.recentError = fmt.Errorf("localpart too long (%d characters, RFC 2821's maximum is 64): %s@%s", len(localpart), localpart, domain)
@@ -518,7 +685,7 @@ func (p *AddressParser) add(name, localpart, domain string) {
 	}
 	// anti-outlook hackery, step 1: remove extra surrounding quotes
 	i := 0
-	for i < len(name)-1 &&
+	for i < len(name)-1-i &&
 		(name[i] == name[len(name)-1-i] &&
 			(name[i] == '\'' || name[i] == '"')) {
 		i++
@@ -545,17 +712,40 @@ func (p *AddressParser) add(name, localpart, domain string) {
 
 	a := NewAddress(name, localpart, domain)
 	a.err = p.recentError
+	a.Route = route
 
 	// Prepend, since addresses are detected in reverse
 	p.Addresses = append([]Address{a}, p.Addresses...)
 }
 
+// Returns true if \a name contains only printable characters. Non-ASCII
+// characters are accepted if this parser accepts UTF-8, or if the text being
+// parsed is ASCII, in which case they come from RFC 2047 encoded-words. Raw
+// 8-bit text in a display-name is otherwise in an unknown charset.
+func (p *AddressParser) displayable(name string) bool {
+	if (p.utf8 || isAscii(p.s)) && utf8.ValidString(name) {
+		for _, r := range name {
+			if unicode.IsControl(r) || r == utf8.RuneError {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 32 || name[i] >= 127 {
+			return false
+		}
+	}
+	return true
+}
+
 // This private function parses an address ending at position \a i and adds it
 // to the list.
 func (p *AddressParser) address(i int) int {
 	// we're presumably looking at an address
 	p.lastComment = ""
 	p.recentError = nil
+	p.pendingRoute = ""
 	i = p.comment(i)
 	s := p.s
 	for i > 0 && s[i] == ',' {
@@ -607,11 +797,11 @@ func (p *AddressParser) address(i int) int {
 		var dom string
 		dom, i = p.domain(i)
 		var lp, name string
-		if s[i] == '<' {
+		if i >= 0 && s[i] == '<' {
 			lp = dom
 			dom = ""
 		} else {
-			if s[i] == '@' {
+			if i >= 0 && s[i] == '@' {
 				i--
 				for i > 0 && s[i] == '@' {
 					i--
@@ -657,7 +847,7 @@ func (p *AddressParser) address(i int) int {
 					name = buf.String()
 				} else {
 					lp, i = p.localpart(i)
-					if s[i] != '<' {
+					if i >= 0 && s[i] != '<' {
 						j := i
 						for j >= 0 &&
 							((s[j] >= 'a' && s[j] <= 'z') ||
@@ -700,11 +890,7 @@ func (p *AddressParser) address(i int) int {
 		// if the display-name contains unknown-8bit or the
 		// undisplayable marker control characters, we drop the
 		// display-name.
-		j := 0
-		for j < len(name) && (name[j] >= 32 && name[j] < 127) {
-			j++
-		}
-		if j < len(name) {
+		if !p.displayable(name) {
 			name = ""
 		}
 		p.add(name, lp, dom)
@@ -713,14 +899,14 @@ func (p *AddressParser) address(i int) int {
 		i -= 3
 		var dom string
 		dom, i = p.domain(i)
-		if s[i] == '@' {
+		if i >= 0 && s[i] == '@' {
 			i--
 			for i > 0 && s[i] == '@' {
 				i--
 			}
 			var lp string
 			lp, i = p.localpart(i)
-			if s[i] == '<' {
+			if i >= 0 && s[i] == '<' {
 				i--
 				_, i = p.atom(i) // discard the "supplied" display-name
 				p.add("", lp, dom)
@@ -735,6 +921,7 @@ func (p *AddressParser) address(i int) int {
 	} else if s[i] == ';' && strings.Contains(s[:i], ":") {
 		// group
 		empty := true
+		before := len(p.Addresses)
 		i--
 		p.comment(i)
 		for i > 0 && s[i] != ':' {
@@ -745,19 +932,24 @@ func (p *AddressParser) address(i int) int {
 				p.setError("Parsing stopped while in group parser", i)
 				return i
 			}
-			if s[i] == ',' {
+			if i >= 0 && s[i] == ',' {
 				i--
-			} else if s[i] != ':' {
+			} else if i < 0 || s[i] != ':' {
 				p.setError("Expected : or ',' while parsing group", i)
 				return i
 			}
 		}
-		if s[i] == ':' {
+		if i >= 0 && s[i] == ':' {
 			i--
 			var name string
 			name, i = p.phrase(i)
 			if empty {
 				p.add(name, "", "")
+			} else {
+				// the members were prepended
+				for k := 0; k < len(p.Addresses)-before; k++ {
+					p.Addresses[k].group = simplify(name)
+				}
 			}
 		}
 	} else if s[i] == '"' && strings.Contains(s[:i], "%\"") {
@@ -811,22 +1003,23 @@ func (p *AddressParser) address(i int) int {
 		}
 		date := simplify(strings.ToLower(s[x+1 : i]))
 		dp := 0
-		c := date[0]
-		for dp < len(date) &&
-			((c >= 'a' && c <= 'z') ||
+		for dp < len(date) {
+			c := date[dp]
+			if !((c >= 'a' && c <= 'z') ||
 				(c >= 'A' && c <= 'Z') ||
 				(c >= '0' && c <= '9') ||
 				c == ' ' || c == '-' ||
 				c == ':' || c == '.') {
+				break
+			}
 			dp++
-			c = date[dp]
 		}
 		if dp == len(date) && strings.Contains(date, "-19") {
 			// at least it resembles the kind of date field we skip
 			i = x
 		}
 	} else if isQuoted(s, '"', '\'') && strings.Contains(s, "@") {
-		wrapped := NewAddressParser(unquote(s, '"', '\''))
+		wrapped := newAddressParser(unquote(s, '"', '\''), p.utf8, p.keepRoutes)
 		if wrapped.firstError == nil {
 			p.Addresses = append(p.Addresses, wrapped.Addresses...)
 			i = -1
@@ -929,7 +1122,7 @@ func (p *AddressParser) comment(i int) int {
 		// comment  = "(" *([FWS] ccontent) [FWS] ")"
 		i--
 		i = p.ccontent(i)
-		if p.s[i] != '(' {
+		if i < 0 || p.s[i] != '(' {
 			p.setError("Unbalanced comment: ", i)
 		} else {
 			ep := newParser(p.s[i : j+1])
@@ -946,11 +1139,16 @@ func (p *AddressParser) comment(i int) int {
 // This very private helper helps comment() handle nested comments. It advances
 // \a i to the start of a comment (where it points to '(').
 func (p *AddressParser) ccontent(i int) int {
-	for {
+	for i >= 0 {
 		if i > 0 && p.s[i-1] == '\\' {
 			i--
 		} else if p.s[i] == ')' {
+			j := i
 			i = p.comment(i)
+			if i < j {
+				// look at whatever the nested comment stopped at
+				continue
+			}
 		} else if p.s[i] == '(' {
 			return i
 		}
@@ -960,6 +1158,7 @@ func (p *AddressParser) ccontent(i int) int {
 		}
 		i--
 	}
+	return i
 }
 
 // This static helper removes quoted-pair from \a s and turns all sequences of
@@ -972,8 +1171,8 @@ func unqp(s string) string {
 		if s[j] == ' ' || s[j] == 9 ||
 			s[j] == 10 || s[j] == 13 {
 			sp = true
-			for s[j] == ' ' || s[j] == 9 ||
-				s[j] == 10 || s[j] == 13 {
+			for j < len(s) && (s[j] == ' ' || s[j] == 9 ||
+				s[j] == 10 || s[j] == 13) {
 				j++
 			}
 		} else {
@@ -981,7 +1180,7 @@ func unqp(s string) string {
 				buf.WriteByte(' ')
 				sp = false
 			}
-			if s[j] == '\\' {
+			if s[j] == '\\' && j+1 < len(s) {
 				j++
 				buf.WriteByte(s[j])
 				j++
@@ -1017,7 +1216,7 @@ func (p *AddressParser) domain(i int) (string, int) {
 		// scan for an unquoted IPv4 address and turn that into an
 		// address literal if found.
 		j := i
-		for (p.s[i] >= '0' && p.s[i] <= '9') || p.s[i] == '.' {
+		for i >= 0 && (p.s[i] >= '0' && p.s[i] <= '9' || p.s[i] == '.') {
 			i--
 		}
 		test := net.ParseIP(p.s[i+1 : j+1])
@@ -1034,11 +1233,22 @@ func (p *AddressParser) domain(i int) (string, int) {
 			i--
 		}
 		if i > 0 {
-			i--
 			// copy the string we fetched, turn FWS into a single
 			// space and unquote quoted-pair. we parse forward here
 			// because of quoted-pair.
-			dom = unqp(p.s[i+1 : j])
+			literal := unqp(p.s[i+1 : j+1])
+			i--
+			if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+				// RFC 5321 section 4.1.3: the tag is followed by
+				// an IPv6 address, which we check but leave as
+				// written.
+				literal = "IPv6:" + literal[5:]
+				addr := literal[5:]
+				if !strings.Contains(addr, ":") || net.ParseIP(addr) == nil {
+					p.setError("invalid IPv6 address literal: "+literal, i)
+				}
+			}
+			dom = "[" + literal + "]"
 		} else {
 			p.setError("literal Domain missing [", i)
 		}
@@ -1118,6 +1328,9 @@ func (p *AddressParser) phrase(i int) (string, int) {
 			}
 			if i < 0 || p.s[i] != '"' {
 				p.setError("quoted phrase must begin with '\"'", i)
+				if i < 0 {
+					i = 0
+				}
 			}
 			w := unquote(p.s[i:j+1], '"', '\'')
 			l := 0
@@ -1177,7 +1390,7 @@ func (p *AddressParser) phrase(i int) (string, int) {
 			if a == "" {
 				done = true
 			} else if strings.HasPrefix(a, "=?") {
-				p := newParser(a)
+				p := p.wordParser(a)
 				tmp := simplify(p.Phrase())
 				if strings.HasPrefix(tmp, "=?") || strings.Contains(tmp, "=?") {
 					drop = true
@@ -1212,6 +1425,17 @@ func (p *AddressParser) phrase(i int) (string, int) {
 	return simplify(r), i
 }
 
+// Returns a parser for the encoded-word \a w. The same parser is reused for
+// each word, since a long address list can contain very many.
+func (p *AddressParser) wordParser(w string) *parser {
+	if p.words == nil {
+		p.words = newParser(w)
+	} else {
+		p.words.reset(w)
+	}
+	return p.words
+}
+
 // This private function parses the localpart ending at \a i, and returns it as
 // a string.
 func (p *AddressParser) localpart(i int) (string, int) {
@@ -1222,7 +1446,7 @@ func (p *AddressParser) localpart(i int) (string, int) {
 		more = false
 	}
 	atomOnly := true
-	for more {
+	for more && i >= 0 {
 		w := ""
 		if p.s[i] == '"' {
 			atomOnly = false
@@ -1250,18 +1474,25 @@ func (p *AddressParser) localpart(i int) (string, int) {
 	return r, i
 }
 
-// If \a i points to an obs-route, this function silently skips the route.
+// If \a i points to an obs-route, this function skips the route, recording it
+// for the next add() if this parser keeps routes.
 func (p *AddressParser) route(i int) int {
 	if i < 0 || p.s[i] != ':' || p.firstError != nil {
 		return i
 	}
 
+	colon := i
 	i--
 	var dom string
 	dom, i = p.domain(i)
 	if dom == "mailto" {
 		return i
 	}
+	if i < 0 || p.s[i] != '@' {
+		// not a route; the colon probably ends a group's display-name
+		return colon
+	}
+	var route []string
 	for i >= 0 && dom != "" &&
 		(p.s[i] == ',' || p.s[i] == '@') {
 		if i >= 0 && p.s[i] == '@' {
@@ -1270,8 +1501,12 @@ func (p *AddressParser) route(i int) int {
 		for i >= 0 && p.s[i] == ',' {
 			i--
 		}
+		route = append([]string{dom}, route...)
 		dom, i = p.domain(i)
 	}
+	if p.keepRoutes && len(route) > 0 {
+		p.pendingRoute = "@" + strings.Join(route, ",@")
+	}
 	p.firstError = nil
 	p.recentError = nil
 	return i
@@ -1287,7 +1522,7 @@ func (p *AddressParser) setError(s string, i int) {
 	if i > 8 {
 		start = i - 8
 	}
-	end := 20
+	end := start + 20
 	if end > len(p.s) {
 		end = len(p.s)
 	}
@@ -1298,10 +1533,24 @@ func (p *AddressParser) setError(s string, i int) {
 	}
 }
 
-// Removes any addresses that exist twice in the list.
+// Returns true if the list contains an address equal to \a a. See
+// Address.Equal.
+func (as Addresses) Contains(a Address) bool {
+	for _, b := range as {
+		if b.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes any addresses that exist twice in the list. Both the localpart and
+// the domain are compared case-insensitively: RFC 5321 permits case-sensitive
+// localparts, but in practice nobody relies on that, and a list containing
+// both Foo@example.com and foo@example.com is almost certainly one recipient.
 func (as *Addresses) Uniquify() {
 	key := func(a Address) string {
-		return fmt.Sprintf("%s@%s", strings.ToTitle(a.Localpart), strings.ToTitle(a.Domain))
+		return fmt.Sprintf("%s@%s", strings.ToLower(a.Localpart), strings.ToLower(a.Domain))
 	}
 
 	if len(*as) == 0 {
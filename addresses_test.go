@@ -0,0 +1,330 @@
+package mail_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/paulrosania/go-mail"
+)
+
+func TestInternationalizedDomain(t *testing.T) {
+	a := mail.NewAddress("", "user", "münchen.example")
+	ascii, err := a.ASCIIDomain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "ASCII domain", ascii, "xn--mnchen-3ya.example")
+
+	b := mail.NewAddress("", "user", ascii)
+	testStringEquals(t, "Unicode domain", b.UnicodeDomain(), "münchen.example")
+	testStringEquals(t, "Unicode domain of Unicode domain", a.UnicodeDomain(), "münchen.example")
+
+	h, err := mail.ReadHeader("To: user@münchen.example\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Header avoiding UTF-8", h.AsText(true), "To: user@xn--mnchen-3ya.example\r\n")
+}
+
+func TestGroupRoundTrip(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"To: Team: a@example.com, b@example.com;\r\n", "To: Team: a@example.com, b@example.com;\r\n"},
+		{"To: Team:a@example.com,b@example.com;, c@example.com\r\n", "To: Team: a@example.com, b@example.com;, c@example.com\r\n"},
+		{"To: undisclosed-recipients:;\r\n", "To: undisclosed-recipients:;\r\n"},
+	}
+
+	for _, test := range tests {
+		h, err := mail.ReadHeader(test.in+"\r\n", mail.RFC5322Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, test.in, h.AsText(false), test.out)
+	}
+
+	h, err := mail.ReadHeader("To: Team: a@example.com, b@example.com;\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := h.Addresses("To")
+	if len(to) != 2 {
+		t.Fatalf("incorrect number of addresses: expected 2, got %d", len(to))
+	}
+	testStringEquals(t, "Group of first address", to[0].Group(), "Team")
+	testStringEquals(t, "Group of second address", to[1].Group(), "Team")
+}
+
+func TestRunTogetherAddresses(t *testing.T) {
+	p := mail.NewAddressParser("alice@example.com]bob@example.org")
+	if len(p.Addresses) != 2 {
+		t.Fatalf("incorrect number of addresses: expected 2, got %d", len(p.Addresses))
+	}
+	testStringEquals(t, "First address", p.Addresses[0].String(), "alice@example.com")
+	testStringEquals(t, "Second address", p.Addresses[1].String(), "bob@example.org")
+}
+
+func TestUniquify(t *testing.T) {
+	as := mail.Addresses{
+		mail.NewAddress("", "Foo", "Example.com"),
+		mail.NewAddress("", "foo", "example.com"),
+		mail.NewAddress("", "bar", "example.com"),
+	}
+	as.Uniquify()
+	if len(as) != 2 {
+		t.Fatalf("incorrect number of addresses: expected 2, got %d", len(as))
+	}
+	testStringEquals(t, "First address", as[0].String(), "Foo@Example.com")
+	testStringEquals(t, "Second address", as[1].String(), "bar@example.com")
+}
+
+func TestAddressEqual(t *testing.T) {
+	a := mail.NewAddress("Alice", "alice", "example.com")
+	tests := []struct {
+		b     mail.Address
+		equal bool
+	}{
+		{mail.NewAddress("Alice", "alice", "example.com"), true},
+		{mail.NewAddress("", "alice", "example.com"), true},
+		{mail.NewAddress("Someone Else", "alice", "EXAMPLE.com"), true},
+		{mail.NewAddress("Alice", "Alice", "example.com"), false},
+		{mail.NewAddress("Alice", "alice", "example.org"), false},
+	}
+
+	for _, test := range tests {
+		if a.Equal(test.b) != test.equal {
+			t.Errorf("incorrect Equal(%s): expected %v", test.b.String(), test.equal)
+		}
+	}
+
+	// Equal has a value receiver, so it works on values that aren't
+	// addressable
+	if !mail.NewAddress("", "bob", "example.com").Equal(mail.NewAddress("Bob", "bob", "example.com")) {
+		t.Error("Equal is false for a non-addressable Address")
+	}
+
+	as := mail.Addresses{mail.NewAddress("", "bob", "example.com"), a}
+	if !as.Contains(mail.NewAddress("", "alice", "Example.COM")) {
+		t.Error("list should contain alice@Example.COM")
+	}
+	if as.Contains(mail.NewAddress("", "carol", "example.com")) {
+		t.Error("list should not contain carol@example.com")
+	}
+}
+
+func TestAddressString(t *testing.T) {
+	tests := []struct {
+		name, localpart, domain string
+		str, ascii              string
+	}{
+		{"Doe, Jane", "jane", "example.com",
+			"\"Doe, Jane\" <jane@example.com>",
+			"\"Doe, Jane\" <jane@example.com>"},
+		{"Jürgen Müller", "juergen", "example.com",
+			"Jürgen Müller <juergen@example.com>",
+			"=?iso-8859-1?q?J=FCrgen_M=FCller?= <juergen@example.com>"},
+		{"", "john doe", "example.com",
+			"\"john doe\"@example.com",
+			"\"john doe\"@example.com"},
+	}
+
+	for _, test := range tests {
+		a := mail.NewAddress(test.name, test.localpart, test.domain)
+		testStringEquals(t, "String", a.String(), test.str)
+		testStringEquals(t, "ASCIIString", a.ASCIIString(), test.ascii)
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	as, err := mail.ParseAddressList("Alice <alice@example.com>, bob@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 2 {
+		t.Fatalf("incorrect number of addresses: expected 2, got %d", len(as))
+	}
+	testStringEquals(t, "First address", as[0].String(), "Alice <alice@example.com>")
+	testStringEquals(t, "Second address", as[1].String(), "bob@example.org")
+
+	// not an address list, but there's an address in there
+	as, err = mail.ParseAddressList("<<alice@example.com>> (\"Alice\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 {
+		t.Fatalf("incorrect number of recovered addresses: expected 1, got %d", len(as))
+	}
+	testStringEquals(t, "Recovered address", as[0].String(), "alice@example.com")
+
+	if _, err := mail.ParseAddressList("@"); err == nil {
+		t.Error("expected an error for an unrecoverable address list")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	a, err := mail.ParseAddress("Alice <alice@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Address", a.String(), "Alice <alice@example.com>")
+
+	if _, err := mail.ParseAddress("alice@example.com, bob@example.org"); err == nil {
+		t.Error("expected an error for two addresses")
+	}
+	if _, err := mail.ParseAddress("undisclosed-recipients:;"); err == nil {
+		t.Error("expected an error for an empty group")
+	}
+	if _, err := mail.ParseAddress(""); err == nil {
+		t.Error("expected an error for an empty string")
+	}
+}
+
+func TestAddressLiteral(t *testing.T) {
+	tests := []struct {
+		in, domain, out string
+	}{
+		{"u@[192.0.2.1]", "[192.0.2.1]", "u@[192.0.2.1]"},
+		{"u@[IPv6:2001:db8::1]", "[IPv6:2001:db8::1]", "u@[IPv6:2001:db8::1]"},
+		{"Alice <u@[ipv6:2001:DB8::1]>", "[IPv6:2001:DB8::1]", "Alice <u@[IPv6:2001:DB8::1]>"},
+	}
+	for _, test := range tests {
+		a, err := mail.ParseAddress(test.in)
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		testStringEquals(t, "Domain of "+test.in, a.Domain, test.domain)
+		testStringEquals(t, "String of "+test.in, a.String(), test.out)
+		if err := a.Validate(); err != nil {
+			t.Errorf("%s: %v", test.in, err)
+		}
+	}
+
+	for _, s := range []string{"u@[IPv6:2001:db8::zz]", "u@[IPv6:192.0.2.1]"} {
+		if _, err := mail.ParseAddress(s); err == nil {
+			t.Errorf("expected an error for %s", s)
+		}
+	}
+}
+
+func TestSourceRoutes(t *testing.T) {
+	s := "Bob <@relay.example,@gw.example:bob@example.com>, carol@example.org"
+
+	p := mail.NewAddressParserWithRoutes(s)
+	testIntegerEquals(t, "address count", len(p.Addresses), 2)
+	bob := p.Addresses[0]
+	testStringEquals(t, "route", bob.Route, "@relay.example,@gw.example")
+	testStringEquals(t, "address", bob.String(), "Bob <bob@example.com>")
+	testStringEquals(t, "second route", p.Addresses[1].Route, "")
+
+	// addresses with routes are still comparable
+	seen := map[mail.Address]bool{bob: true}
+	if !seen[p.Addresses[0]] {
+		t.Error("address not found in map")
+	}
+
+	p = mail.NewAddressParserWithRoutes("@a.example,,@b.example:u@c.example")
+	testIntegerEquals(t, "address count", len(p.Addresses), 1)
+	testStringEquals(t, "route", p.Addresses[0].Route, "@a.example,@b.example")
+	testStringEquals(t, "address", p.Addresses[0].String(), "u@c.example")
+
+	p = mail.NewAddressParser(s)
+	testIntegerEquals(t, "address count", len(p.Addresses), 2)
+	testStringEquals(t, "route", p.Addresses[0].Route, "")
+	testStringEquals(t, "address", p.Addresses[0].String(), "Bob <bob@example.com>")
+}
+
+func TestAddressValidate(t *testing.T) {
+	valid := mail.NewAddress("Alice", "alice", "mail.example.com")
+	if err := valid.Validate(); err != nil {
+		t.Errorf("alice@mail.example.com: %v", err)
+	}
+
+	invalid := []mail.Address{
+		mail.NewAddress("", strings.Repeat("a", 65), "example.com"),
+		mail.NewAddress("", "alice", strings.Repeat("a.", 120)+"example.com"),
+		mail.NewAddress("", "alice", ""),
+		mail.NewAddress("", "alice", "localhost"),
+		mail.NewAddress("", "", ""),
+		mail.NewAddress("undisclosed-recipients", "", ""),
+	}
+	for _, a := range invalid {
+		if err := a.Validate(); err == nil {
+			t.Errorf("expected an error for %q", a.String())
+		}
+	}
+}
+
+func TestEncodedDisplayName(t *testing.T) {
+	names := []string{
+		"José María Ñoño",
+		"Dr. José María Ñoño Jr",
+		"☺ Smiley",
+	}
+	for _, name := range names {
+		a := mail.NewAddress(name, "jose", "example.com")
+		s := a.ASCIIString()
+		// the whole phrase is encoded, not just one of its words
+		if strings.Contains(s, "Mar") && !strings.Contains(s, "Jos=E9_Mar=EDa_=D1o=F1o") {
+			t.Errorf("%q encoded as %q", name, s)
+		}
+
+		b, err := mail.ParseAddress(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, "Decoded display-name of "+s, b.String(), a.String())
+	}
+}
+
+func BenchmarkParseAddressList(b *testing.B) {
+	var as []string
+	for i := 0; i < 200; i++ {
+		as = append(as, fmt.Sprintf("=?iso-8859-1?q?Jos=E9_%d?= =?utf-8?b?4pi6?= <user%d@example.com>", i, i))
+		as = append(as, fmt.Sprintf("\"Doe, Jane %d\" <jane%d@example.org>", i, i))
+	}
+	s := strings.Join(as, ", ")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := mail.ParseAddressList(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzParseAddressList(f *testing.F) {
+	seeds := []string{
+		"alice@example.com",
+		"Alice <alice@example.com>, \"Doe, Jane\" <jane@example.org>",
+		"Team: alice@example.com, bob@example.org;",
+		"undisclosed-recipients:;",
+		"<>",
+		"=?iso-8859-1?q?Jos=E9?= <jose@example.com>",
+		"=?iso-8859-1?q?Jos=E9<jose@example.com>?=",
+		"NODE::USER",
+		"user@[IPv6:2001:db8::1]",
+		"user@1.2.3.4",
+		"@route,@other:user@example.com",
+		"(comment) user (more) @ example . com",
+		// inputs that once caused panics or hangs
+		"%@0",
+		"=?aa00000!0?q?A`a00?!.,00",
+		"0000000000000000000000000000:\";",
+		"Aaaaa<0@0>\"'\"<0>",
+		"0[" + strings.Repeat("0", 111) + " ]",
+		"0@0(\xcb\f" + strings.Repeat("\xbe", 200) + "\x00)",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		// errors are fine; panics are not
+		as, _ := mail.ParseAddressList(s)
+		for _, a := range as {
+			_ = a.String()
+			_ = a.ASCIIString()
+		}
+	})
+}
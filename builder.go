@@ -0,0 +1,239 @@
+package mail
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The Builder class assembles a new Message from its parts, without the
+// caller having to know how MIME structures mail.
+//
+// The body is a text/plain part, a text/html part, or both as a
+// multipart/alternative. If there are attachments, the body and the
+// attachments are wrapped in a multipart/mixed. Text is quoted-printable
+// encoded if necessary, attachments other than messages are base64 encoded.
+type Builder struct {
+	from, to, cc Addresses
+	subject      string
+	date         time.Time
+
+	text, html       string
+	hasText, hasHTML bool
+
+	attachments []attachment
+}
+
+type attachment struct {
+	filename, contentType string
+	data                  []byte
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Sets the From field to \a addrs, replacing any addresses set earlier.
+func (b *Builder) SetFrom(addrs ...Address) {
+	b.from = append(Addresses(nil), addrs...)
+}
+
+// Adds \a addrs to the To field.
+func (b *Builder) AddTo(addrs ...Address) {
+	b.to = append(b.to, addrs...)
+}
+
+// Adds \a addrs to the Cc field.
+func (b *Builder) AddCc(addrs ...Address) {
+	b.cc = append(b.cc, addrs...)
+}
+
+// Sets the Subject field to \a subject, which may contain any Unicode text.
+// Build() RFC 2047 encodes it where necessary.
+func (b *Builder) SetSubject(subject string) {
+	b.subject = subject
+}
+
+// Sets the Date field to \a t. If this is not called, Build() uses the
+// current time.
+func (b *Builder) SetDate(t time.Time) {
+	b.date = t
+}
+
+// Sets the text/plain body to \a text.
+func (b *Builder) SetText(text string) {
+	b.text = text
+	b.hasText = true
+}
+
+// Adds a text/html body, \a html. If SetText() is also called, the two are
+// sent as alternatives.
+func (b *Builder) AddHTML(html string) {
+	b.html = html
+	b.hasHTML = true
+}
+
+// Attaches \a data, which has the MIME type \a contentType (e.g.
+// "application/pdf") and is named \a filename.
+//
+// A message/rfc822 or message/global attachment is parsed and encapsulated
+// as it is, rather than base64 encoded, since RFC 2046 doesn't permit
+// encoding it. Build() fails for other message types.
+func (b *Builder) Attach(filename, contentType string, data []byte) {
+	b.attachments = append(b.attachments, attachment{filename, contentType, data})
+}
+
+// Assembles and returns the Message, or returns an error if the header or any
+// part would be invalid.
+func (b *Builder) Build() (*Message, error) {
+	if len(b.from) == 0 {
+		return nil, errors.New("No From address")
+	}
+
+	h := &Header{mode: RFC5322Header}
+	date := b.date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	h.Add(DateFieldName, date.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	h.addAddresses(FromFieldName, b.from)
+	h.addAddresses(ToFieldName, b.to)
+	h.addAddresses(CcFieldName, b.cc)
+	if b.subject != "" {
+		h.Add(SubjectFieldName, encodeText(b.subject))
+	}
+
+	var body []*Part
+	if b.hasText || !b.hasHTML && len(b.attachments) == 0 {
+		body = append(body, textBodyPart("plain", b.text))
+	}
+	if b.hasHTML {
+		body = append(body, textBodyPart("html", b.html))
+	}
+
+	var top *Part
+	if len(body) == 1 {
+		top = body[0]
+	} else if len(body) > 1 {
+		top = multipartBodyPart("alternative", body)
+	}
+	if len(b.attachments) > 0 {
+		var parts []*Part
+		if top != nil {
+			parts = append(parts, top)
+		}
+		for _, a := range b.attachments {
+			p, err := attachmentBodyPart(a)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, p)
+		}
+		top = multipartBodyPart("mixed", parts)
+	}
+
+	// the top-level entity's MIME fields belong in the message header
+	for _, f := range top.Header.Fields {
+		h.addField(f)
+	}
+	top.Header = h
+	h.Simplify()
+	if !h.Valid() {
+		return nil, h.err
+	}
+
+	m := NewMessage()
+	m.Part = top
+	m.Header = h
+	return m, nil
+}
+
+// Adds an address field named \a name containing \a addrs, unless \a addrs is
+// empty.
+func (h *Header) addAddresses(name string, addrs Addresses) {
+	if len(addrs) == 0 {
+		return
+	}
+	af := NewAddressField(name)
+	af.Addresses = append(Addresses(nil), addrs...)
+	h.addField(af)
+}
+
+// Returns a text/\a subtype Part containing \a text.
+func textBodyPart(subtype, text string) *Part {
+	h := &Header{mode: MIMEHeader}
+	text = toCRLF(text)
+	ct := "text/" + subtype
+	if !isAscii(text) {
+		ct += "; charset=utf-8"
+	}
+	h.Add(ContentTypeFieldName, ct)
+	if needsQP(text) {
+		h.Add(ContentTransferEncodingFieldName, "quoted-printable")
+	}
+	h.Simplify()
+	return &Part{Header: h, Text: text, hasText: true}
+}
+
+// Returns an attachment Part for \a a. Its data is base64 encoded, unless it
+// is an encapsulated message.
+func attachmentBodyPart(a attachment) (*Part, error) {
+	h := &Header{mode: MIMEHeader}
+	h.Add(ContentTypeFieldName, a.contentType)
+	ct := h.ContentType()
+	if ct == nil || !ct.Valid() {
+		return nil, fmt.Errorf("Invalid content type for %s: %q", a.filename, a.contentType)
+	}
+	if ct.Type == "message" && !isMessage(ct) {
+		return nil, fmt.Errorf("Cannot attach %s as %s/%s", a.filename, ct.Type, ct.Subtype)
+	}
+	h.Add(ContentDispositionFieldName, "attachment")
+	if a.filename != "" {
+		h.ContentDisposition().addParameter("filename", a.filename)
+	}
+	if isMessage(ct) {
+		return messageBodyPart(h, a.data)
+	}
+	h.Add(ContentTransferEncodingFieldName, "base64")
+	return &Part{Header: h, Data: string(a.data)}, nil
+}
+
+// Returns a Part with the header \a h which encapsulates the message \a
+// data, parsed the way the parser treats a message/rfc822 bodypart.
+func messageBodyPart(h *Header, data []byte) (*Part, error) {
+	p := &Part{Header: h, maxDepth: DefaultMaxNestingDepth}
+	m := NewMessage()
+	m.parent = p
+	if err := m.parse(string(data), 0); err != nil {
+		return nil, err
+	}
+	for _, c := range m.Parts {
+		p.Parts = append(p.Parts, c)
+		c.parent = p
+	}
+	p.message = m
+	return p, nil
+}
+
+// Returns a multipart/\a subtype Part containing \a parts.
+func multipartBodyPart(subtype string, parts []*Part) *Part {
+	h := &Header{mode: MIMEHeader}
+	h.Add(ContentTypeFieldName, "multipart/"+subtype+"; boundary="+GenerateBoundary())
+	p := &Part{Header: h, Parts: parts}
+	for i, c := range parts {
+		c.parent = p
+		c.Number = i + 1
+	}
+	p.settleBoundaries()
+	return p
+}
+
+// Returns a random string suitable for use as a MIME boundary. The result
+// contains only letters, digits and "=_", so it is legal according to RFC 2046
+// and cannot occur in quoted-printable or base64 text.
+func GenerateBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("=_%x", b)
+}
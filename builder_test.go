@@ -0,0 +1,231 @@
+package mail_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulrosania/go-mail"
+)
+
+func TestBuilderTextAndAttachment(t *testing.T) {
+	b := mail.NewBuilder()
+	b.SetFrom(mail.NewAddress("Alice", "alice", "example.com"))
+	b.AddTo(mail.NewAddress("", "bob", "example.com"))
+	b.AddCc(mail.NewAddress("", "carol", "example.com"))
+	b.SetSubject("Quarterly report")
+	b.SetDate(time.Date(2015, 11, 2, 10, 0, 0, 0, time.FixedZone("", -8*60*60)))
+	b.SetText("Report attached.\nCafé closes at five.\n")
+	b.Attach("report.pdf", "application/pdf", []byte("%PDF-1.4\n\x00\x01\x02\xff"))
+
+	built, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(built.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStringEquals(t, "From", msg.Header.Get("From"), "Alice <alice@example.com>")
+	testStringEquals(t, "To", msg.Header.Get("To"), "bob@example.com")
+	testStringEquals(t, "Cc", msg.Header.Get("Cc"), "carol@example.com")
+	testStringEquals(t, "Subject", msg.Header.Subject(), "Quarterly report")
+	testStringEquals(t, "Date", msg.Header.Get("Date"), "Mon, 02 Nov 2015 10:00:00 -0800")
+	testStringEquals(t, "Content-Type", msg.Header.ContentType().Type+"/"+msg.Header.ContentType().Subtype, "multipart/mixed")
+
+	text, ok := msg.PlainText()
+	if !ok {
+		t.Error("missing text/plain body")
+	}
+	testStringEquals(t, "Text", text, "Report attached.\r\nCafé closes at five.\r\n")
+
+	attachments := msg.Attachments()
+	if len(attachments) != 1 {
+		t.Fatalf("incorrect number of attachments: expected 1, got %d", len(attachments))
+	}
+	testStringEquals(t, "Attachment filename", attachments[0].Filename(), "report.pdf")
+	testStringEquals(t, "Attachment data", attachments[0].Data, "%PDF-1.4\n\x00\x01\x02\xff")
+
+	testStringEquals(t, "Reserialized message", msg.RFC822(false), built.RFC822(false))
+}
+
+func TestBuilderAlternative(t *testing.T) {
+	b := mail.NewBuilder()
+	b.SetFrom(mail.NewAddress("", "alice", "example.com"))
+	b.SetText("Hello")
+	b.AddHTML("<p>Hello</p>")
+
+	built, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(built.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Content-Type subtype", msg.Header.ContentType().Subtype, "alternative")
+	text, _ := msg.PlainText()
+	testStringEquals(t, "Text", text, "Hello\r\n")
+	html, _ := msg.HTML()
+	testStringEquals(t, "HTML", html, "<p>Hello</p>\r\n")
+}
+
+func TestBuilderText(t *testing.T) {
+	b := mail.NewBuilder()
+	b.SetFrom(mail.NewAddress("", "alice", "example.com"))
+	b.SetText("Hello")
+
+	built, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(built.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := msg.PlainText()
+	testStringEquals(t, "Text", text, "Hello\r\n")
+
+	if _, err := mail.NewBuilder().Build(); err == nil {
+		t.Error("expected an error building a message without a From address")
+	}
+}
+
+func TestBuilderUnicodeSubject(t *testing.T) {
+	b := mail.NewBuilder()
+	b.SetFrom(mail.NewAddress("", "alice", "example.com"))
+	b.SetSubject("Grüße aus Köln")
+	b.SetText("Hello")
+
+	built, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(built.RFC822(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Subject", msg.Header.Subject(), "Grüße aus Köln")
+}
+
+func TestBuilderTextAttachment(t *testing.T) {
+	b := mail.NewBuilder()
+	b.SetFrom(mail.NewAddress("", "alice", "example.com"))
+	b.SetText("See the attached notes.")
+	b.Attach("notes.txt", "text/plain", []byte("first line\nsecond line\n"))
+
+	built, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(built.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attachments := msg.Attachments()
+	if len(attachments) != 1 {
+		t.Fatalf("incorrect number of attachments: expected 1, got %d", len(attachments))
+	}
+	testStringEquals(t, "Attachment filename", attachments[0].Filename(), "notes.txt")
+	testStringEquals(t, "Attachment text", attachments[0].Text, "first line\r\nsecond line\r\n")
+}
+
+func TestBuilderMessageAttachment(t *testing.T) {
+	forwarded := "From: Carol <carol@example.com>\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: Minutes\r\n" +
+		"Date: Mon, 02 Nov 2015 09:00:00 -0800\r\n" +
+		"\r\n" +
+		"The minutes are below.\r\n"
+
+	b := mail.NewBuilder()
+	b.SetFrom(mail.NewAddress("", "alice", "example.com"))
+	b.SetText("Forwarding Carol's message.")
+	b.Attach("minutes.eml", "message/rfc822", []byte(forwarded))
+
+	built, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := built.RFC822(false)
+	if !strings.Contains(s, "Subject: Minutes\r\n") ||
+		!strings.Contains(s, "\r\n\r\nThe minutes are below.\r\n") {
+		t.Errorf("encapsulated message is not written as it is: %q", s)
+	}
+
+	msg, err := mail.ReadMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Parts) != 2 {
+		t.Fatalf("incorrect number of parts: expected 2, got %d", len(msg.Parts))
+	}
+	p := msg.Parts[1]
+	testStringEquals(t, "Content-Type", p.Header.ContentTypeString(), "message/rfc822")
+	if p.Header.ContentTransferEncoding() != nil {
+		t.Error("encapsulated message has a Content-Transfer-Encoding")
+	}
+	testStringEquals(t, "Reserialized message", msg.RFC822(false), s)
+
+	b.Attach("status.txt", "message/delivery-status", []byte("Reporting-MTA: dns; example.com\n"))
+	if _, err := b.Build(); err == nil {
+		t.Error("expected an error attaching a message/delivery-status")
+	}
+}
+
+func TestGenerateBoundary(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		b := mail.GenerateBoundary()
+		if len(b) == 0 || len(b) > 70 {
+			t.Fatalf("boundary %q has illegal length %d", b, len(b))
+		}
+		for _, c := range b {
+			if !strings.ContainsRune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ'()+_,-./:=? ", c) {
+				t.Fatalf("boundary %q contains illegal character %q", b, c)
+			}
+		}
+		if seen[b] {
+			t.Fatalf("boundary %q generated twice", b)
+		}
+		seen[b] = true
+	}
+}
+
+func TestBoundaryCollision(t *testing.T) {
+	msg, err := mail.ReadMessage("From: a@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: multipart/mixed; boundary=xyz\r\n" +
+		"\r\n" +
+		"--xyz\r\n" +
+		"\r\n" +
+		"first\r\n" +
+		"--xyz\r\n" +
+		"\r\n" +
+		"second\r\n" +
+		"--xyz--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make the first part contain the boundary
+	msg.Parts[0].Text = "--xyz\r\n"
+
+	reparsed, err := mail.ReadMessage(msg.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := reparsed.Header.ContentType().Parameters[0].Value; b == "xyz" {
+		t.Error("boundary occurring in a part was not replaced")
+	}
+	if len(reparsed.Parts) != 2 {
+		t.Fatalf("incorrect number of parts: expected 2, got %d", len(reparsed.Parts))
+	}
+	testStringEquals(t, "Part 1 text", reparsed.Parts[0].Text, "--xyz\r\n")
+	testStringEquals(t, "Part 2 text", reparsed.Parts[1].Text, "second\r\n")
+}
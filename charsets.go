@@ -0,0 +1,184 @@
+package mail
+
+import "unicode"
+
+// The upper halves (0xA0-0xFF) of ISO-8859-2 and ISO-8859-15, for the
+// guessing done by guessLegacyCodec(). The upper half of ISO-8859-1 is
+// identical to Unicode.
+var iso88592 = []rune(
+	"\u00a0Ą˘Ł¤ĽŚ§¨ŠŞŤŹ\u00adŽŻ°ą˛ł´ľśˇ¸šşťź˝žż" +
+		"ŔÁÂĂÄĹĆÇČÉĘËĚÍÎĎĐŃŇÓÔŐÖ×ŘŮÚŰÜÝŢß" +
+		"ŕáâăäĺćçčéęëěíîďđńňóôőö÷řůúűüýţ˙")
+
+var iso885915 = map[byte]rune{
+	0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž',
+	0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+}
+
+// The characters Windows-1252 assigns to 0x80-0x9F, where ISO-8859-1 has C1
+// controls. Zero marks the five unassigned code points.
+var windows1252 = []rune(
+	"€\x00‚ƒ„…†‡ˆ‰Š‹Œ\x00Ž\x00\x00‘’“”•–—˜™š›œ\x00žŸ")
+
+// Returns the character the byte \a b stands for in the single-byte charset
+// \a cs, which must be one of those considered by guessLegacyCodec().
+func legacyRune(cs string, b byte) rune {
+	switch {
+	case b < 0x80:
+		return rune(b)
+	case b < 0xA0:
+		if cs == "windows-1252" {
+			return windows1252[b-0x80]
+		}
+	case cs == "iso-8859-2":
+		return iso88592[b-0xA0]
+	case cs == "iso-8859-15":
+		if r, ok := iso885915[b]; ok {
+			return r
+		}
+	}
+	return rune(b)
+}
+
+// Returns the name of the legacy charset that \a body, which is neither ASCII
+// nor UTF-8, most plausibly uses, or an empty string if there is no plausible
+// candidate.
+//
+// Japanese text is recognized by its structure, which Latin text rarely
+// matches by accident. Otherwise, each single-byte candidate is scored by how
+// often its interpretation of the 8-bit bytes yields letters where letters
+// are expected, and penalized for symbols in the middle of words and for
+// rarely used symbols. Ties go to the earlier, more common candidate.
+func guessLegacyCodec(body string) string {
+	if looksLikeEUCJP(body) {
+		return "euc-jp"
+	}
+	if looksLikeShiftJIS(body) {
+		return "shift_jis"
+	}
+
+	if isAscii(body) {
+		return ""
+	}
+	candidates := []string{"iso-8859-1", "iso-8859-15", "iso-8859-2"}
+	for i := 0; i < len(body); i++ {
+		if body[i] >= 0x80 && body[i] < 0xA0 {
+			candidates = []string{"windows-1252"}
+			break
+		}
+	}
+
+	best := ""
+	bestScore := 0
+	for _, cs := range candidates {
+		score, ok := legacyScore(body, cs)
+		if ok && (best == "" || score > bestScore) {
+			best = cs
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// Returns the plausibility score of \a body in the single-byte charset \a cs,
+// and false if \a body contains a byte \a cs doesn't assign.
+func legacyScore(body, cs string) (int, bool) {
+	isWordChar := func(i int) bool {
+		if i < 0 || i >= len(body) {
+			return false
+		}
+		return body[i] >= 0x80 || unicode.IsLetter(rune(body[i]))
+	}
+
+	score := 0
+	for i := 0; i < len(body); i++ {
+		b := body[i]
+		if b < 0x80 {
+			continue
+		}
+		r := legacyRune(cs, b)
+		if r == 0 || (r >= 0x80 && r < 0xA0) {
+			return 0, false
+		}
+		inWord := isWordChar(i-1) || isWordChar(i+1)
+		switch {
+		case unicode.IsLetter(r):
+			if inWord {
+				score++
+			}
+		case r == '¤' || r == '¦' || r == '¨' || r == '´' || r == '¸':
+			score -= 2
+		case isWordChar(i-1) && isWordChar(i+1):
+			score--
+		}
+	}
+	return score, true
+}
+
+// Returns true if \a body is valid EUC-JP and contains at least two
+// consecutive double-byte characters.
+func looksLikeEUCJP(body string) bool {
+	consecutive := false
+	last := -1
+	for i := 0; i < len(body); i++ {
+		b := body[i]
+		if b < 0x80 {
+			continue
+		}
+		start := i
+		switch {
+		case b == 0x8E:
+			if i+1 >= len(body) || body[i+1] < 0xA1 || body[i+1] > 0xDF {
+				return false
+			}
+			i++
+		case b == 0x8F:
+			if i+2 >= len(body) || !isEUCByte(body[i+1]) || !isEUCByte(body[i+2]) {
+				return false
+			}
+			i += 2
+		case isEUCByte(b):
+			if i+1 >= len(body) || !isEUCByte(body[i+1]) {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+		if last >= 0 && last == start {
+			consecutive = true
+		}
+		last = i + 1
+	}
+	return consecutive
+}
+
+func isEUCByte(b byte) bool {
+	return b >= 0xA1 && b <= 0xFE
+}
+
+// Returns true if \a body is valid Shift_JIS and contains at least two
+// consecutive double-byte characters.
+func looksLikeShiftJIS(body string) bool {
+	consecutive := false
+	last := -1
+	for i := 0; i < len(body); i++ {
+		b := body[i]
+		if b < 0x80 || (b >= 0xA1 && b <= 0xDF) {
+			continue
+		}
+		if !(b >= 0x81 && b <= 0x9F || b >= 0xE0 && b <= 0xFC) || i+1 >= len(body) {
+			return false
+		}
+		t := body[i+1]
+		if t < 0x40 || t == 0x7F || t > 0xFC {
+			return false
+		}
+		if last >= 0 && last == i {
+			consecutive = true
+		}
+		i++
+		last = i + 1
+	}
+	return consecutive
+}
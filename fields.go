@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/paulrosania/go-charset/charset"
 )
@@ -44,9 +45,16 @@ const (
 	ContentLanguageFieldName         = "Content-Language"
 	ContentLocationFieldName         = "Content-Location"
 	ContentMd5FieldName              = "Content-Md5"
-	ListIdFieldName                  = "List-Id"
+	ListIdFieldName                  = "List-ID"
+	ListUnsubscribeFieldName         = "List-Unsubscribe"
+	ListUnsubscribePostFieldName     = "List-Unsubscribe-Post"
 	ContentBaseFieldName             = "Content-Base"
 	ErrorsToFieldName                = "Errors-To"
+	AuthenticationResultsFieldName   = "Authentication-Results"
+	ReceivedSPFFieldName             = "Received-SPF"
+	DKIMSignatureFieldName           = "DKIM-Signature"
+	AutoSubmittedFieldName           = "Auto-Submitted"
+	PrecedenceFieldName              = "Precedence"
 )
 
 var addressFieldNames = []string{
@@ -98,8 +106,15 @@ var fieldNames = []string{
 	ContentLocationFieldName,
 	ContentMd5FieldName,
 	ListIdFieldName,
+	ListUnsubscribeFieldName,
+	ListUnsubscribePostFieldName,
 	ContentBaseFieldName,
 	ErrorsToFieldName,
+	AuthenticationResultsFieldName,
+	ReceivedSPFFieldName,
+	DKIMSignatureFieldName,
+	AutoSubmittedFieldName,
+	PrecedenceFieldName,
 }
 
 var isKnownField map[string]bool
@@ -120,14 +135,24 @@ type Field interface {
 	Valid() bool
 	UnparsedValue() string
 	SetUnparsedValue(value string)
+	Raw() string
 
 	rfc822(avoidUTF8 bool) string
+	setUTF8(allowUTF8 bool)
+	setRaw(raw string)
+	lastRaw() string
 }
 
 type HeaderField struct {
 	name, value   string
 	unparsedValue string
 	err           error
+
+	// true if the value may contain raw UTF-8 (RFC 6532)
+	utf8 bool
+
+	// the text of each field read into this one; see Raw()
+	raw []string
 }
 
 func (f *HeaderField) Name() string {
@@ -142,6 +167,38 @@ func (f *HeaderField) Error() error {
 	return f.err
 }
 
+// Returns the field exactly as it was read by ReadHeader(), from the start of
+// its name to the end of its value, including any folding but not the final
+// line break. This is what DKIM and similar schemes sign. Returns an empty
+// string if the field wasn't read from a message, and for address fields
+// into which ReadHeader() merged later fields of the same name, it is the
+// first field's text.
+func (f *HeaderField) Raw() string {
+	if len(f.raw) == 0 {
+		return ""
+	}
+	return f.raw[0]
+}
+
+func (f *HeaderField) setRaw(raw string) {
+	f.raw = []string{raw}
+}
+
+// Like Raw(), except that for an address field into which ReadHeader()
+// merged later fields of the same name, this returns the last field's text.
+func (f *HeaderField) lastRaw() string {
+	if len(f.raw) == 0 {
+		return ""
+	}
+	return f.raw[len(f.raw)-1]
+}
+
+// Records whether Parse() should accept raw UTF-8 in the field value, as RFC
+// 6532 permits, instead of treating it as an error.
+func (f *HeaderField) setUTF8(allowUTF8 bool) {
+	f.utf8 = allowUTF8
+}
+
 // Every HeaderField subclass must define a parse() function that takes a
 // string \a s from a message and sets the field value(). This default function
 // handles fields that are not specially handled by subclasses using functions
@@ -154,7 +211,8 @@ func (f *HeaderField) Parse(s string) {
 		ContentIDFieldName, ResentMessageIDFieldName, ReferencesFieldName, DateFieldName,
 		OrigDateFieldName, ResentDateFieldName, ContentTypeFieldName,
 		ContentTransferEncodingFieldName, ContentDispositionFieldName,
-		ContentLanguageFieldName:
+		ContentLanguageFieldName, ReceivedFieldName, ListIdFieldName,
+		ListUnsubscribeFieldName:
 		// These should be handled by their own parse()
 	case ContentDescriptionFieldName, SubjectFieldName, CommentsFieldName:
 		f.parseText(s)
@@ -162,12 +220,14 @@ func (f *HeaderField) Parse(s string) {
 		f.parseMIMEVersion(s)
 	case ContentLocationFieldName:
 		f.parseContentLocation(s)
-	case InReplyToFieldName, KeywordsFieldName, ReceivedFieldName, ContentMd5FieldName:
+	case InReplyToFieldName, KeywordsFieldName, ContentMd5FieldName:
 		f.parseOther(s)
 	case ContentBaseFieldName:
 		f.parseContentBase(s)
 	case ErrorsToFieldName:
 		f.parseErrorsTo(s)
+	case PrecedenceFieldName:
+		f.parsePrecedence(s)
 	default:
 		f.parseOther(s)
 	}
@@ -177,9 +237,11 @@ func (f *HeaderField) Parse(s string) {
 // by RFC 2047. This is used to parse the Subject and Comments fields.
 func (f *HeaderField) parseText(s string) {
 	h := false
+	allowUTF8 := f.utf8 && utf8.ValidString(s)
 
 	if !h {
 		p := newParser(s)
+		p.utf8 = allowUTF8
 		t := p.Text()
 		if p.AtEnd() {
 			f.value = trim(t)
@@ -189,6 +251,7 @@ func (f *HeaderField) parseText(s string) {
 
 	if !h {
 		p := newParser(simplify(s))
+		p.utf8 = allowUTF8
 		t := p.Text()
 		if p.AtEnd() {
 			f.value = t
@@ -222,6 +285,7 @@ func (f *HeaderField) parseText(s string) {
 			}
 		}
 		p2 := newParser(tmp.String())
+		p2.utf8 = allowUTF8
 		t := simplify(p2.Text())
 		if p2.AtEnd() && !strings.Contains(t, "?=") {
 			f.value = t
@@ -239,7 +303,9 @@ func (f *HeaderField) parseText(s string) {
 //
 // Only version 1.0 is legal. Since vast numbers of spammers send other version
 // numbers, we replace other version numbers with 1.0 and a comment. Bayesian
-// analysis tools will probably find the comment to be a sure spam sign.
+// analysis tools will probably find the comment to be a sure spam sign. The
+// sender's own comment is kept if it is legal, since it often identifies the
+// sending program, and our note follows it.
 func (f *HeaderField) parseMIMEVersion(s string) {
 	p := newParser(s)
 	p.Comment()
@@ -249,13 +315,14 @@ func (f *HeaderField) parseMIMEVersion(s string) {
 	if err != nil || strings.ContainsAny(c, "()\\") {
 		c = ""
 	}
-	if v != "1.0" || !p.AtEnd() {
-		c = "Note: Original mime-version had syntax problems"
-	}
 	result := "1.0"
 	if c != "" {
 		result += " (" + c + ")"
 	}
+	note := "Note: Original mime-version had syntax problems"
+	if (v != "1.0" || !p.AtEnd()) && c != note {
+		result += " (" + note + ")"
+	}
 	f.value = result
 }
 
@@ -337,6 +404,10 @@ func (f *HeaderField) parseContentLocation(s string) {
 // Tries to parses any (otherwise uncovered and presumably unstructured) field
 // in \a s, and records an error if it contains NULs or 8-bit characters.
 func (f *HeaderField) parseOther(s string) {
+	if f.utf8 && utf8.ValidString(s) {
+		f.value = s
+		return
+	}
 	v, err := decode(s, "us-ascii")
 	if err != nil {
 		f.err = err
@@ -344,6 +415,21 @@ func (f *HeaderField) parseOther(s string) {
 	f.value = v
 }
 
+// Parses the Precedence field in \a s, which is not standardized but usually
+// contains a single word such as "bulk", "list" or "junk". The word is
+// lowercased, and comments are dropped.
+func (f *HeaderField) parsePrecedence(s string) {
+	p := newParser(s)
+	v := strings.ToLower(p.MIMEToken())
+	p.Comment()
+	if v == "" || !p.AtEnd() {
+		f.err = fmt.Errorf("Unparseable value: %q", s)
+		f.value = simplify(s)
+		return
+	}
+	f.value = v
+}
+
 // Parses the Content-Base header field in \a s and records the first problem
 // found. Somewhat overflexibly assumes that if there is a colon, the URL is
 // absolute, so it accepts -:/asr as a valid URL.
@@ -391,6 +477,19 @@ func (f *HeaderField) SetUnparsedValue(value string) {
 	f.unparsedValue = value
 }
 
+// Sets the value of this field to \a value. This is meant for the Parse()
+// functions of fields registered with RegisterField().
+func (f *HeaderField) SetValue(value string) {
+	f.value = value
+}
+
+// Records \a err as the problem found while parsing this field, or clears it
+// if \a err is nil. This is meant for the Parse() functions of fields
+// registered with RegisterField().
+func (f *HeaderField) SetError(err error) {
+	f.err = err
+}
+
 type AddressField struct {
 	HeaderField
 	Addresses Addresses
@@ -423,7 +522,7 @@ func (f *AddressField) rfc822(avoidUTF8 bool) string {
 			s = "<" + f.Addresses[0].toString(false) + ">"
 		} else {
 			s = f.Name() + ": " + ascii(f.Value())
-			s = wrap(simplify(s), 78, "", " ", false)
+			s = wrap(simplify(s), 78, "", " ", false, 0)
 			p := len(f.Name()) + 1
 			for p < len(s) &&
 				(s[p] == ' ' || s[p] == '\r' || s[p] == '\n') {
@@ -461,10 +560,23 @@ func (f *AddressField) rfc822(avoidUTF8 bool) string {
 
 			if f.Name() == ReferencesFieldName {
 				a = "<" + a + ">"
+			} else if addr.group != "" {
+				if i == 0 || f.Addresses[i-1].group != addr.group {
+					a = displayName(addr.group, avoidUTF8) + ": " + a
+				}
+				if i+1 == len(f.Addresses) || f.Addresses[i+1].group != addr.group {
+					a += ";"
+				}
 			}
 
 			if first {
 				first = false
+				if f.Name() == ReferencesFieldName && c+len(a) > 78 {
+					// a message-id can't be broken, so an
+					// over-long one gets a line of its own
+					s += lsep
+					c = lpos
+				}
 			} else if (c+len(wsep)+len(a) > 78) ||
 				(c+len(wsep)+len(a) == 78 && len(f.Addresses) > i+1) {
 				s += lsep
@@ -588,7 +700,7 @@ func (f *AddressField) Parse(s string) {
 // Parses the RFC 2822 address-list production from \a s and records the first
 // problem found.
 func (f *AddressField) parseAddressList(s string) {
-	ap := NewAddressParser(s)
+	ap := newAddressParser(s, f.utf8, false)
 	f.err = ap.firstError
 	f.Addresses = ap.Addresses
 }
@@ -747,9 +859,10 @@ func NewDateField() *DateField {
 var dateLayouts []string
 
 func init() {
-	// Generate layouts based on RFC 5322, section 3.3.
+	// Generate layouts based on RFC 5322, section 3.3. There is no
+	// day-of-week, since normalizeDate removes it.
 
-	dows := [...]string{"", "Mon, "}   // day-of-week
+	dows := [...]string{""}            // day-of-week
 	days := [...]string{"2", "02"}     // day = 1*2DIGIT
 	years := [...]string{"2006", "06"} // year = 4*DIGIT / 2*DIGIT
 	seconds := [...]string{":05", ""}  // second
@@ -770,17 +883,130 @@ func init() {
 	}
 }
 
-func parseDate(s string) *time.Time {
+// The offsets of the named zones permitted by RFC 5322 section 4.3. time.Parse
+// only knows the offset of a zone name if it happens to be the local zone.
+var obsZones = map[string]int{
+	"UT":  0,
+	"GMT": 0,
+	"EST": -5 * 60 * 60,
+	"EDT": -4 * 60 * 60,
+	"CST": -6 * 60 * 60,
+	"CDT": -5 * 60 * 60,
+	"MST": -7 * 60 * 60,
+	"MDT": -6 * 60 * 60,
+	"PST": -8 * 60 * 60,
+	"PDT": -7 * 60 * 60,
+}
+
+var dayNames = [...]string{
+	"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday",
+}
+
+var monthNames = [...]string{
+	"january", "february", "march", "april", "may", "june", "july",
+	"august", "september", "october", "november", "december",
+}
+
+// Returns the full name in \a names of which \a w is a case-insensitive
+// abbreviation of at least three letters, or "" if there is none.
+func fullName(names []string, w string) string {
+	w = strings.ToLower(w)
+	if len(w) < 3 {
+		return ""
+	}
+	for _, n := range names {
+		if strings.HasPrefix(n, w) {
+			return n
+		}
+	}
+	return ""
+}
+
+// Rewrites the common deviations from RFC 5322 in the date \a s so that one
+// of dateLayouts can match: The day of the week is removed (it's redundant,
+// and often misspelled or missing its comma), month names are abbreviated,
+// day-month-year may be separated by hyphens, and the zone is turned into
+// something time.Parse understands. A missing zone is taken to be -0000.
+func normalizeDate(s string) string {
 	s = simplify(stripcomments(s))
+	s = strings.Replace(s, ",", " ", -1)
+
+	var words []string
+	for _, w := range strings.Fields(s) {
+		if strings.Count(w, "-") == 2 && !strings.HasPrefix(w, "-") {
+			words = append(words, strings.Split(w, "-")...)
+		} else {
+			words = append(words, w)
+		}
+	}
+
+	if len(words) > 0 && fullName(dayNames[:], strings.TrimSuffix(words[0], ".")) != "" {
+		words = words[1:]
+	}
+
+	for i, w := range words {
+		if m := fullName(monthNames[:], strings.TrimSuffix(w, ".")); m != "" {
+			words[i] = strings.ToUpper(m[:1]) + m[1:3]
+		}
+	}
+
+	if len(words) == 0 {
+		return ""
+	}
+
+	zone := words[len(words)-1]
+	upper := strings.ToUpper(zone)
+	switch {
+	case strings.Contains(zone, ":") && !strings.HasPrefix(zone, "+") &&
+		!strings.HasPrefix(zone, "-"):
+		// the last word is the time, so there is no zone
+		words = append(words, "-0000")
+	case upper == "UT" || upper == "Z":
+		words[len(words)-1] = "+0000"
+	case len(upper) == 1 && upper[0] >= 'A' && upper[0] <= 'Z':
+		// RFC 5322 says military zones other than Z must be treated as
+		// -0000, since RFC 822 got their signs wrong.
+		words[len(words)-1] = "-0000"
+	case len(zone) == 6 && (zone[0] == '+' || zone[0] == '-') && zone[3] == ':':
+		words[len(words)-1] = zone[:3] + zone[4:]
+	case (strings.HasPrefix(upper, "GMT") || strings.HasPrefix(upper, "UTC")) &&
+		len(zone) == 8 && (zone[3] == '+' || zone[3] == '-'):
+		words[len(words)-1] = zone[3:]
+	default:
+		words[len(words)-1] = upper
+	}
+
+	return strings.Join(words, " ")
+}
+
+func parseDate(s string) *time.Time {
+	s = normalizeDate(s)
 	for _, layout := range dateLayouts {
 		t, err := time.Parse(layout, s)
 		if err == nil {
+			name, _ := t.Zone()
+			if offset, ok := obsZones[name]; ok && strings.HasSuffix(s, name) {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(),
+					t.Second(), 0, time.FixedZone(name, offset))
+			}
 			return &t
 		}
 	}
 	return nil
 }
 
+// Returns the parsed date, in the zone and with the offset given in the
+// field, or the zero time if the field could not be parsed.
+func (f *DateField) Time() time.Time {
+	if f.Date == nil {
+		return time.Time{}
+	}
+	return *f.Date
+}
+
+// Parses \a s and records the date with its original offset intact. The
+// field's value is the canonical RFC 5322 form of that date.
+//
 // TODO: Evaluate aox implementation, might be more lenient
 func (f *DateField) Parse(s string) {
 	t := parseDate(s)
@@ -792,6 +1018,439 @@ func (f *DateField) Parse(s string) {
 	f.err = errors.New("mail: header could not be parsed")
 }
 
+type ReceivedField struct {
+	HeaderField
+	From, By, Via, With, ID, For string
+	When                         *time.Time
+}
+
+func NewReceivedField() *ReceivedField {
+	hf := HeaderField{name: ReceivedFieldName}
+	return &ReceivedField{HeaderField: hf}
+}
+
+// Parses the RFC 5322 received production from \a s. Every clause is
+// optional, and since incomplete or oddly ordered Received fields are common,
+// no error is recorded for clauses that are missing or not understood.
+func (f *ReceivedField) Parse(s string) {
+	f.parseOther(s)
+
+	tokens := s
+	if i := strings.LastIndex(s, ";"); i >= 0 {
+		tokens = s[:i]
+		f.When = parseDate(s[i+1:])
+	}
+
+	words := strings.Split(simplify(stripcomments(tokens)), " ")
+	for i := 0; i+1 < len(words); i++ {
+		var clause *string
+		switch strings.ToLower(words[i]) {
+		case "from":
+			clause = &f.From
+		case "by":
+			clause = &f.By
+		case "via":
+			clause = &f.Via
+		case "with":
+			clause = &f.With
+		case "id":
+			clause = &f.ID
+		case "for":
+			clause = &f.For
+		}
+		if clause != nil && *clause == "" {
+			i++
+			*clause = words[i]
+		}
+	}
+}
+
+type ListIdField struct {
+	HeaderField
+	Description string
+	Identifier  string
+}
+
+func NewListIdField() *ListIdField {
+	hf := HeaderField{name: ListIdFieldName}
+	return &ListIdField{HeaderField: hf}
+}
+
+// Parses the RFC 2919 list-id production from \a s: an optional phrase
+// describing the list, followed by the list identifier in angle brackets.
+// Encoded-words in the description are decoded.
+func (f *ListIdField) Parse(s string) {
+	f.parseOther(s)
+
+	lt := strings.LastIndex(s, "<")
+	gt := strings.LastIndex(s, ">")
+	if lt < 0 || gt < lt {
+		f.err = fmt.Errorf("List-ID must contain an identifier in angle brackets: %q", s)
+		return
+	}
+
+	f.Identifier = simplify(s[lt+1 : gt])
+	p := newParser(s[:lt])
+	f.Description = simplify(p.Phrase())
+}
+
+type ListUnsubscribeField struct {
+	HeaderField
+	URIs []string
+}
+
+func NewListUnsubscribeField() *ListUnsubscribeField {
+	hf := HeaderField{name: ListUnsubscribeFieldName}
+	return &ListUnsubscribeField{HeaderField: hf}
+}
+
+// Parses the RFC 2369 List-Unsubscribe field in \a s, which is a
+// comma-separated list of URIs in angle brackets. Whitespace inside the
+// brackets is removed, and the first problem found is recorded.
+func (f *ListUnsubscribeField) Parse(s string) {
+	f.parseOther(s)
+
+	p := newParser(s)
+	for {
+		p.Comment()
+		if !p.Present("<") {
+			break
+		}
+		var buf bytes.Buffer
+		for !p.AtEnd() && p.NextChar() != '>' {
+			c := p.NextChar()
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				buf.WriteByte(c)
+			}
+			p.Step(1)
+		}
+		p.require(">")
+		if !p.Valid() {
+			break
+		}
+		if buf.Len() > 0 {
+			f.URIs = append(f.URIs, buf.String())
+		}
+		p.Comment()
+		if !p.Present(",") {
+			break
+		}
+	}
+
+	if !p.AtEnd() || len(f.URIs) == 0 {
+		f.err = fmt.Errorf("Unparseable value: %q", s)
+	}
+}
+
+// Returns the mailto: URIs in this field, in the order in which they appear.
+func (f *ListUnsubscribeField) MailtoURIs() []string {
+	return f.urisWithScheme("mailto")
+}
+
+// Returns the http: and https: URIs in this field, in the order in which they
+// appear.
+func (f *ListUnsubscribeField) HTTPURIs() []string {
+	return f.urisWithScheme("http", "https")
+}
+
+func (f *ListUnsubscribeField) urisWithScheme(schemes ...string) []string {
+	var r []string
+	for _, u := range f.URIs {
+		scheme := strings.ToLower(section(u, ":", 1))
+		for _, s := range schemes {
+			if scheme == s {
+				r = append(r, u)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// An AuthenticationResult is one method's verdict from an
+// Authentication-Results field, e.g. "dkim=pass header.d=example.com".
+// Method, Result and the property names are lowercased; Properties maps
+// "ptype.property" (e.g. "smtp.mailfrom") to its value.
+type AuthenticationResult struct {
+	Method, Result string
+	Reason         string
+	Properties     map[string]string
+}
+
+type AuthenticationResultsField struct {
+	HeaderField
+	AuthServID string
+	Results    []AuthenticationResult
+}
+
+func NewAuthenticationResultsField() *AuthenticationResultsField {
+	hf := HeaderField{name: AuthenticationResultsFieldName}
+	return &AuthenticationResultsField{HeaderField: hf}
+}
+
+// Parses the RFC 8601 Authentication-Results field in \a s: the authserv-id,
+// an optional version, and then either "none" or a semicolon-separated list
+// of results. Comments are ignored, and the first problem found is recorded.
+func (f *AuthenticationResultsField) Parse(s string) {
+	f.parseOther(s)
+
+	p := newParser(s)
+	f.AuthServID = p.MIMEValue()
+	if f.AuthServID == "" {
+		f.err = fmt.Errorf("Authentication-Results must start with an authserv-id: %q", s)
+		return
+	}
+	p.Comment()
+	if c := p.NextChar(); c >= '0' && c <= '9' {
+		p.MIMEToken()
+	}
+
+	for p.Valid() {
+		p.Comment()
+		if !p.Present(";") {
+			break
+		}
+		method := strings.ToLower(p.MIMEToken())
+		if p.Present("/") {
+			p.MIMEToken()
+		}
+		p.Comment()
+		if method == "none" && (p.AtEnd() || p.NextChar() == ';') {
+			continue
+		}
+		p.require("=")
+		r := AuthenticationResult{
+			Method:     method,
+			Result:     strings.ToLower(p.MIMEToken()),
+			Properties: make(map[string]string),
+		}
+		if r.Method == "" || r.Result == "" {
+			p.err = fmt.Errorf("Expected method=result, got: %s", p.following())
+		}
+		p.Comment()
+		for p.Valid() && !p.AtEnd() && p.NextChar() != ';' {
+			name := strings.ToLower(p.MIMEToken())
+			p.Comment()
+			p.require("=")
+			value := propertyValue(p)
+			if name == "" || value == "" {
+				p.err = fmt.Errorf("Expected property=value, got: %s", p.following())
+			} else if name == "reason" {
+				r.Reason = value
+			} else {
+				r.Properties[name] = value
+			}
+			p.Comment()
+		}
+		f.Results = append(f.Results, r)
+	}
+
+	if !p.Valid() {
+		f.err = p.err
+	} else if !p.AtEnd() {
+		f.err = fmt.Errorf("Unparseable value: %q", s)
+	}
+}
+
+// Returns the result for \a method (e.g. "spf"), or nil if this field has
+// none. If the method is reported more than once, the first is returned.
+func (f *AuthenticationResultsField) Result(method string) *AuthenticationResult {
+	for i := range f.Results {
+		if strings.EqualFold(f.Results[i].Method, method) {
+			return &f.Results[i]
+		}
+	}
+	return nil
+}
+
+// Steps past a property value in \a p and returns it. The value may be a
+// quoted string, or a token which, unlike a MIME token, may contain '@' and
+// '/' so that addresses, domains and IP addresses can be given unquoted.
+func propertyValue(p *parser) string {
+	p.Comment()
+	if p.NextChar() == '"' {
+		return p.String()
+	}
+	var buf bytes.Buffer
+	c := p.NextChar()
+	for c > 32 && c < 127 && c != ';' && c != '(' && c != ')' && c != '"' {
+		buf.WriteByte(c)
+		p.Step(1)
+		c = p.NextChar()
+	}
+	return buf.String()
+}
+
+// The results an SPF verifier may report, as listed in RFC 7208 section 8.
+var spfResults = []string{
+	"pass", "fail", "softfail", "neutral", "none", "temperror", "permerror",
+}
+
+type ReceivedSPFField struct {
+	HeaderField
+	Result  string
+	Comment string
+	Params  map[string]string
+}
+
+func NewReceivedSPFField() *ReceivedSPFField {
+	hf := HeaderField{name: ReceivedSPFFieldName}
+	return &ReceivedSPFField{HeaderField: hf}
+}
+
+// Parses the RFC 7208 Received-SPF field in \a s: a result, an optional
+// comment, and a semicolon-separated list of key=value pairs such as
+// client-ip, envelope-from and helo. Keys are lowercased. Known results are
+// lowercased too, but an unknown result is recorded as is rather than treated
+// as an error.
+func (f *ReceivedSPFField) Parse(s string) {
+	f.parseOther(s)
+	f.Params = make(map[string]string)
+
+	p := newParser(s)
+	f.Result = p.MIMEToken()
+	if f.Result == "" {
+		f.err = fmt.Errorf("Received-SPF must start with a result: %q", s)
+		return
+	}
+	for _, r := range spfResults {
+		if strings.EqualFold(f.Result, r) {
+			f.Result = r
+		}
+	}
+	f.Comment = p.Comment()
+
+	for p.Valid() && !p.AtEnd() {
+		key := strings.ToLower(p.MIMEToken())
+		p.Comment()
+		p.require("=")
+		value := propertyValue(p)
+		if key == "" || value == "" {
+			p.err = fmt.Errorf("Expected key=value, got: %s", p.following())
+			break
+		}
+		f.Params[key] = value
+		p.Comment()
+		if !p.Present(";") {
+			break
+		}
+		p.Comment()
+	}
+
+	if !p.Valid() {
+		f.err = p.err
+	} else if !p.AtEnd() {
+		f.err = fmt.Errorf("Unparseable value: %q", s)
+	}
+}
+
+// Returns the client-ip parameter, or an empty string if there is none.
+func (f *ReceivedSPFField) ClientIP() string {
+	return f.Params["client-ip"]
+}
+
+// Returns the envelope-from parameter, or an empty string if there is none.
+func (f *ReceivedSPFField) EnvelopeFrom() string {
+	return f.Params["envelope-from"]
+}
+
+// Returns the helo parameter, or an empty string if there is none.
+func (f *ReceivedSPFField) Helo() string {
+	return f.Params["helo"]
+}
+
+// A DKIMTag is one tag=value pair from a DKIM-Signature field.
+type DKIMTag struct {
+	Tag, Value string
+}
+
+// The DKIMSignatureField class parses the RFC 6376 DKIM-Signature field into
+// its tags, in the order in which they appear. It does not verify the
+// signature.
+type DKIMSignatureField struct {
+	HeaderField
+	Tags []DKIMTag
+}
+
+func NewDKIMSignatureField() *DKIMSignatureField {
+	hf := HeaderField{name: DKIMSignatureFieldName}
+	return &DKIMSignatureField{HeaderField: hf}
+}
+
+// Parses the tag-list in \a s and records the first problem found. All
+// whitespace is removed from the base64 values b= and bh=, and other values
+// are simplified.
+func (f *DKIMSignatureField) Parse(s string) {
+	f.parseOther(s)
+
+	for _, spec := range strings.Split(s, ";") {
+		if trim(spec) == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, '=')
+		if i < 0 {
+			f.err = fmt.Errorf("Expected tag=value, got: %q", simplify(spec))
+			return
+		}
+		tag := trim(spec[:i])
+		value := spec[i+1:]
+		if tag == "b" || tag == "bh" {
+			value = strings.Join(strings.Fields(value), "")
+		} else {
+			value = simplify(value)
+		}
+		if tag == "" {
+			f.err = fmt.Errorf("Expected tag=value, got: %q", simplify(spec))
+			return
+		}
+		if f.Tag(tag) != "" {
+			f.err = fmt.Errorf("Duplicate tag: %s", tag)
+			return
+		}
+		f.Tags = append(f.Tags, DKIMTag{tag, value})
+	}
+
+	if len(f.Tags) == 0 {
+		f.err = fmt.Errorf("DKIM-Signature contains no tags: %q", s)
+	}
+}
+
+// Returns the value of \a tag, or an empty string if there is no such tag.
+// Tag names are case-sensitive.
+func (f *DKIMSignatureField) Tag(tag string) string {
+	for _, t := range f.Tags {
+		if t.Tag == tag {
+			return t.Value
+		}
+	}
+	return ""
+}
+
+// Returns the signing domain (d=).
+func (f *DKIMSignatureField) Domain() string {
+	return f.Tag("d")
+}
+
+// Returns the selector (s=).
+func (f *DKIMSignatureField) Selector() string {
+	return f.Tag("s")
+}
+
+// Returns the signing algorithm (a=), e.g. "rsa-sha256".
+func (f *DKIMSignatureField) Algorithm() string {
+	return f.Tag("a")
+}
+
+// Returns the base64-encoded hash of the canonicalized body (bh=).
+func (f *DKIMSignatureField) BodyHash() string {
+	return f.Tag("bh")
+}
+
+// Returns the base64-encoded signature (b=).
+func (f *DKIMSignatureField) Signature() string {
+	return f.Tag("b")
+}
+
 type MIMEParameter struct {
 	Name, Value string
 	Parts       []string
@@ -813,9 +1472,8 @@ type MIMEField struct {
 // Returns the value of the parameter named \a n (ignoring the case of the
 // name). If there is no such parameter, this function returns an empty string.
 func (f *MIMEField) parameter(n string) string {
-	s := strings.ToLower(n)
 	for _, p := range f.Parameters {
-		if p.Name == s {
+		if strings.EqualFold(p.Name, n) {
 			return p.Value
 		}
 	}
@@ -827,32 +1485,65 @@ func (f *MIMEField) addParameter(n, v string) {
 	s := strings.ToLower(n)
 	found := false
 	for i := 0; i < len(f.Parameters); i++ {
-		if f.Parameters[i].Name == s {
+		if strings.EqualFold(f.Parameters[i].Name, s) {
+			f.Parameters[i].Name = s
 			f.Parameters[i].Value = v
 			found = true
 		}
 	}
 	if !found {
-		p := MIMEParameter{Name: n, Value: v}
+		p := MIMEParameter{Name: s, Value: v}
 		f.Parameters = append(f.Parameters, p)
 	}
 }
 
-// Removes the parameter named \a n (without regard to case), or does nothing
-// if there is no such parameter.
+// Removes the parameter named \a n (without regard to case), including any
+// RFC 2231 continuation parts, or does nothing if there is no such parameter.
+// Parameters added directly to Parameters need not have lower-case names, so
+// every match is removed.
 func (f *MIMEField) removeParameter(n string) {
-	s := strings.ToLower(n)
-	for i, p := range f.Parameters {
-		if p.Name == s {
-			f.Parameters = append(f.Parameters[:i], f.Parameters[i+1:]...)
-			break
+	params := f.Parameters[:0]
+	for _, p := range f.Parameters {
+		if !strings.EqualFold(p.Name, n) {
+			params = append(params, p)
+		}
+	}
+	f.Parameters = params
+}
+
+// Returns the value of the parameter named \a name (ignoring the case of the
+// name), and whether there is such a parameter at all.
+func (f *MIMEField) Parameter(name string) (string, bool) {
+	for _, p := range f.Parameters {
+		if strings.EqualFold(p.Name, name) {
+			return p.Value, true
 		}
 	}
+	return "", false
+}
+
+// Sets the parameter named \a name to \a value, replacing any previous
+// setting. The name is stored in lower case, as the parser does.
+func (f *MIMEField) SetParameter(name, value string) {
+	f.addParameter(name, value)
+}
+
+// Removes the parameter named \a name (without regard to case), or does
+// nothing if there is no such parameter.
+func (f *MIMEField) RemoveParameter(name string) {
+	f.removeParameter(name)
 }
 
+// The highest RFC 2231 continuation number parseParameters() accepts. A
+// parameter with a higher (or negative) number is ignored.
+const maxParameterPart = 999
+
 // Parses \a p, which is expected to refer to a string whose next characters
 // form the RFC 2045 production '*(";"parameter)'.
 func (f *MIMEField) parseParameters(p *parser) {
+	charsets := make(map[string]string)
+	defer f.joinParameterParts(charsets)
+
 	done := false
 	first := true
 	for f.Valid() && !done {
@@ -879,16 +1570,26 @@ func (f *MIMEField) parseParameters(p *parser) {
 			p.Comment()
 			havePart := false
 			partNumber := 0
+			invalid := false
 
 			if n == "" {
 				return
 			}
 
+			// RFC 2231: a trailing star marks an extended value
+			extended := false
+			if strings.HasSuffix(n, "*") {
+				extended = true
+				n = n[:len(n)-1]
+			}
 			if strings.Contains(n, "*") {
 				star := strings.Index(n, "*")
 				var err error
 				partNumber, err = strconv.Atoi(n[star+1:])
-				if err == nil {
+				if err == nil && (partNumber < 0 || partNumber > maxParameterPart) {
+					// parsed below, but then ignored
+					invalid = true
+				} else if err == nil {
 					havePart = true
 					n = n[:star]
 				}
@@ -940,7 +1641,24 @@ func (f *MIMEField) parseParameters(p *parser) {
 			}
 			p.Comment()
 
-			if n != "" {
+			if !extended && !havePart && looksExtended(v) {
+				// some senders use the extended syntax but forget the star
+				extended = true
+			}
+			if extended {
+				cs := ""
+				if !havePart || partNumber == 0 {
+					cs, v = split2231(v)
+				}
+				v = percentDecode(v)
+				if !havePart {
+					v = decode2231(v, cs)
+				} else if cs != "" {
+					charsets[n] = cs
+				}
+			}
+
+			if n != "" && !invalid {
 				i := 0
 				for i < len(f.Parameters) {
 					if f.Parameters[i].Name == n {
@@ -953,13 +1671,13 @@ func (f *MIMEField) parseParameters(p *parser) {
 					f.Parameters = append(f.Parameters, param)
 				}
 				if havePart {
-					gap := partNumber - len(f.Parameters[i].Parts)
+					gap := partNumber + 1 - len(f.Parameters[i].Parts)
 					if gap > 0 {
-						// extend so append works
+						// extend so the part fits, even out of order
 						f.Parameters[i].Parts = append(f.Parameters[i].Parts, make([]string, gap)...)
 					}
 
-					f.Parameters[i].Parts = append(f.Parameters[i].Parts, v)
+					f.Parameters[i].Parts[partNumber] = v
 				} else {
 					f.Parameters[i].Value = v
 				}
@@ -967,28 +1685,178 @@ func (f *MIMEField) parseParameters(p *parser) {
 		}
 	}
 
-	for _, p := range f.Parameters {
+}
+
+// Joins the RFC 2231 continuations of each parameter into its value, and
+// converts the values that were extended using \a charsets, which maps the
+// parameter names to the charset declared in their first part.
+func (f *MIMEField) joinParameterParts(charsets map[string]string) {
+	for i := range f.Parameters {
+		p := &f.Parameters[i]
 		if p.Value == "" && len(p.Parts) > 0 {
-			for _, v := range p.Parts {
-				p.Value += v
+			p.Value = strings.Join(p.Parts, "")
+			if cs, ok := charsets[p.Name]; ok {
+				p.Value = decode2231(p.Value, cs)
 			}
 		}
 	}
 }
 
-// This reimplementation of rfc822() never generates UTF-8 at the moment.
-// Merely a SMoP, but I haven't the guts to do it at the moment.
+// Returns true if \a v looks like an RFC 2231 extended value, i.e. it starts
+// with a known charset and a language (which may be empty) in single quotes,
+// and contains percent-encoded octets.
+func looksExtended(v string) bool {
+	if strings.Count(v, "'") < 2 || !strings.Contains(v, "%") {
+		return false
+	}
+	cs, _ := split2231(v)
+	return cs != "" && charset.Info(cs) != nil
+}
+
+// Splits the RFC 2231 extended value \a v into its charset and the
+// (still percent-encoded) octets. The language is discarded. If \a v has no
+// charset'language' prefix, the charset is empty and \a v is returned as is.
+func split2231(v string) (string, string) {
+	a := strings.IndexByte(v, '\'')
+	if a < 0 {
+		return "", v
+	}
+	b := strings.IndexByte(v[a+1:], '\'')
+	if b < 0 {
+		return "", v
+	}
+	return v[:a], v[a+1+b+1:]
+}
+
+// Returns \a s with each %XX sequence replaced by the octet it encodes.
+// Malformed sequences are left alone.
+func percentDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var buf bytes.Buffer
+	i := 0
+	for i < len(s) {
+		if s[i] == '%' && i+2 < len(s) {
+			n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err == nil {
+				buf.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+		i++
+	}
+	return buf.String()
+}
+
+// Converts the octets \a s from charset \a cs to UTF-8. If \a cs is empty or
+// can't be used, \a s is returned unchanged.
+func decode2231(s, cs string) string {
+	if cs == "" {
+		return s
+	}
+	d, err := toUnicode(s, cs)
+	if err != nil {
+		return s
+	}
+	return d
+}
+
+// The longest parameter word rfc822() will generate, so that a folded line
+// holding a single parameter (" " word ";") fits in 78 characters.
+const maxParameterWordLength = 76
+
+// Returns the parameter \a n with value \a v as one or more name=value words.
+// Long values are split into RFC 2231 continuations, and values that contain
+// 8-bit or control characters are RFC 2231 encoded as UTF-8.
+func parameterWords(n, v string) []string {
+	extended := false
+	for i := 0; i < len(v); i++ {
+		if v[i] >= 128 || v[i] < 32 {
+			extended = true
+		}
+	}
+
+	if !extended {
+		s := v
+		if !isBoring(s, MIMEBoring) {
+			s = quote(s, '"', '\\')
+		}
+		// a name too long to leave room for continuations is not split
+		if len(n)+1+len(s) <= maxParameterWordLength ||
+			len(n)+len("*00=")+2 >= maxParameterWordLength {
+			return []string{n + "=" + s}
+		}
+
+		words := []string{}
+		for len(v) > 0 {
+			prefix := n + "*" + strconv.Itoa(len(words)) + "="
+			l := maxParameterWordLength - len(prefix) - 2
+			if l < 1 {
+				l = 1
+			}
+			if l > len(v) {
+				l = len(v)
+			}
+			s := v[:l]
+			if !isBoring(s, MIMEBoring) {
+				s = quote(s, '"', '\\')
+			}
+			words = append(words, prefix+s)
+			v = v[l:]
+		}
+		return words
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("utf-8''")
+	for i := 0; i < len(v); i++ {
+		if isBoring(v[i:i+1], MIMEBoring) {
+			buf.WriteByte(v[i])
+		} else {
+			buf.WriteByte('%')
+			buf.WriteByte(qphexdigits[v[i]/16])
+			buf.WriteByte(qphexdigits[v[i]%16])
+		}
+	}
+	e := buf.String()
+	if len(n)+2+len(e) <= maxParameterWordLength ||
+		len(n)+len("*00*=")+3 >= maxParameterWordLength {
+		return []string{n + "*=" + e}
+	}
+
+	words := []string{}
+	for len(e) > 0 {
+		prefix := n + "*" + strconv.Itoa(len(words)) + "*="
+		l := maxParameterWordLength - len(prefix)
+		if l < 3 {
+			// room for at least one %XX escape
+			l = 3
+		}
+		if l >= len(e) {
+			l = len(e)
+		} else if e[l-1] == '%' {
+			l--
+		} else if e[l-2] == '%' {
+			l -= 2
+		}
+		words = append(words, prefix+e[:l])
+		e = e[l:]
+	}
+	return words
+}
+
+// This reimplementation of rfc822() never generates UTF-8. Parameter values
+// that need it are RFC 2231 encoded instead.
 func (f *MIMEField) rfc822(avoidUTF8 bool) string {
 	s := f.baseValue
 	lineLength := len(f.Name()) + 2 + len(s)
 
 	words := []string{}
 	for _, p := range f.Parameters {
-		s := p.Value
-		if !isBoring(s, MIMEBoring) {
-			s = quote(s, '"', '\'')
-		}
-		words = append(words, p.Name+"="+s)
+		words = append(words, parameterWords(p.Name, p.Value)...)
 	}
 
 	for len(words) > 0 {
@@ -1004,7 +1872,7 @@ func (f *MIMEField) rfc822(avoidUTF8 bool) string {
 			s += ";\r\n "
 			lineLength = 1
 		}
-		s += words[i] // FIXME: need more elaboration for 2231
+		s += words[i]
 		lineLength += len(words[i])
 		words = append(words[:i], words[i+1:]...)
 	}
@@ -1146,8 +2014,8 @@ func (f *ContentType) Parse(s string) {
 
 	if f.Valid() && !p.AtEnd() &&
 		f.Type == "multipart" && f.parameter("boundary") == "" &&
-		containsWord(strings.ToLower(s), "boundary") {
-		csp := newParser(s[strings.Index(strings.ToLower(s), "boundary"):])
+		containsWord(asciiLower(s), "boundary") {
+		csp := newParser(s[strings.Index(asciiLower(s), "boundary"):])
 		csp.require("boundary")
 		csp.Whitespace()
 		if csp.Present("=") {
@@ -1178,6 +2046,29 @@ func (f *ContentType) Parse(s string) {
 	f.baseValue = f.Type + "/" + f.Subtype
 }
 
+// Returns the protocol parameter of a multipart/signed or
+// multipart/encrypted type (RFC 1847) in lowercase, e.g.
+// "application/pgp-signature" for PGP/MIME or "application/pkcs7-signature"
+// for S/MIME. Returns an empty string if there is none.
+func (f *ContentType) Protocol() string {
+	return strings.ToLower(f.parameter("protocol"))
+}
+
+// Returns the micalg parameter of a multipart/signed type (RFC 1847) in
+// lowercase, e.g. "pgp-sha256" or "sha-256", naming the message integrity
+// check algorithm used for the signature. Returns an empty string if there is
+// none.
+func (f *ContentType) MicAlg() string {
+	return strings.ToLower(f.parameter("micalg"))
+}
+
+// Returns the report-type parameter of a multipart/report type (RFC 6522) in
+// lowercase, e.g. "delivery-status" or "disposition-notification". Returns an
+// empty string if there is none.
+func (f *ContentType) ReportType() string {
+	return strings.ToLower(f.parameter("report-type"))
+}
+
 type ContentTransferEncoding struct {
 	MIMEField
 	Encoding EncodingType
@@ -1189,6 +2080,12 @@ func NewContentTransferEncoding() *ContentTransferEncoding {
 	return &ContentTransferEncoding{MIMEField: mf}
 }
 
+// Sets the encoding to \a e, and updates the field value to match.
+func (f *ContentTransferEncoding) setEncoding(e EncodingType) {
+	f.Encoding = e
+	f.baseValue = e.String()
+}
+
 func (f *ContentTransferEncoding) Parse(s string) {
 	p := newParser(s)
 
@@ -1196,23 +2093,11 @@ func (f *ContentTransferEncoding) Parse(s string) {
 	p.Comment()
 	// FIXME: shouldn't we do p.end() here and record parse errors?
 
-	if t == "7bit" || t == "8bit" || t == "8bits" || t == "binary" || t == "unknown" {
-		f.Encoding = BinaryEncoding
-		f.baseValue = "7bit"
-	} else if t == "quoted-printable" {
-		f.Encoding = QPEncoding
-		f.baseValue = "quoted-printable"
-	} else if t == "base64" {
-		f.Encoding = Base64Encoding
-		f.baseValue = "base64"
-	} else if t == "x-uuencode" || t == "uuencode" {
-		f.Encoding = UuencodeEncoding
-		f.baseValue = "x-uuencode"
-	} else if strings.Contains(t, "bit") && t[0] >= '0' && t[0] <= '9' {
-		f.Encoding = BinaryEncoding
-		f.baseValue = "7bit"
+	e, err := ParseEncoding(t)
+	if err != nil {
+		f.err = err
 	} else {
-		f.err = fmt.Errorf("Invalid c-t-e value: %q", t)
+		f.setEncoding(e)
 	}
 }
 
@@ -1253,6 +2138,53 @@ func (f *ContentDisposition) Parse(s string) {
 	f.baseValue = f.Disposition
 }
 
+// Returns the date in the creation-date parameter (RFC 2183), or a null
+// pointer if there is none or it can't be parsed.
+func (f *ContentDisposition) CreationDate() *time.Time {
+	return f.dateParameter("creation-date")
+}
+
+// Returns the date in the modification-date parameter (RFC 2183), or a null
+// pointer if there is none or it can't be parsed.
+func (f *ContentDisposition) ModificationDate() *time.Time {
+	return f.dateParameter("modification-date")
+}
+
+// Parses the parameter \a n as an RFC 822 date-time, the same way as DateField
+// does, and returns the result or a null pointer.
+func (f *ContentDisposition) dateParameter(n string) *time.Time {
+	v := f.parameter(n)
+	if v == "" {
+		return nil
+	}
+	return parseDate(v)
+}
+
+type AutoSubmittedField struct {
+	MIMEField
+	Keyword string
+}
+
+func NewAutoSubmittedField() *AutoSubmittedField {
+	hf := HeaderField{name: AutoSubmittedFieldName}
+	mf := MIMEField{HeaderField: hf}
+	return &AutoSubmittedField{MIMEField: mf}
+}
+
+// Parses the RFC 3834 Auto-Submitted field in \a s: a keyword such as "no",
+// "auto-generated" or "auto-replied", optionally followed by parameters. The
+// keyword is lowercased.
+func (f *AutoSubmittedField) Parse(s string) {
+	p := newParser(s)
+	f.Keyword = strings.ToLower(p.MIMEToken())
+	if f.Keyword == "" {
+		f.err = fmt.Errorf("Unparseable value: %q", s)
+		return
+	}
+	f.parseParameters(p)
+	f.baseValue = f.Keyword
+}
+
 type ContentLanguage struct {
 	MIMEField
 	Languages []string
@@ -1264,13 +2196,21 @@ func NewContentLanguage() *ContentLanguage {
 	return &ContentLanguage{MIMEField: mf}
 }
 
+// Parses \a s as a list of language tags. Each tag is converted to the
+// canonical case BCP 47 recommends (see languageTag()). Tags that aren't
+// well-formed are left out of Languages and recorded as an error.
 func (f *ContentLanguage) Parse(s string) {
 	p := newParser(s)
+	bad := ""
 	for {
 		p.Comment()
 		t := p.MIMEToken()
 		if t != "" {
-			f.Languages = append(f.Languages, t)
+			if tag, ok := languageTag(t); ok {
+				f.Languages = append(f.Languages, tag)
+			} else if bad == "" {
+				bad = t
+			}
 		}
 		p.Comment()
 		if !p.Present(",") {
@@ -1278,21 +2218,108 @@ func (f *ContentLanguage) Parse(s string) {
 		}
 	}
 
-	if !p.AtEnd() || len(f.Languages) == 0 {
+	if !p.AtEnd() || (len(f.Languages) == 0 && bad == "") {
 		f.err = fmt.Errorf("Unparseable value: %q", s)
+	} else if bad != "" {
+		f.err = fmt.Errorf("Invalid language tag: %q", bad)
 	}
 
 	f.baseValue = strings.Join(f.Languages, ", ")
 }
 
+// Returns the primary language subtag of the first language, e.g. "en" for
+// "en-US", or an empty string if there is none.
+func (f *ContentLanguage) PrimaryLanguage() string {
+	if len(f.Languages) == 0 {
+		return ""
+	}
+	return section(f.Languages[0], "-", 1)
+}
+
+// Returns \a t in the canonical case recommended by RFC 5646 section 2.1.1 and
+// true, or an empty string and false if \a t doesn't have the general shape of
+// a language tag. Subtags are lowercase, except that four-letter script
+// subtags are titlecase and two-letter region subtags are uppercase, provided
+// they don't follow a singleton such as "x".
+//
+// Only the syntax is checked; whether the subtags are registered isn't.
+func languageTag(t string) (string, bool) {
+	subtags := strings.Split(strings.ToLower(t), "-")
+	for _, st := range subtags {
+		if len(st) < 1 || len(st) > 8 {
+			return "", false
+		}
+		for i := 0; i < len(st); i++ {
+			if !(st[i] >= 'a' && st[i] <= 'z') && !(st[i] >= '0' && st[i] <= '9') {
+				return "", false
+			}
+		}
+	}
+
+	first := subtags[0]
+	if first != "x" && first != "i" && (len(first) < 2 || !isAlpha(first)) {
+		return "", false
+	}
+	if len(subtags[len(subtags)-1]) == 1 {
+		// a singleton must be followed by at least one subtag
+		return "", false
+	}
+
+	singleton := len(first) == 1
+	for i := 1; i < len(subtags) && !singleton; i++ {
+		st := subtags[i]
+		if len(st) == 1 {
+			singleton = true
+		} else if len(st) == 4 && isAlpha(st) {
+			subtags[i] = strings.ToUpper(st[:1]) + st[1:]
+		} else if len(st) == 2 && isAlpha(st) {
+			subtags[i] = strings.ToUpper(st)
+		}
+	}
+
+	return strings.Join(subtags, "-"), true
+}
+
+var fieldFactories = map[string]func(name string) Field{}
+
+// Registers \a factory as the constructor for header fields named \a name,
+// so that NewHeaderFieldNamed(), NewHeaderField() and ReadHeader() use the
+// Field it returns instead of an unstructured HeaderField. This lets
+// applications parse extension fields such as Content-Duration. The name is
+// case-insensitive, and \a factory is called with its canonical form.
+//
+// A later registration for the same name replaces an earlier one. Fields this
+// package parses itself can't be replaced, and RegisterField panics if \a
+// name is one of those. RegisterField should be called during
+// initialization, before any messages are parsed.
+//
+// The easiest way to write a Field is to embed a *HeaderField returned by
+// NewUnstructuredField(), and to override Parse().
+func RegisterField(name string, factory func(name string) Field) {
+	n := headerCase(name)
+	if isKnownField[n] {
+		panic("mail: RegisterField called for built-in field " + n)
+	}
+	fieldFactories[n] = factory
+}
+
+// Returns a HeaderField named \a name, which treats its value as unstructured
+// text.
+func NewUnstructuredField(name string) *HeaderField {
+	return &HeaderField{name: headerCase(name)}
+}
+
 func NewHeaderFieldNamed(name string) Field {
 	n := headerCase(name)
+	if factory := fieldFactories[n]; factory != nil {
+		return factory(n)
+	}
 
 	var hf Field
 	switch n {
 	case InReplyToFieldName, SubjectFieldName, CommentsFieldName, KeywordsFieldName,
-		ContentDescriptionFieldName, MIMEVersionFieldName, ReceivedFieldName,
-		ContentLocationFieldName, ContentMd5FieldName, ListIdFieldName:
+		ContentDescriptionFieldName, MIMEVersionFieldName,
+		ContentLocationFieldName, ContentMd5FieldName, ListUnsubscribePostFieldName:
 		hf = &HeaderField{name: n}
 	case FromFieldName, ResentFromFieldName, SenderFieldName, ResentSenderFieldName,
 		ReturnPathFieldName, ReplyToFieldName, ToFieldName, CcFieldName, BccFieldName,
@@ -1300,7 +2327,23 @@ func NewHeaderFieldNamed(name string) Field {
 		ContentIDFieldName, ResentMessageIDFieldName, ReferencesFieldName:
 		hf = NewAddressField(n)
 	case DateFieldName, OrigDateFieldName, ResentDateFieldName:
-		hf = NewDateField()
+		df := NewDateField()
+		df.name = n
+		hf = df
+	case ReceivedFieldName:
+		hf = NewReceivedField()
+	case ListIdFieldName:
+		hf = NewListIdField()
+	case ListUnsubscribeFieldName:
+		hf = NewListUnsubscribeField()
+	case AuthenticationResultsFieldName:
+		hf = NewAuthenticationResultsField()
+	case ReceivedSPFFieldName:
+		hf = NewReceivedSPFField()
+	case DKIMSignatureFieldName:
+		hf = NewDKIMSignatureField()
+	case AutoSubmittedFieldName:
+		hf = NewAutoSubmittedField()
 	case ContentTypeFieldName:
 		hf = NewContentType()
 	case ContentTransferEncodingFieldName:
@@ -1317,20 +2360,30 @@ func NewHeaderFieldNamed(name string) Field {
 }
 
 func NewHeaderField(name, value string) Field {
+	return newHeaderField(name, value, false)
+}
+
+// Like NewHeaderField(), except that if \a allowUTF8 is true, raw UTF-8 is
+// accepted in \a value wherever RFC 6532 permits it.
+func newHeaderField(name, value string, allowUTF8 bool) Field {
 	hf := NewHeaderFieldNamed(name)
+	hf.setUTF8(allowUTF8)
 	hf.Parse(value)
 	if hf.Valid() {
 		return hf
 	}
 
 	i := 0
-	for value[i] == ':' || value[i] == ' ' {
+	for i < len(value) && (value[i] == ':' || value[i] == ' ') {
 		i++
 	}
-	suf := NewHeaderFieldNamed(name)
-	suf.Parse(value[i:])
-	if suf.Valid() {
-		return suf
+	if i > 0 && i < len(value) {
+		suf := NewHeaderFieldNamed(name)
+		suf.setUTF8(allowUTF8)
+		suf.Parse(value[i:])
+		if suf.Valid() {
+			return suf
+		}
 	}
 	hf.SetUnparsedValue(value)
 	return hf
@@ -1346,11 +2399,17 @@ func (f *HeaderField) rfc822(avoidUTF8 bool) string {
 	if f.Name() == SubjectFieldName ||
 		f.Name() == CommentsFieldName ||
 		f.Name() == ContentDescriptionFieldName {
+		// the name is part of the first line, so it's wrapped along
+		// with the value and then cut off again. encodeText() splits
+		// words too long for a line into encoded-words; otherwise a
+		// word is only broken if it exceeds RFC 5322's hard limit,
+		// although that adds a space to it.
+		prefix := f.Name() + ": "
+		v := f.value
 		if avoidUTF8 {
-			return wrap(encodeText(f.value), 78, "", " ", false)
-		} else {
-			return wrap(f.value, 78, "", " ", false)
+			v = encodeText(v)
 		}
+		return wrap(v, 78, prefix, " ", false, 998)[len(prefix):]
 	}
 
 	// We assume that, for most fields, we can use the database
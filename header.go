@@ -31,6 +31,9 @@ type Header struct {
 
 	mode headerMode
 
+	// true if field values may contain raw UTF-8 (RFC 6532)
+	utf8 bool
+
 	numBytes int
 
 	err      error
@@ -67,9 +70,41 @@ func (h *Header) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// The limits ReadHeader passes to ReadHeaderLimit. They are far beyond what
+// legitimate mail needs.
+const (
+	DefaultMaxHeaderFields = 10000
+	DefaultMaxHeaderBytes  = 4 * 1024 * 1024
+)
+
 func ReadHeader(rfc5322 string, m headerMode) (h *Header, err error) {
-	h = &Header{mode: m}
+	return ReadHeaderLimit(rfc5322, m, DefaultMaxHeaderFields, DefaultMaxHeaderBytes)
+}
+
+// ReadHeaderLimit is like ReadHeader, but stops and returns an error once the
+// header contains more than maxFields fields or extends beyond maxBytes bytes.
+// A limit of zero or less means no limit. The fields read before the limit
+// was reached are returned along with the error.
+func ReadHeaderLimit(rfc5322 string, m headerMode, maxFields, maxBytes int) (h *Header, err error) {
+	return readHeader(rfc5322, m, maxFields, maxBytes, false)
+}
+
+// ReadHeaderUTF8 is like ReadHeader, but accepts raw UTF-8 in field values, as
+// RFC 6532 permits for internationalized mail. Unstructured fields such as
+// Subject and display-names may then contain UTF-8 instead of being treated
+// as unparseable. Field names must still be ASCII.
+//
+// Fields added to the returned Header later accept UTF-8 as well.
+func ReadHeaderUTF8(rfc5322 string, m headerMode) (*Header, error) {
+	return readHeader(rfc5322, m, DefaultMaxHeaderFields, DefaultMaxHeaderBytes, true)
+}
+
+// This private helper does the work of ReadHeaderLimit() and
+// ReadHeaderUTF8(); \a allowUTF8 is true if field values may contain UTF-8.
+func readHeader(rfc5322 string, m headerMode, maxFields, maxBytes int, allowUTF8 bool) (h *Header, err error) {
+	h = &Header{mode: m, utf8: allowUTF8}
 	done := false
+	fields := 0
 
 	i := 0
 	end := len(rfc5322)
@@ -89,23 +124,23 @@ func ReadHeader(rfc5322 string, m headerMode) (h *Header, err error) {
 			j++
 		}
 
-		if j == i+4 && m == RFC5322Header && strings.ToLower(rfc5322[i:j+1]) == "from " {
+		if j == i+4 && j < end && m == RFC5322Header && strings.ToLower(rfc5322[i:j+1]) == "from " {
 			for i < end && rfc5322[i] != '\r' && rfc5322[i] != '\n' {
 				i++
 			}
-			for rfc5322[i] == '\r' {
+			for i < end && rfc5322[i] == '\r' {
 				i++
 			}
-			if rfc5322[i] == '\n' {
+			if i < end && rfc5322[i] == '\n' {
 				i++
 			}
-		} else if j > i && rfc5322[j] == ':' {
+		} else if k := skipWSP(rfc5322, j); j > i && k < end && rfc5322[k] == ':' {
+			// RFC 5322's obs-field allows whitespace before the colon
+			fieldStart := i
 			name := rfc5322[i:j]
-			i = j
+			i = k
 			i++
-			for rfc5322[i] == ' ' || rfc5322[i] == '\t' {
-				i++
-			}
+			i = skipWSP(rfc5322, i)
 			j = i
 
 			// Find the end of the value, including multiline values
@@ -116,16 +151,27 @@ func ReadHeader(rfc5322 string, m headerMode) (h *Header, err error) {
 			if j > 0 && rfc5322[j-1] == '\r' {
 				j--
 			}
+			if maxBytes > 0 && j > maxBytes {
+				return h, fmt.Errorf("Header exceeds %d bytes", maxBytes)
+			}
+			fields++
+			if maxFields > 0 && fields > maxFields {
+				return h, fmt.Errorf("Header contains more than %d fields", maxFields)
+			}
 			value := rfc5322[i:j]
 			//233-237
 			if simplify(value) != "" || strings.HasPrefix(strings.ToLower(name), "x-") {
-				h.Add(name, value)
+				f := newHeaderField(name, value, h.utf8)
+				f.setRaw(rfc5322[fieldStart:j])
+				h.addField(f)
 			}
 			i = j
 			if i+1 < end && rfc5322[i] == '\r' && rfc5322[i+1] == '\n' {
 				i++
 			}
-			i++
+			if i < end {
+				i++
+			}
 		} else {
 			done = true
 		}
@@ -143,6 +189,15 @@ func ReadHeader(rfc5322 string, m headerMode) (h *Header, err error) {
 	return h, nil
 }
 
+// Returns the index of the first character at or after \a i in \a s that
+// isn't a space or tab.
+func skipWSP(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
 // Returns true if this Header fills all the conditions laid out in RFC 2821
 // for validity, and false if not.
 func (h *Header) Valid() bool {
@@ -153,7 +208,14 @@ func (h *Header) Valid() bool {
 // Add adds the key, value pair to the header. It appends to any existing
 // values associated with the key.
 func (h *Header) Add(key, value string) {
-	h.addField(NewHeaderField(key, value))
+	h.addField(newHeaderField(key, value, h.utf8))
+}
+
+// Set sets the header field named key to value. It replaces any existing
+// fields with that name, including the whole address list of address fields.
+func (h *Header) Set(key, value string) {
+	h.RemoveAllNamed(headerCase(key))
+	h.addField(newHeaderField(key, value, h.utf8))
 }
 
 func (h *Header) addField(f Field) {
@@ -166,16 +228,33 @@ func (h *Header) addField(f Field) {
 			for _, a := range next.Addresses {
 				first.Addresses = append(first.Addresses, a)
 			}
+			first.raw = append(first.raw, next.raw...)
 			return
 		}
 	}
-	// TODO: aox implementation allows insertion at specified position
 	h.Fields = append(h.Fields, f)
 	h.verified = false
 }
 
+// InsertAt parses the key, value pair and inserts the resulting field at
+// position i, which is clamped to the bounds of Fields. Unlike Add, it never
+// merges into an existing address field.
+func (h *Header) InsertAt(i int, key, value string) {
+	if i < 0 {
+		i = 0
+	} else if i > len(h.Fields) {
+		i = len(h.Fields)
+	}
+	f := newHeaderField(key, value, h.utf8)
+	h.Fields = append(h.Fields, nil)
+	copy(h.Fields[i+1:], h.Fields[i:])
+	h.Fields[i] = f
+	h.verified = false
+}
+
 func (h *Header) RemoveAt(i int) {
 	h.Fields = append(h.Fields[:i], h.Fields[i+1:]...)
+	h.verified = false
 }
 
 func (h *Header) Remove(r Field) {
@@ -198,8 +277,32 @@ func (h *Header) RemoveAllNamed(name string) {
 	}
 }
 
+// Removes the first field named \a name, if there is one. The name is
+// case-insensitive.
+func (h *Header) RemoveFirst(name string) {
+	name = strings.ToLower(name)
+	for i, f := range h.Fields {
+		if strings.ToLower(f.Name()) == name {
+			h.RemoveAt(i)
+			return
+		}
+	}
+}
+
+// Removes the last field named \a name, if there is one. The name is
+// case-insensitive.
+func (h *Header) RemoveLast(name string) {
+	name = strings.ToLower(name)
+	for i := len(h.Fields) - 1; i >= 0; i-- {
+		if strings.ToLower(h.Fields[i].Name()) == name {
+			h.RemoveAt(i)
+			return
+		}
+	}
+}
+
 // Get gets the first value associated with the given key. If there are no
-// values associated with the key, Get returns "".
+// values associated with the key, Get returns "". The key is case-insensitive.
 func (h *Header) Get(key string) string {
 	f := h.field(key, 0)
 	if f == nil {
@@ -209,9 +312,22 @@ func (h *Header) Get(key string) string {
 	}
 }
 
+// GetAll returns the values of every field named \a key, in the order in
+// which they appear. The key is case-insensitive. If there are no such
+// fields, GetAll returns nil.
+func (h *Header) GetAll(key string) []string {
+	var values []string
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name(), key) {
+			values = append(values, f.Value())
+		}
+	}
+	return values
+}
+
 func (h *Header) field(fn string, n int) Field {
 	for _, field := range h.Fields {
-		if field.Name() == fn {
+		if strings.EqualFold(field.Name(), fn) {
 			if n > 0 {
 				n--
 			} else {
@@ -226,6 +342,7 @@ func (h *Header) field(fn string, n int) Field {
 // Returns a pointer to the address field of type \a t at index \a n in this
 // header, or a null pointer if no such field exists.
 func (h *Header) addressField(fn string, n int) *AddressField {
+	fn = headerCase(fn)
 	switch fn {
 	case FromFieldName, ResentFromFieldName, SenderFieldName, ResentSenderFieldName,
 		ReturnPathFieldName, ReplyToFieldName, ToFieldName, CcFieldName, BccFieldName,
@@ -241,8 +358,8 @@ func (h *Header) addressField(fn string, n int) *AddressField {
 // also be orig-date or resent-date. If there is no such field or \a t is
 // meaningless, date() returns a null pointer.
 func (h *Header) Date() *time.Time {
-	hf := h.field(DateFieldName, 0).(*DateField)
-	if hf == nil {
+	hf, ok := h.field(DateFieldName, 0).(*DateField)
+	if !ok || hf == nil {
 		return nil
 	}
 	return hf.Date
@@ -270,6 +387,18 @@ func (h *Header) Addresses(fn string) []Address {
 	return af.Addresses
 }
 
+// Returns a pointer to the sole address in the Sender field, or a null
+// pointer if there is no Sender field or it doesn't contain exactly one
+// mailbox. A Sender field that can't be parsed is treated as empty, as is
+// common in otherwise legible messages, so Sender() returns nil for it too.
+func (h *Header) Sender() *Address {
+	a := h.Addresses(SenderFieldName)
+	if len(a) != 1 {
+		return nil
+	}
+	return &a[0]
+}
+
 // Returns a pointer to the Content-Type header field, or a null pointer if
 // there isn't one.
 func (h *Header) ContentType() *ContentType {
@@ -281,6 +410,39 @@ func (h *Header) ContentType() *ContentType {
 	return f.(*ContentType)
 }
 
+// Returns the effective content type as a lowercase "type/subtype" string.
+// If there is no Content-Type field, this is the default for the context:
+// "message/rfc822" in a multipart/digest, and "text/plain" elsewhere.
+func (h *Header) ContentTypeString() string {
+	ct := h.ContentType()
+	if ct != nil {
+		return strings.ToLower(ct.Type + "/" + ct.Subtype)
+	}
+	if h.defaultType == MessageRFC822ContentType {
+		return "message/rfc822"
+	}
+	return "text/plain"
+}
+
+// Returns the effective charset of a text part, in lowercase. This is the
+// charset parameter if there is one, and "us-ascii" otherwise, as RFC 2045
+// specifies. Once a part has been parsed, the parameter names the charset
+// that was specified or guessed. Returns an empty string for other types.
+func (h *Header) Charset() string {
+	ct := h.ContentType()
+	cs := ""
+	if ct != nil {
+		cs = strings.ToLower(ct.parameter("charset"))
+	}
+	if cs == "default" {
+		cs = ""
+	}
+	if cs == "" && strings.HasPrefix(h.ContentTypeString(), "text/") {
+		cs = "us-ascii"
+	}
+	return cs
+}
+
 // Returns a pointer to the Content-Transfer-Encoding header field, or a null
 // pointer if there isn't one.
 func (h *Header) ContentTransferEncoding() *ContentTransferEncoding {
@@ -334,6 +496,93 @@ func (h *Header) ContentLanguage() *ContentLanguage {
 	return f.(*ContentLanguage)
 }
 
+// Returns a pointer to the List-ID header field, or a null pointer if there
+// isn't one.
+func (h *Header) ListID() *ListIdField {
+	f, _ := h.field(ListIdFieldName, 0).(*ListIdField)
+	return f
+}
+
+// Returns a pointer to the List-Unsubscribe header field, or a null pointer if
+// there isn't one.
+func (h *Header) ListUnsubscribe() *ListUnsubscribeField {
+	f, _ := h.field(ListUnsubscribeFieldName, 0).(*ListUnsubscribeField)
+	return f
+}
+
+// Returns all Authentication-Results fields, in the order in which they
+// appear. Each mail server along the way may add its own.
+func (h *Header) AuthenticationResults() []*AuthenticationResultsField {
+	var r []*AuthenticationResultsField
+	for _, f := range h.Fields {
+		if arf, ok := f.(*AuthenticationResultsField); ok {
+			r = append(r, arf)
+		}
+	}
+	return r
+}
+
+// Returns a pointer to the first Received-SPF field, which is the one added
+// most recently, or a null pointer if there isn't one.
+func (h *Header) ReceivedSPF() *ReceivedSPFField {
+	f, _ := h.field(ReceivedSPFFieldName, 0).(*ReceivedSPFField)
+	return f
+}
+
+// Returns all DKIM-Signature fields, in the order in which they appear.
+func (h *Header) DKIMSignatures() []*DKIMSignatureField {
+	var r []*DKIMSignatureField
+	for _, f := range h.Fields {
+		if df, ok := f.(*DKIMSignatureField); ok {
+			r = append(r, df)
+		}
+	}
+	return r
+}
+
+// Returns every Received field, in header order, which is newest first. Hops
+// whose fields couldn't be fully parsed are included, with whatever parts
+// could be parsed; their When is nil if the date is missing or unreadable.
+func (h *Header) Received() []*ReceivedField {
+	var r []*ReceivedField
+	for _, f := range h.Fields {
+		if rf, ok := f.(*ReceivedField); ok {
+			r = append(r, rf)
+		}
+	}
+	return r
+}
+
+// Returns a pointer to the Auto-Submitted header field, or a null pointer if
+// there isn't one.
+func (h *Header) AutoSubmitted() *AutoSubmittedField {
+	f, _ := h.field(AutoSubmittedFieldName, 0).(*AutoSubmittedField)
+	return f
+}
+
+// Returns true if the Auto-Submitted field says that the message was sent
+// automatically, that is, if it is present and not "no". Auto-responders
+// should not reply to such messages (RFC 3834), nor to messages whose
+// Precedence() is "bulk", "list" or "junk".
+func (h *Header) IsAutoSubmitted() bool {
+	f := h.field(AutoSubmittedFieldName, 0)
+	if f == nil {
+		return false
+	}
+	af, ok := f.(*AutoSubmittedField)
+	return !ok || af.Keyword != "no"
+}
+
+// Returns the lowercased value of the Precedence field, e.g. "bulk", or an
+// empty string if there isn't one.
+func (h *Header) Precedence() string {
+	f := h.field(PrecedenceFieldName, 0)
+	if f == nil {
+		return ""
+	}
+	return f.Value()
+}
+
 // Returns the value of the Message-ID field, or an empty string if there isn't one
 // or if there are multiple (which is illegal).
 func (h *Header) MessageID() string {
@@ -346,6 +595,193 @@ func (h *Header) MessageID() string {
 	return fmt.Sprintf("<%s@%s>", id.Localpart, id.Domain)
 }
 
+// Returns the message-ids in the References field, oldest first, each
+// enclosed in angle brackets. Returns nil if there is no References field.
+func (h *Header) References() []string {
+	return messageIDs(h.Addresses(ReferencesFieldName))
+}
+
+// Returns the message-ids in the In-Reply-To field, each enclosed in angle
+// brackets. Anything else in the field, such as the "Your message of ..."
+// text some old clients add, is ignored. Returns nil if there is no
+// In-Reply-To field.
+func (h *Header) InReplyTo() []string {
+	f := h.field(InReplyToFieldName, 0)
+	if f == nil {
+		return nil
+	}
+	return messageIDs(references(f.Value()).Addresses)
+}
+
+// Returns the keywords in all Keywords fields, in header order. Each field is
+// a comma-separated list of phrases (RFC 5322 section 3.6.5); encoded-words
+// are decoded, whitespace is simplified and empty keywords are dropped.
+// Returns nil if there is no Keywords field.
+func (h *Header) Keywords() []string {
+	var r []string
+	for _, v := range h.GetAll(KeywordsFieldName) {
+		r = append(r, keywords(v)...)
+	}
+	return r
+}
+
+// Splits \a s into the phrases of a Keywords field. Anything that doesn't
+// parse as a phrase is kept as raw text, up to the next comma.
+func keywords(s string) []string {
+	var r []string
+	p := newParser(s)
+	for !p.AtEnd() {
+		start := p.Pos()
+		k := p.Phrase()
+		if !p.AtEnd() && p.NextChar() != ',' {
+			end := strings.IndexByte(s[p.Pos():], ',')
+			if end < 0 {
+				end = len(s)
+			} else {
+				end += p.Pos()
+			}
+			k = s[start:end]
+			p.Step(end - p.Pos())
+		}
+		if k = simplify(k); k != "" {
+			r = append(r, k)
+		}
+		p.Step(1)
+	}
+	return r
+}
+
+// Returns the addresses in the most recent Resent-From field, or nil if there
+// is none.
+func (h *Header) ResentFrom() []Address {
+	return h.Addresses(ResentFromFieldName)
+}
+
+// Returns the addresses in the most recent Resent-To field, or nil if there
+// is none.
+func (h *Header) ResentTo() []Address {
+	return h.Addresses(ResentToFieldName)
+}
+
+// Returns the date in the most recent Resent-Date field, or a null pointer if
+// there is none or it can't be parsed.
+func (h *Header) ResentDate() *time.Time {
+	df, ok := h.field(ResentDateFieldName, 0).(*DateField)
+	if !ok {
+		return nil
+	}
+	return df.Date
+}
+
+// A ResentBlock describes one resending of a message, as recorded by a group
+// of Resent-* fields (RFC 5322 section 3.6.6).
+type ResentBlock struct {
+	Date      *time.Time
+	From      []Address
+	Sender    []Address
+	To        []Address
+	Cc        []Address
+	Bcc       []Address
+	MessageID string
+
+	// the Resent-* fields making up this block, in header order
+	Fields []Field
+}
+
+// Returns the resent blocks in this header, most recent first. Each block is
+// a run of consecutive Resent-* fields; since each resending prepends its
+// fields to the header, a run ends at any other field, or where a field that
+// is already in the run appears again.
+func (h *Header) ResentBlocks() []*ResentBlock {
+	var r []*ResentBlock
+	var b *ResentBlock
+	seen := map[string]bool{}
+	for _, f := range h.Fields {
+		n := f.Name()
+		if !strings.HasPrefix(n, "Resent-") {
+			b = nil
+			continue
+		}
+		if b == nil || seen[n] {
+			b = &ResentBlock{}
+			r = append(r, b)
+			seen = map[string]bool{}
+		}
+		seen[n] = true
+		b.Fields = append(b.Fields, f)
+
+		switch f := f.(type) {
+		case *DateField:
+			b.Date = f.Date
+		case *AddressField:
+			switch n {
+			case ResentFromFieldName:
+				b.From = f.Addresses
+			case ResentSenderFieldName:
+				b.Sender = f.Addresses
+			case ResentToFieldName:
+				b.To = f.Addresses
+			case ResentCcFieldName:
+				b.Cc = f.Addresses
+			case ResentBccFieldName:
+				b.Bcc = f.Addresses
+			case ResentMessageIDFieldName:
+				if ids := messageIDs(f.Addresses); len(ids) == 1 {
+					b.MessageID = ids[0]
+				}
+			}
+		}
+	}
+	return r
+}
+
+// Prepends a new resent block to this header, recording that the message was
+// resent by \a from to \a to at \a date, with Resent-Message-ID \a messageID.
+// The fields are inserted in the order RFC 5322 section 3.6.6 lists them,
+// above any earlier resent blocks and trace fields.
+//
+// If \a date is the zero time, the current time is used. Resent-To and
+// Resent-Message-ID are omitted if \a to or \a messageID is empty.
+func (h *Header) AddResentBlock(from Addresses, to Addresses, date time.Time, messageID string) {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	i := 0
+	insert := func(name, value string) {
+		h.InsertAt(i, name, value)
+		i++
+	}
+	insert(ResentDateFieldName, date.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	insert(ResentFromFieldName, addressList(from))
+	if len(to) > 0 {
+		insert(ResentToFieldName, addressList(to))
+	}
+	if messageID != "" {
+		if !strings.HasPrefix(messageID, "<") {
+			messageID = "<" + messageID + ">"
+		}
+		insert(ResentMessageIDFieldName, messageID)
+	}
+}
+
+// Returns \a as formatted for use as the value of an address field.
+func addressList(as Addresses) string {
+	var r []string
+	for _, a := range as {
+		r = append(r, a.String())
+	}
+	return strings.Join(r, ", ")
+}
+
+// Returns \a ids formatted as bracketed message-ids.
+func messageIDs(ids []Address) []string {
+	var r []string
+	for _, id := range ids {
+		r = append(r, fmt.Sprintf("<%s@%s>", id.Localpart, id.Domain))
+	}
+	return r
+}
+
 func (h *Header) ToMap() map[string][]string {
 	headers := make(map[string][]string)
 	for _, f := range h.Fields {
@@ -354,6 +790,129 @@ func (h *Header) ToMap() map[string][]string {
 	return headers
 }
 
+// Calls \a fn with the name and value of each field, in the order in which the
+// fields appear, until \a fn returns false. Unlike ToMap(), this preserves
+// the order of repeated fields.
+func (h *Header) Each(fn func(name, value string) bool) {
+	for _, f := range h.Fields {
+		if !fn(f.Name(), f.Value()) {
+			return
+		}
+	}
+}
+
+// Returns a description of how \a other differs from this header, one line
+// per difference, or nil if there are none. This is meant for debugging, e.g.
+// to see what Repair() changed.
+//
+// Fields are compared by name and Value(): the nth field with a given name in
+// this header is compared with the nth field with that name in \a other. A
+// field only this header has is described as "- Name: value", one only \a
+// other has as "+ Name: value", and one whose value differs as
+// "~ Name: value -> other value". The order of the lines follows the order in
+// which the names first occur.
+func (h *Header) Diff(other *Header) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, fields := range [][]Field{h.Fields, other.Fields} {
+		for _, f := range fields {
+			if !seen[f.Name()] {
+				seen[f.Name()] = true
+				names = append(names, f.Name())
+			}
+		}
+	}
+
+	a := h.ToMap()
+	b := other.ToMap()
+	var r []string
+	for _, n := range names {
+		va, vb := a[n], b[n]
+		for i := 0; i < len(va) || i < len(vb); i++ {
+			if i >= len(vb) {
+				r = append(r, fmt.Sprintf("- %s: %s", n, va[i]))
+			} else if i >= len(va) {
+				r = append(r, fmt.Sprintf("+ %s: %s", n, vb[i]))
+			} else if va[i] != vb[i] {
+				r = append(r, fmt.Sprintf("~ %s: %s -> %s", n, va[i], vb[i]))
+			}
+		}
+	}
+	return r
+}
+
+// Returns the last field named \a name in this header, using RFC 6376 simple
+// header canonicalization: the field exactly as received, ending with CRLF.
+// DKIM verifiers select the fields a signature covers from the bottom up,
+// hence the last one. Returns an empty string if there is no such field.
+//
+// Fields that weren't read by ReadHeader() are canonicalized as AsText()
+// would write them.
+func (h *Header) CanonicalizeSimple(name string) string {
+	f := h.lastField(name)
+	if f == nil {
+		return ""
+	}
+	return rawField(f) + crlf
+}
+
+// Like CanonicalizeSimple(), but uses RFC 6376 relaxed header
+// canonicalization: The name is lowercased, the value is unfolded, runs of
+// whitespace become a single space, and whitespace at the end of the value
+// and around the colon is removed.
+func (h *Header) CanonicalizeRelaxed(name string) string {
+	f := h.lastField(name)
+	if f == nil {
+		return ""
+	}
+
+	s := rawField(f)
+	colon := strings.IndexByte(s, ':')
+	var buf bytes.Buffer
+	buf.WriteString(strings.ToLower(strings.TrimRight(s[:colon], " \t")))
+	buf.WriteByte(':')
+	space := false
+	empty := true
+	for i := colon + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\r', '\n':
+			// unfold
+		case ' ', '\t':
+			space = true
+		default:
+			if space && !empty {
+				buf.WriteByte(' ')
+			}
+			space = false
+			empty = false
+			buf.WriteByte(s[i])
+		}
+	}
+	buf.WriteString(crlf)
+	return buf.String()
+}
+
+// Returns the field in this header named \a name that comes last, or nil.
+func (h *Header) lastField(name string) Field {
+	for i := len(h.Fields) - 1; i >= 0; i-- {
+		if strings.EqualFold(h.Fields[i].Name(), name) {
+			return h.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Returns the text of \a f as received, with CRLF line endings, or as it
+// would be written if it wasn't received. There is no final CRLF. If several
+// fields were merged into \a f, this is the last one's text.
+func rawField(f Field) string {
+	raw := f.lastRaw()
+	if raw == "" {
+		return f.Name() + ": " + f.rfc822(false)
+	}
+	return strings.Replace(strings.Replace(raw, crlf, "\n", -1), "\n", crlf, -1)
+}
+
 type HeaderFieldCondition struct {
 	name     string
 	min, max int
@@ -389,10 +948,29 @@ func (h *Header) verify() {
 	h.verified = true
 	h.err = nil
 
+	if errs := h.problems(false); len(errs) > 0 {
+		h.err = errs[0]
+	}
+}
+
+// Returns every problem that makes this Header invalid: each invalid field,
+// and each field that occurs too often or too rarely. Unlike Valid(), this
+// does not stop at the first problem, so it is slower.
+func (h *Header) Validate() []error {
+	return h.problems(true)
+}
+
+// Returns the problems found in this Header, in the order verify() looks for
+// them. If \a all is false, stops after the first.
+func (h *Header) problems(all bool) []error {
+	var errs []error
+
 	for _, f := range h.Fields {
 		if !f.Valid() {
-			h.err = fmt.Errorf("%s: %s", f.Name(), f.Error())
-			return
+			errs = append(errs, fmt.Errorf("%s: %s", f.Name(), f.Error()))
+			if !all {
+				return errs
+			}
 		}
 	}
 
@@ -401,20 +979,21 @@ func (h *Header) verify() {
 		occurrences[f.Name()]++
 	}
 
-	i := 0
-	for h.err == nil && i < len(conditions) {
-		if conditions[i].m == h.mode &&
-			occurrences[conditions[i].name] < conditions[i].min ||
-			occurrences[conditions[i].name] > conditions[i].max {
-			if conditions[i].max < occurrences[conditions[i].name] {
-				h.err = fmt.Errorf("%d %s fields seen. At most %d may be present.",
-					occurrences[conditions[i].name], conditions[i].name, conditions[i].max)
+	for _, c := range conditions {
+		if c.m == h.mode &&
+			(occurrences[c.name] < c.min ||
+				occurrences[c.name] > c.max) {
+			if c.max < occurrences[c.name] {
+				errs = append(errs, fmt.Errorf("%d %s fields seen. At most %d may be present.",
+					occurrences[c.name], c.name, c.max))
 			} else {
-				h.err = fmt.Errorf("%d %s fields seen. At least %d must be present.",
-					occurrences[conditions[i].name], conditions[i].name, conditions[i].min)
+				errs = append(errs, fmt.Errorf("%d %s fields seen. At least %d must be present.",
+					occurrences[c.name], c.name, c.min))
+			}
+			if !all {
+				return errs
 			}
 		}
-		i++
 	}
 
 	// strictly speaking, if From contains more than one address,
@@ -425,8 +1004,12 @@ func (h *Header) verify() {
 	// misleading error messages.
 
 	// we graciously ignore all the Resent-This-Or-That restrictions.
+
+	return errs
 }
 
+// Returns true if \a a and \a b contain the same addresses, in any order.
+// Domains are compared case-insensitively, localparts case-sensitively.
 func sameAddresses(a, b *AddressField) bool {
 	if a == nil || b == nil {
 		return false
@@ -443,28 +1026,14 @@ func sameAddresses(a, b *AddressField) bool {
 		return false
 	}
 
-	lmap := make(map[string]bool)
-	for _, a := range l {
-		n := fmt.Sprintf("%s@%s", a.Localpart, strings.ToTitle(a.Domain))
-		lmap[n] = true
-	}
-
-	mmap := make(map[string]bool)
-	for _, a := range l {
-		n := fmt.Sprintf("%s@%s", a.Localpart, strings.ToTitle(a.Domain))
-		mmap[n] = true
-	}
-
 	for _, a := range l {
-		n := fmt.Sprintf("%s@%s", a.Localpart, strings.ToTitle(a.Domain))
-		if !mmap[n] {
+		if !m.Contains(a) {
 			return false
 		}
 	}
 
 	for _, a := range m {
-		n := fmt.Sprintf("%s@%s", a.Localpart, strings.ToTitle(a.Domain))
-		if !lmap[n] {
+		if !l.Contains(a) {
 			return false
 		}
 	}
@@ -503,8 +1072,10 @@ func (h *Header) Simplify() {
 
 	cdi := h.ContentDisposition()
 	if cdi != nil {
-		ct := h.ContentType()
-		if h.mode == RFC5322Header && (ct == nil || ct.Type == "text") &&
+		// inline is the default for text, but not necessarily for
+		// anything else
+		if h.mode == RFC5322Header &&
+			strings.HasPrefix(h.ContentTypeString(), "text/") &&
 			cdi.Disposition == "inline" &&
 			len(cdi.Parameters) == 0 {
 			h.RemoveAllNamed(ContentDispositionFieldName)
@@ -612,6 +1183,7 @@ func (h *Header) Repair() {
 					n++
 					if n > 1 && hf.rfc822(false) == h.Fields[j].rfc822(false) {
 						h.RemoveAt(j)
+						occurrences[conditions[i].name]--
 					} else {
 						j++
 					}
@@ -728,7 +1300,7 @@ func (h *Header) Repair() {
 	// that error.
 	if occurrences[ContentTransferEncodingFieldName] > 0 {
 		ct := h.ContentType()
-		if ct != nil && ct.Type == "multipart" || ct.Type == "message" {
+		if ct != nil && (ct.Type == "multipart" || ct.Type == "message") {
 			h.RemoveAllNamed(ContentTransferEncodingFieldName)
 		}
 	}
@@ -764,6 +1336,12 @@ func (h *Header) Repair() {
 	}
 }
 
+// The name of the host this code runs on, e.g. "mx.example.com".
+// RepairWithBody() uses it to recognize messages that were written here, so
+// that it doesn't blame their missing From address on postmaster@ some other
+// domain. Programs that repair incoming mail should set it at startup.
+var LocalHostname = "localhost"
+
 // Repairs a few harmless and common problems, such as inserting two Date
 // fields with the same value. Assumes that \a p is its companion body (whose
 // text is in \a body), and may look at it to decide what/how to repair.
@@ -790,6 +1368,7 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 					n++
 					if n > 1 && hf.rfc822(false) == h.Fields[j].rfc822(false) {
 						h.RemoveAt(j)
+						occurrences[conditions[i].name]--
 					} else {
 						j++
 					}
@@ -812,27 +1391,18 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 		for _, f := range h.Fields {
 			// First, we take the date from the oldest plausible
 			// Received field.
-			if f.Name() == ReceivedFieldName {
-				v := f.rfc822(false)
-				i := 0
-				for strings.Index(v[i+1:], ";") > 0 {
-					i = i + 1 + strings.Index(v[i+1:], ";")
-				}
-				if i >= 0 {
-					tmp := parseDate(v[i+1:])
-					if tmp != nil {
-						if date == nil {
-							// first plausible we've seen
-							date = tmp
-						} else {
-							// if it took more than an hour to
-							// deliver, or less than no time, we don't
-							// trust this received field at all.
-							// FIXME: aox has a buggy extra comparison here, do we need it?
-							if tmp.Before(*date) {
-								date = tmp
-							}
-						}
+			if rf, ok := f.(*ReceivedField); ok && rf.When != nil {
+				tmp := rf.When
+				if date == nil {
+					// first plausible we've seen
+					date = tmp
+				} else {
+					// if it took more than an hour to
+					// deliver, or less than no time, we don't
+					// trust this received field at all.
+					// FIXME: aox has a buggy extra comparison here, do we need it?
+					if tmp.Before(*date) {
+						date = tmp
 					}
 				}
 			}
@@ -1101,7 +1671,7 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 			ct.Type == "multipart" &&
 			ct.parameter("boundary") == "" {
 			cand := 0
-			for body[cand] == '\n' {
+			for cand < len(body) && body[cand] == '\n' {
 				cand++
 			}
 			confused := false
@@ -1110,23 +1680,25 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 			for cand >= 0 && cand < len(body) && !done && !confused {
 				if len(body) > cand+1 && body[cand] == '-' && body[cand+1] == '-' {
 					i := cand + 2
-					c := body[i]
 					// bchars := bcharsnospace / " "
 					// bcharsnospace := DIGIT / ALPHA / "'" / "(" / ")" /
 					//                  "+" / "_" / "," / "-" / "." /
 					//                  "/" / ":" / "=" / "?"
-					for (c >= 'a' && c <= 'z') ||
-						(c >= 'A' && c <= 'Z') ||
-						(c >= '0' && c <= '9') ||
-						c == '\'' || c == '(' || c == ')' ||
-						c == '+' || c == '_' || c == ',' ||
-						c == '-' || c == '.' || c == '/' ||
-						c == ':' || c == '=' || c == '?' ||
-						c == ' ' {
+					for i < len(body) {
+						c := body[i]
+						if !((c >= 'a' && c <= 'z') ||
+							(c >= 'A' && c <= 'Z') ||
+							(c >= '0' && c <= '9') ||
+							c == '\'' || c == '(' || c == ')' ||
+							c == '+' || c == '_' || c == ',' ||
+							c == '-' || c == '.' || c == '/' ||
+							c == ':' || c == '=' || c == '?' ||
+							c == ' ') {
+							break
+						}
 						i++
-						c = body[i]
 					}
-					if i > cand+2 &&
+					if i > cand+2 && i < len(body) &&
 						(body[i] == '\r' || body[i] == '\n') {
 						// found a candidate line.
 						s := body[cand+2 : i]
@@ -1365,10 +1937,8 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 
 	// Some crapware tries to send DSNs without a From field. We try
 	// to patch it up. We don't care very much, so this parses the
-	// body and discards the result, does a _very_ quick job of
-	// parsing message/delivery-status, doesn't handle xtext, and
-	// doesn't care whether it uses Original-Recipient or
-	// Final-Recipient.
+	// body and discards the result, and doesn't care whether it uses
+	// Original-Recipient or Final-Recipient.
 	if h.mode == RFC5322Header &&
 		(h.field(FromFieldName, 0) == nil ||
 			h.field(FromFieldName, 0).Error() != nil &&
@@ -1379,38 +1949,23 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 		h.ContentType().parameter("report-type") == "delivery-status" {
 		ct := h.ContentType()
 		tmp := &Part{}
-		tmp.parseMultipart(body, ct.parameter("boundary"), false)
+		tmp.parseMultipart(body, ct.parameter("boundary"), false, 0)
 		for _, p := range tmp.Parts {
-			h := p.Header
 			var ct *ContentType
-			if h != nil {
-				ct = h.ContentType()
+			if p.Header != nil {
+				ct = p.Header.ContentType()
 			}
 			if ct != nil && ct.Type == "message" && ct.Subtype == "delivery-status" {
 				// woo.
-				lines := strings.Split(p.Data, "\n")
-				reportingMta := ""
+				ds := parseDeliveryStatus(p.Data)
+				reportingMta := strings.ToLower(ds.ReportingMTA)
 				var address *Address
-				for _, l := range lines {
-					line := strings.ToLower(l)
-					field := simplify(section(line, ":", 1))
-					domain := simplify(section(section(line, ":", 2), ";", 1))
-					value := simplify(section(section(line, ":", 2), ";", 2))
-					// value may be xtext, but I don't care. it's an
-					// odd error case in illegal mail, so who can say
-					// that the sender knows the xtext rules anyway?
-					if field == "reporting-mta" && domain == "dns" &&
-						value != "" {
-						reportingMta = value
-					} else if (field == "final-recipient" ||
-						field == "original-recipient") &&
-						domain == "rfc822" &&
-						address == nil && value != "" {
-						ap := NewAddressParser(value)
-						for _, a := range ap.Addresses {
-							if a.err == nil && a.Domain != "" {
-								address = &a
-								break
+				for _, r := range ds.Recipients {
+					for _, v := range []string{r.OriginalRecipient, r.FinalRecipient} {
+						ap := NewAddressParser(v)
+						for i, a := range ap.Addresses {
+							if address == nil && a.err == nil && a.Domain != "" {
+								address = &ap.Addresses[i]
 							}
 						}
 					}
@@ -1451,24 +2006,23 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 					msgid = &al[0]
 				}
 
-				Hostname := "localhost" // FIXME: this should be configurable
-				me := strings.ToLower(Hostname)
+				me := strings.ToLower(LocalHostname)
 				victim := ""
 				if msgid != nil {
 					victim = strings.ToLower(msgid.Domain)
 				}
 				tld := len(victim)
-				if victim[tld-3] == '.' {
+				if tld >= 3 && victim[tld-3] == '.' {
 					tld -= 3 // .de
-				} else if victim[tld-4] == '.' {
+				} else if tld >= 4 && victim[tld-4] == '.' {
 					tld -= 4 // .com
 				}
 				if tld < len(victim) {
-					if victim[tld-3] == '.' {
+					if tld >= 3 && victim[tld-3] == '.' {
 						tld -= 3 // .co.uk
-					} else if victim[tld-4] == '.' {
+					} else if tld >= 4 && victim[tld-4] == '.' {
 						tld -= 4 // .com.au
-					} else if tld == len(victim)-2 && victim[tld-5] == '.' {
+					} else if tld == len(victim)-2 && tld >= 5 && victim[tld-5] == '.' {
 						tld -= 5 // .priv.no
 					}
 				}
@@ -1659,10 +2213,23 @@ func (h *Header) RepairWithBody(p *Part, body string) {
 // Returns the canonical text representation of this Header.  Downgrades rather
 // than including UTF-8 if \a avoidUTF8 is true.
 func (h *Header) AsText(avoidUTF8 bool) string {
+	return h.asText(avoidUTF8, false, nil)
+}
+
+// Returns the text representation of this Header like AsText(), except that if
+// \a eightBit is true, the Content-Transfer-Encoding is given as 8bit, and if
+// \a ct is not nil, it is written instead of the Content-Type field.
+func (h *Header) asText(avoidUTF8, eightBit bool, ct *ContentType) string {
 	buf := bytes.NewBuffer(make([]byte, 0, len(h.Fields)*100))
 
 	for _, f := range h.Fields {
-		h.appendField(buf, f, avoidUTF8)
+		if eightBit && f.Name() == ContentTransferEncodingFieldName {
+			buf.WriteString(ContentTransferEncodingFieldName + ": 8bit" + crlf)
+		} else if _, ok := f.(*ContentType); ok && ct != nil {
+			h.appendField(buf, ct, avoidUTF8)
+		} else {
+			h.appendField(buf, f, avoidUTF8)
+		}
 	}
 
 	return buf.String()
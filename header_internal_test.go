@@ -0,0 +1,32 @@
+package mail
+
+import (
+	"testing"
+)
+
+func TestSimplifyDefaultTypeDisposition(t *testing.T) {
+	const simplifyHeader = "From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Disposition: inline\r\n\r\n"
+
+	// with no Content-Type, a digest child is message/rfc822, not text, so
+	// its inline disposition isn't redundant
+	h, err := ReadHeader(simplifyHeader, RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.defaultType = MessageRFC822ContentType
+	h.Simplify()
+	if cd := h.ContentDisposition(); cd == nil || cd.Disposition != "inline" {
+		t.Error("inline disposition of a message/rfc822 default was removed")
+	}
+
+	h, err = ReadHeader(simplifyHeader, RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Simplify()
+	if h.ContentDisposition() != nil {
+		t.Error("redundant inline disposition of a text/plain default was kept")
+	}
+}
@@ -1,8 +1,11 @@
 package mail_test
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -234,3 +237,1503 @@ func TestMessageID(t *testing.T) {
 	testStringEquals(t, "Part 1 Content-ID", parts[0].Header.Get("Content-ID"), "<invalid-id-with-no-brackets>")
 	testStringEquals(t, "Part 2 Content-ID", parts[1].Header.Get("Content-ID"), "<valid-id@example>")
 }
+
+func TestCaseInsensitiveLookup(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Type: text/plain\r\n"+
+		"Message-Id: <lookup@example.com>\r\n"+
+		"Reply-To: a@example.com\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"content-type", "CONTENT-TYPE", "Content-Type"} {
+		testStringEquals(t, name, h.Get(name), "text/plain")
+	}
+	testStringEquals(t, "message-id", h.Get("message-id"), "<lookup@example.com>")
+
+	replyTo := h.Addresses("reply-to")
+	if len(replyTo) != 1 {
+		t.Errorf("incorrect number of reply-to addresses: expected 1, got %d", len(replyTo))
+	} else {
+		testStringEquals(t, "reply-to address", replyTo[0].String(), "a@example.com")
+	}
+}
+
+func TestHeaderGetAll(t *testing.T) {
+	h, err := mail.ReadHeader("Received: from a.example.com by b.example.com; Mon, 2 Nov 2015 10:00:03 -0800\r\n"+
+		"Subject: hello\r\n"+
+		"Received: from c.example.com by a.example.com; Mon, 2 Nov 2015 10:00:02 -0800\r\n"+
+		"Received: from d.example.com by c.example.com; Mon, 2 Nov 2015 10:00:01 -0800\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := h.GetAll("received")
+	if len(received) != 3 {
+		t.Fatalf("incorrect number of Received values: expected 3, got %d", len(received))
+	}
+	testStringEquals(t, "Received 1", received[0], "from a.example.com by b.example.com; Mon, 2 Nov 2015 10:00:03 -0800")
+	testStringEquals(t, "Received 2", received[1], "from c.example.com by a.example.com; Mon, 2 Nov 2015 10:00:02 -0800")
+	testStringEquals(t, "Received 3", received[2], "from d.example.com by c.example.com; Mon, 2 Nov 2015 10:00:01 -0800")
+
+	if comments := h.GetAll("Comments"); comments != nil {
+		t.Errorf("expected no Comments values, got %q", comments)
+	}
+}
+
+func TestHeaderSet(t *testing.T) {
+	h, err := mail.ReadHeader("Subject: first\r\nTo: a@example.com, b@example.com\r\nSubject: second\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Set("subject", "replaced")
+	n := 0
+	for _, f := range h.Fields {
+		if f.Name() == "Subject" {
+			n++
+		}
+	}
+	testIntegerEquals(t, "number of Subject fields", n, 1)
+	testStringEquals(t, "Subject", h.Subject(), "replaced")
+
+	h.Set("To", "c@example.com")
+	to := h.Addresses("To")
+	if len(to) != 1 {
+		t.Errorf("incorrect number of To addresses: expected 1, got %d", len(to))
+	} else {
+		testStringEquals(t, "To address", to[0].String(), "c@example.com")
+	}
+}
+
+func TestHeaderInsertAt(t *testing.T) {
+	h, err := mail.ReadHeader("From: a@example.com\r\nSubject: test\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.InsertAt(0, "Return-Path", "<bounce@example.com>")
+	h.InsertAt(100, "X-Last", "last")
+	testStringEquals(t, "AsText", h.AsText(false),
+		"Return-Path: <bounce@example.com>\r\nFrom: a@example.com\r\nSubject: test\r\nX-Last: last\r\n")
+}
+
+func TestSimplifyKeepsDifferentReplyTo(t *testing.T) {
+	msg, err := mail.ReadMessage("From: a@example.com, b@example.com\r\n" +
+		"Reply-To: a@example.com, c@example.com\r\n" +
+		"Sender: a@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"\r\n" +
+		"Body\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replyTo := msg.Header.Addresses("Reply-To")
+	if len(replyTo) != 2 {
+		t.Errorf("incorrect number of Reply-To addresses: expected 2, got %d", len(replyTo))
+	} else {
+		testStringEquals(t, "Reply-To address", replyTo[0].String(), "a@example.com")
+		testStringEquals(t, "Reply-To address", replyTo[1].String(), "c@example.com")
+	}
+
+	sender := msg.Header.Addresses("Sender")
+	if len(sender) != 1 {
+		t.Errorf("incorrect number of Sender addresses: expected 1, got %d", len(sender))
+	}
+}
+
+func TestHeaderDate(t *testing.T) {
+	h, err := mail.ReadHeader("From: a@example.com\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date := h.Date(); date != nil {
+		t.Errorf("incorrect Date: expected nil, got %s", date)
+	}
+
+	h, err = mail.ReadHeader("From: a@example.com\r\nDate: Mon, 2 Nov 2015 10:00:00 -0800\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := h.Date()
+	if date == nil {
+		t.Errorf("missing or invalid date field in header")
+	} else {
+		testStringEquals(t, "Date", date.Format(time.RFC1123Z), "Mon, 02 Nov 2015 10:00:00 -0800")
+	}
+}
+
+func TestDateFieldZone(t *testing.T) {
+	tests := []struct {
+		in, value string
+		offset    int
+	}{
+		{"Mon, 2 Nov 2015 10:00:00 +0530", "Mon, 02 Nov 2015 10:00:00 +0530", 5*60*60 + 30*60},
+		{"Mon, 2 Nov 2015 10:00:00 -0800", "Mon, 02 Nov 2015 10:00:00 -0800", -8 * 60 * 60},
+		{"Mon, 2 Nov 2015 10:00:00 EST", "Mon, 02 Nov 2015 10:00:00 -0500", -5 * 60 * 60},
+	}
+
+	for _, test := range tests {
+		h, err := mail.ReadHeader("Date: "+test.in+"\r\n\r\n", mail.RFC5322Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, ok := h.Fields[0].(*mail.DateField)
+		if !ok {
+			t.Fatalf("Date field has type %T", h.Fields[0])
+		}
+		_, offset := f.Time().Zone()
+		testIntegerEquals(t, test.in+" offset", offset, test.offset)
+		testStringEquals(t, test.in+" value", f.Value(), test.value)
+	}
+}
+
+func TestLenientDates(t *testing.T) {
+	tests := []struct {
+		in, value string
+	}{
+		{"Thu, 4 Jun 2020 9:05:00 GMT", "Thu, 04 Jun 2020 09:05:00 +0000"},
+		{"Thu 4 Jun 2020 09:05:00 +0200", "Thu, 04 Jun 2020 09:05:00 +0200"},
+		{"Thu,4 Jun 2020 09:05:00 +0200", "Thu, 04 Jun 2020 09:05:00 +0200"},
+		{"4 Jun 2020 09:05:00 UT", "Thu, 04 Jun 2020 09:05:00 +0000"},
+		{"4 Jun 2020 09:05:00 Z", "Thu, 04 Jun 2020 09:05:00 +0000"},
+		{"Thursday, 4 June 2020 09:05:00 -0700", "Thu, 04 Jun 2020 09:05:00 -0700"},
+		{"Thu, 4 Jun 20 09:05:00 PDT", "Thu, 04 Jun 2020 09:05:00 -0700"},
+		{"Thu, 4 Jun 2020 09:05 EST", "Thu, 04 Jun 2020 09:05:00 -0500"},
+		{"thu, 4 JUN 2020 09:05:00 gmt", "Thu, 04 Jun 2020 09:05:00 +0000"},
+		{"Thu, 04-Jun-2020 09:05:00 +0000", "Thu, 04 Jun 2020 09:05:00 +0000"},
+		{"Thu, 4 Jun 2020 09:05:00 +02:00", "Thu, 04 Jun 2020 09:05:00 +0200"},
+		{"Thu, 4 Jun 2020 09:05:00 GMT+0200", "Thu, 04 Jun 2020 09:05:00 +0200"},
+		{"Thu, 4 Jun 2020 09:05:00", "Thu, 04 Jun 2020 09:05:00 +0000"},
+		{"Thu, 4 Jun 2020 09:05:00 +0000 (Coordinated Universal Time)", "Thu, 04 Jun 2020 09:05:00 +0000"},
+	}
+
+	for _, test := range tests {
+		h, err := mail.ReadHeader("Date: "+test.in+"\r\n\r\n", mail.RFC5322Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := h.Fields[0]
+		if !f.Valid() {
+			t.Errorf("could not parse %q: %s", test.in, f.Error())
+			continue
+		}
+		testStringEquals(t, test.in, f.Value(), test.value)
+	}
+
+	h, err := mail.ReadHeader("Date: sometime last week\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Fields[0].Valid() {
+		t.Errorf("unexpectedly parsed an invalid date as %q", h.Fields[0].Value())
+	}
+}
+
+func TestReceived(t *testing.T) {
+	h, err := mail.ReadHeader("Received: from mail.example.com (mail.example.com [192.0.2.1])\r\n"+
+		"\tby mx.example.org (Postfix) with ESMTPS id 3F2A1C0\r\n"+
+		"\tfor <user@example.org>; Mon, 2 Nov 2015 10:00:00 -0800 (PST)\r\n"+
+		"Received: by local.example.com; Mon, 2 Nov 2015 09:59:58 -0800\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.Fields) != 2 {
+		t.Fatalf("incorrect number of fields: expected 2, got %d", len(h.Fields))
+	}
+
+	r, ok := h.Fields[0].(*mail.ReceivedField)
+	if !ok {
+		t.Fatalf("incorrect field type: expected *mail.ReceivedField, got %T", h.Fields[0])
+	}
+	testStringEquals(t, "Received from", r.From, "mail.example.com")
+	testStringEquals(t, "Received by", r.By, "mx.example.org")
+	testStringEquals(t, "Received with", r.With, "ESMTPS")
+	testStringEquals(t, "Received id", r.ID, "3F2A1C0")
+	testStringEquals(t, "Received for", r.For, "<user@example.org>")
+	if r.When == nil {
+		t.Errorf("missing Received date")
+	} else {
+		testStringEquals(t, "Received date", r.When.Format(time.RFC1123Z), "Mon, 02 Nov 2015 10:00:00 -0800")
+	}
+
+	r = h.Fields[1].(*mail.ReceivedField)
+	if !r.Valid() {
+		t.Errorf("partial Received field is invalid: %s", r.Error())
+	}
+	testStringEquals(t, "Received from", r.From, "")
+	testStringEquals(t, "Received by", r.By, "local.example.com")
+	if r.When == nil {
+		t.Errorf("missing Received date")
+	}
+}
+
+// Relevant RFC: https://tools.ietf.org/html/rfc2919
+func TestListID(t *testing.T) {
+	h, err := mail.ReadHeader("List-Id: =?utf-8?q?Go=20Mail=20=E2=98=BA?= <go-mail.lists.example.com>\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := h.ListID()
+	if l == nil {
+		t.Fatal("missing List-ID")
+	}
+	testStringEquals(t, "List-ID description", l.Description, "Go Mail ☺")
+	testStringEquals(t, "List-ID identifier", l.Identifier, "go-mail.lists.example.com")
+
+	h, err = mail.ReadHeader("List-ID: <bare.lists.example.com>\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l = h.ListID()
+	if l == nil {
+		t.Fatal("missing List-ID")
+	}
+	if !l.Valid() {
+		t.Errorf("List-ID without description is invalid: %s", l.Error())
+	}
+	testStringEquals(t, "List-ID description", l.Description, "")
+	testStringEquals(t, "List-ID identifier", l.Identifier, "bare.lists.example.com")
+
+	h, err = mail.ReadHeader("List-ID: no identifier here\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l = h.ListID(); l == nil || l.Valid() {
+		t.Errorf("List-ID without identifier should be present but invalid")
+	}
+}
+
+// Relevant RFCs: https://tools.ietf.org/html/rfc2369, https://tools.ietf.org/html/rfc8058
+func TestListUnsubscribe(t *testing.T) {
+	h, err := mail.ReadHeader("List-Unsubscribe: <mailto:unsubscribe@lists.example.com?subject=unsubscribe>,\r\n"+
+		" <https://lists.example.com/unsubscribe/abc123>\r\n"+
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := h.ListUnsubscribe()
+	if l == nil {
+		t.Fatal("missing List-Unsubscribe")
+	}
+	if !l.Valid() {
+		t.Errorf("List-Unsubscribe is invalid: %s", l.Error())
+	}
+	if len(l.URIs) != 2 {
+		t.Fatalf("incorrect number of List-Unsubscribe URIs: expected 2, got %d", len(l.URIs))
+	}
+	testStringEquals(t, "List-Unsubscribe URI", l.URIs[0], "mailto:unsubscribe@lists.example.com?subject=unsubscribe")
+	testStringEquals(t, "List-Unsubscribe URI", l.URIs[1], "https://lists.example.com/unsubscribe/abc123")
+
+	mailto := l.MailtoURIs()
+	if len(mailto) != 1 {
+		t.Errorf("incorrect number of mailto URIs: expected 1, got %d", len(mailto))
+	} else {
+		testStringEquals(t, "mailto URI", mailto[0], l.URIs[0])
+	}
+
+	http := l.HTTPURIs()
+	if len(http) != 1 {
+		t.Errorf("incorrect number of HTTP URIs: expected 1, got %d", len(http))
+	} else {
+		testStringEquals(t, "HTTP URI", http[0], l.URIs[1])
+	}
+
+	testStringEquals(t, "List-Unsubscribe-Post", h.Get("List-Unsubscribe-Post"), "List-Unsubscribe=One-Click")
+}
+
+// Relevant RFC: https://tools.ietf.org/html/rfc2231
+func TestParameterContinuations(t *testing.T) {
+	filename := "a-very-long-attachment-filename-that-cannot-possibly-fit-on-a-single-header-line-without-folding.txt"
+	h, err := mail.ReadHeader("Content-Disposition: attachment; filename=\""+filename+"\"\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := h.AsText(false)
+	for _, line := range strings.Split(text, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line exceeds 78 characters: %q", line)
+		}
+	}
+
+	h, err = mail.ReadHeader(text+"\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd := h.ContentDisposition()
+	if cd == nil || len(cd.Parameters) != 1 {
+		t.Fatalf("incorrect Content-Disposition after round trip: %q", text)
+	}
+	testStringEquals(t, "Content-Disposition parameter name", cd.Parameters[0].Name, "filename")
+	testStringEquals(t, "Content-Disposition parameter value", cd.Parameters[0].Value, filename)
+
+	h, err = mail.ReadHeader("Content-Disposition: attachment; filename=\"☺.txt\"\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Content-Disposition", h.AsText(false),
+		"Content-Disposition: attachment; filename*=utf-8''%E2%98%BA.txt\r\n")
+}
+
+// Relevant RFC: https://tools.ietf.org/html/rfc2231
+func TestParameterExtendedValues(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Disposition: attachment; filename*=UTF-8''%e2%98%ba.txt\r\n"+
+		"Content-Type: text/plain; name*0*=utf-8'en'%e2%98%ba; name*1=\".txt\"\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cd := h.ContentDisposition()
+	if cd == nil || len(cd.Parameters) != 1 {
+		t.Fatal("missing Content-Disposition parameters")
+	}
+	testStringEquals(t, "Content-Disposition parameter name", cd.Parameters[0].Name, "filename")
+	testStringEquals(t, "Content-Disposition parameter value", cd.Parameters[0].Value, "☺.txt")
+
+	ct := h.ContentType()
+	if ct == nil || len(ct.Parameters) != 1 {
+		t.Fatal("missing Content-Type parameters")
+	}
+	testStringEquals(t, "Content-Type parameter name", ct.Parameters[0].Name, "name")
+	testStringEquals(t, "Content-Type parameter value", ct.Parameters[0].Value, "☺.txt")
+
+	h, err = mail.ReadHeader("Content-Disposition: attachment; filename=\"x\"\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Content-Disposition parameter value", h.ContentDisposition().Parameters[0].Value, "x")
+}
+
+func TestParameterExtendedLatin1(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Disposition: attachment; filename*=iso-8859-1''%E9t%E9.txt\r\n"+
+		"Content-Type: text/plain; name*0*=iso-8859-1'fr'%E9t; name*1*=%E9.txt\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cd := h.ContentDisposition()
+	if cd == nil || len(cd.Parameters) != 1 {
+		t.Fatal("missing Content-Disposition parameters")
+	}
+	testStringEquals(t, "Content-Disposition parameter value", cd.Parameters[0].Value, "été.txt")
+
+	ct := h.ContentType()
+	if ct == nil || len(ct.Parameters) != 1 {
+		t.Fatal("missing Content-Type parameters")
+	}
+	testStringEquals(t, "Content-Type parameter value", ct.Parameters[0].Value, "été.txt")
+}
+
+func TestParameterExtendedRoundTrip(t *testing.T) {
+	filename := strings.Repeat("☺", 30) + ".txt"
+	h, err := mail.ReadHeader("Content-Disposition: attachment; filename=\""+filename+"\"\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = mail.ReadHeader(h.AsText(false)+"\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Content-Disposition parameter value", h.ContentDisposition().Parameters[0].Value, filename)
+}
+
+func TestMIMEParameters(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Type: text/plain; format=flowed\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := h.ContentType()
+	if _, ok := ct.Parameter("charset"); ok {
+		t.Error("unexpected charset parameter")
+	}
+
+	ct.SetParameter("Charset", "iso-8859-1")
+	v, ok := ct.Parameter("CHARSET")
+	if !ok {
+		t.Fatal("missing charset parameter")
+	}
+	testStringEquals(t, "charset", v, "iso-8859-1")
+	testStringEquals(t, "Content-Type", h.AsText(false),
+		"Content-Type: text/plain; format=flowed; charset=iso-8859-1\r\n")
+
+	ct.SetParameter("charset", "utf-8")
+	testIntegerEquals(t, "parameter count", len(ct.Parameters), 2)
+	testStringEquals(t, "Content-Type", h.AsText(false),
+		"Content-Type: text/plain; format=flowed; charset=utf-8\r\n")
+
+	ct.RemoveParameter("CharSet")
+	if _, ok := ct.Parameter("charset"); ok {
+		t.Error("charset parameter not removed")
+	}
+	testStringEquals(t, "Content-Type", h.AsText(false), "Content-Type: text/plain; format=flowed\r\n")
+	ct.RemoveParameter("charset")
+	testIntegerEquals(t, "parameter count", len(ct.Parameters), 1)
+}
+
+func TestRemoveParameter(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Type: multipart/mixed; boundary=\"xyz\";\r\n"+
+		" charset*0=us-; charset*1=ascii; name=\"a.txt\"\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := h.ContentType()
+	ct.Parameters = append(ct.Parameters, mail.NewMIMEParameter("CHARSET", "utf-8"))
+
+	ct.RemoveParameter("Charset")
+	testIntegerEquals(t, "parameter count", len(ct.Parameters), 2)
+	testStringEquals(t, "first parameter", ct.Parameters[0].Name, "boundary")
+	testStringEquals(t, "second parameter", ct.Parameters[1].Name, "name")
+	testStringEquals(t, "Content-Type", h.AsText(false),
+		"Content-Type: multipart/mixed; boundary=xyz; name=a.txt\r\n")
+}
+
+func TestParameterNameCase(t *testing.T) {
+	ct := mail.NewContentType()
+	ct.Parameters = append(ct.Parameters, mail.NewMIMEParameter("CHARSET", "us-ascii"))
+
+	v, ok := ct.Parameter("Charset")
+	if !ok {
+		t.Fatal("parameter with an upper-case name not found")
+	}
+	testStringEquals(t, "charset", v, "us-ascii")
+
+	ct.SetParameter("charset", "utf-8")
+	testIntegerEquals(t, "parameter count", len(ct.Parameters), 1)
+	testStringEquals(t, "name", ct.Parameters[0].Name, "charset")
+	testStringEquals(t, "value", ct.Parameters[0].Value, "utf-8")
+}
+
+func TestParameterPartNumbers(t *testing.T) {
+	for _, param := range []string{"name*-1=foo", "name*9999999999999=x", "name*1000=x"} {
+		m, err := mail.ReadMessage("Content-Type: text/plain; " + param + "; format=flowed\r\n\r\nbody\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct := m.Header.ContentType()
+		if ct == nil {
+			t.Fatalf("%s: Content-Type lost", param)
+		}
+		if _, ok := ct.Parameter("name"); ok {
+			t.Errorf("%s: out-of-range continuation was kept", param)
+		}
+		format, _ := ct.Parameter("format")
+		testStringEquals(t, param+": format", format, "flowed")
+	}
+
+	h, err := mail.ReadHeader("Content-Type: text/plain; name*999=b; name*0=a\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _ := h.ContentType().Parameter("name")
+	testStringEquals(t, "name", name, "ab")
+}
+
+func TestLongParameterNames(t *testing.T) {
+	for _, n := range []int{50, 65, 71, 80, 120} {
+		name := strings.Repeat("n", n)
+		for _, v := range []string{"abcdefghij", strings.Repeat("x", 90), "☺ " + strings.Repeat("é", 40)} {
+			h, err := mail.ReadHeader("Content-Type: text/plain; "+name+"=\""+v+"\"\r\n\r\n", mail.MIMEHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err = mail.ReadHeader(h.AsText(false)+"\r\n", mail.MIMEHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := h.ContentType().Parameter(name)
+			testStringEquals(t, fmt.Sprintf("%d-character parameter name", n), got, v)
+		}
+	}
+
+	m, err := mail.ReadMessage("Content-Type: message/rfc822\r\n\r\n" +
+		"Content-Type: text/plain; " + strings.Repeat("n", 71) + "=abcdefghij\r\n\r\nbody\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.RFC822(false)
+}
+
+func TestReadHeaderLimit(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		buf.WriteString("X-Spam: yes\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	h, err := mail.ReadHeader(buf.String(), mail.RFC5322Header)
+	if err == nil {
+		t.Error("expected an error reading 100000 header fields")
+	}
+	if h == nil || len(h.Fields) > mail.DefaultMaxHeaderFields {
+		t.Errorf("ReadHeader did not stop at %d fields", mail.DefaultMaxHeaderFields)
+	}
+
+	_, err = mail.ReadHeaderLimit(buf.String(), mail.RFC5322Header, 0, 1000)
+	if err == nil {
+		t.Error("expected an error reading more than 1000 header bytes")
+	}
+
+	_, err = mail.ReadHeaderLimit("Subject: a\r\nSubject: b\r\n\r\n", mail.RFC5322Header, 2, 0)
+	if err != nil {
+		t.Errorf("unexpected error reading a header within its limits: %s", err)
+	}
+}
+
+// Relevant RFC: https://tools.ietf.org/html/rfc8601
+func TestAuthenticationResults(t *testing.T) {
+	h, err := mail.ReadHeader("Authentication-Results: mx.example.com;\r\n"+
+		" spf=pass smtp.mailfrom=alice@example.org;\r\n"+
+		" dkim=fail reason=\"signature did not verify\" (1024-bit key) header.d=example.org header.s=sel1;\r\n"+
+		" dmarc=none header.from=example.org\r\n"+
+		"Authentication-Results: relay.example.net 1; none\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := h.AuthenticationResults()
+	if len(all) != 2 {
+		t.Fatalf("incorrect number of Authentication-Results fields: expected 2, got %d", len(all))
+	}
+	testIntegerEquals(t, "GetAll count", len(h.GetAll("authentication-results")), 2)
+
+	ar := all[0]
+	if !ar.Valid() {
+		t.Errorf("Authentication-Results is invalid: %s", ar.Error())
+	}
+	testStringEquals(t, "authserv-id", ar.AuthServID, "mx.example.com")
+	testIntegerEquals(t, "result count", len(ar.Results), 3)
+
+	if r := ar.Result("spf"); r == nil {
+		t.Error("missing spf result")
+	} else {
+		testStringEquals(t, "spf", r.Result, "pass")
+		testStringEquals(t, "spf smtp.mailfrom", r.Properties["smtp.mailfrom"], "alice@example.org")
+	}
+	if r := ar.Result("dkim"); r == nil {
+		t.Error("missing dkim result")
+	} else {
+		testStringEquals(t, "dkim", r.Result, "fail")
+		testStringEquals(t, "dkim reason", r.Reason, "signature did not verify")
+		testStringEquals(t, "dkim header.d", r.Properties["header.d"], "example.org")
+		testStringEquals(t, "dkim header.s", r.Properties["header.s"], "sel1")
+	}
+	if r := ar.Result("DMARC"); r == nil {
+		t.Error("missing dmarc result")
+	} else {
+		testStringEquals(t, "dmarc", r.Result, "none")
+		testStringEquals(t, "dmarc header.from", r.Properties["header.from"], "example.org")
+	}
+
+	if !all[1].Valid() {
+		t.Errorf("Authentication-Results with no results is invalid: %s", all[1].Error())
+	}
+	testStringEquals(t, "authserv-id", all[1].AuthServID, "relay.example.net")
+	testIntegerEquals(t, "result count", len(all[1].Results), 0)
+}
+
+// Relevant RFC: https://tools.ietf.org/html/rfc7208#section-9.1
+func TestReceivedSPF(t *testing.T) {
+	h, err := mail.ReadHeader("Received-SPF: Pass (mybox.example.org: domain of\r\n"+
+		" myname@example.com designates 192.0.2.1 as permitted sender)\r\n"+
+		" receiver=mybox.example.org; client-ip=192.0.2.1;\r\n"+
+		" envelope-from=\"myname@example.com\"; helo=foo.example.com;\r\n"+
+		"Received-SPF: softfail (example.net: transitioning domain of\r\n"+
+		" example.com does not designate 192.0.2.2 as permitted sender)\r\n"+
+		" client-ip=192.0.2.2; envelope-from=myname@example.com\r\n"+
+		"Received-SPF: bogus client-ip=192.0.2.3\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spf := h.ReceivedSPF()
+	if spf == nil {
+		t.Fatal("missing Received-SPF")
+	}
+	if !spf.Valid() {
+		t.Errorf("Received-SPF is invalid: %s", spf.Error())
+	}
+	testStringEquals(t, "Result", spf.Result, "pass")
+	testStringEquals(t, "receiver", spf.Params["receiver"], "mybox.example.org")
+	testStringEquals(t, "client-ip", spf.ClientIP(), "192.0.2.1")
+	testStringEquals(t, "envelope-from", spf.EnvelopeFrom(), "myname@example.com")
+	testStringEquals(t, "helo", spf.Helo(), "foo.example.com")
+
+	spfs := h.Fields
+	testIntegerEquals(t, "field count", len(spfs), 3)
+	softfail, _ := spfs[1].(*mail.ReceivedSPFField)
+	if softfail == nil || !softfail.Valid() {
+		t.Fatal("second Received-SPF is missing or invalid")
+	}
+	testStringEquals(t, "Result", softfail.Result, "softfail")
+	testStringEquals(t, "client-ip", softfail.ClientIP(), "192.0.2.2")
+	testStringEquals(t, "envelope-from", softfail.EnvelopeFrom(), "myname@example.com")
+	testStringEquals(t, "helo", softfail.Helo(), "")
+
+	unknown, _ := spfs[2].(*mail.ReceivedSPFField)
+	if unknown == nil || !unknown.Valid() {
+		t.Fatal("Received-SPF with an unknown result is missing or invalid")
+	}
+	testStringEquals(t, "Result", unknown.Result, "bogus")
+}
+
+// Relevant RFC: https://tools.ietf.org/html/rfc6376#section-3.5
+func TestDKIMSignature(t *testing.T) {
+	h, err := mail.ReadHeader("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n"+
+		"        d=example.com; s=20161025;\r\n"+
+		"        h=mime-version:from:date:message-id:subject:to;\r\n"+
+		"        bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n"+
+		"        b=dzdVyOfAKCdLXdJOc9G2q8LoXSlEniSbav+yuU4zGeeruD00lszZVoG4ZHRNiYzR\r\n"+
+		"         5s1gzA8O5yzpCXl3FKQ8Fr6DoQ4vIq7DWm2kPKCr26OmzkjGgVR8dbSHnsbcAJV8\r\n"+
+		"         UrS5gQ==\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigs := h.DKIMSignatures()
+	if len(sigs) != 1 {
+		t.Fatalf("incorrect number of DKIM-Signature fields: expected 1, got %d", len(sigs))
+	}
+	sig := sigs[0]
+	if !sig.Valid() {
+		t.Errorf("DKIM-Signature is invalid: %s", sig.Error())
+	}
+	testIntegerEquals(t, "tag count", len(sig.Tags), 8)
+	testStringEquals(t, "first tag", sig.Tags[0].Tag, "v")
+	testStringEquals(t, "d=", sig.Domain(), "example.com")
+	testStringEquals(t, "s=", sig.Selector(), "20161025")
+	testStringEquals(t, "a=", sig.Algorithm(), "rsa-sha256")
+	testStringEquals(t, "h=", sig.Tag("h"), "mime-version:from:date:message-id:subject:to")
+	testStringEquals(t, "bh=", sig.BodyHash(), "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=")
+	testStringEquals(t, "b=", sig.Signature(), "dzdVyOfAKCdLXdJOc9G2q8LoXSlEniSbav+yuU4zGeeruD00lszZVoG4ZHRNiYzR"+
+		"5s1gzA8O5yzpCXl3FKQ8Fr6DoQ4vIq7DWm2kPKCr26OmzkjGgVR8dbSHnsbcAJV8UrS5gQ==")
+
+	sig = mail.NewDKIMSignatureField()
+	sig.Parse("v=1; d=example.com; d=example.org")
+	if sig.Valid() {
+		t.Error("DKIM-Signature with a duplicate tag should be invalid")
+	}
+}
+
+// Relevant RFC: https://tools.ietf.org/html/rfc3834#section-5
+func TestAutoSubmitted(t *testing.T) {
+	h, err := mail.ReadHeader("Auto-Submitted: no\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.IsAutoSubmitted() {
+		t.Error("Auto-Submitted: no should not be auto-submitted")
+	}
+
+	h, err = mail.ReadHeader("Auto-Submitted: Auto-Replied; owner-email=\"alice@example.com\"\r\n"+
+		"Precedence: Bulk (mass mailing)\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.IsAutoSubmitted() {
+		t.Error("Auto-Submitted: auto-replied should be auto-submitted")
+	}
+	testStringEquals(t, "Auto-Submitted", h.AutoSubmitted().Keyword, "auto-replied")
+	testStringEquals(t, "Auto-Submitted", h.Get("Auto-Submitted"), "auto-replied; owner-email=\"alice@example.com\"")
+	testStringEquals(t, "Precedence", h.Precedence(), "bulk")
+
+	h, err = mail.ReadHeader("Subject: hello\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.IsAutoSubmitted() {
+		t.Error("a message without Auto-Submitted should not be auto-submitted")
+	}
+	testStringEquals(t, "Precedence", h.Precedence(), "")
+}
+
+func TestMIMEVersionComment(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"1.0", "1.0"},
+		{" 1.0 ", "1.0"},
+		{"1.0 (Generated by X)", "1.0 (Generated by X)"},
+		{"(Generated by X) 1.0", "1.0 (Generated by X)"},
+		{"1.1 (Generated by X)", "1.0 (Generated by X) (Note: Original mime-version had syntax problems)"},
+		{"2", "1.0 (Note: Original mime-version had syntax problems)"},
+	}
+	for _, c := range cases {
+		f := mail.NewHeaderField("MIME-Version", c.in)
+		testStringEquals(t, "MIME-Version "+c.in, f.Value(), c.out)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	h, err := mail.ReadHeader("From: alice@example.com\r\n"+
+		"Date: the day after tomorrow\r\n"+
+		"Subject: hello\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ReadHeader would merge a second From field into the first
+	h.InsertAt(1, "From", "bob@example.com")
+
+	if h.Valid() {
+		t.Error("header should be invalid")
+	}
+	errs := h.Validate()
+	if len(errs) != 2 {
+		t.Fatalf("incorrect number of errors: expected 2, got %d: %v", len(errs), errs)
+	}
+	if !strings.HasPrefix(errs[0].Error(), "Date: ") {
+		t.Errorf("expected a Date error first, got %q", errs[0])
+	}
+	testStringEquals(t, "From error", errs[1].Error(), "2 From fields seen. At most 1 may be present.")
+}
+
+func TestConditionModes(t *testing.T) {
+	twoTypes := "Content-Type: text/plain\r\n" +
+		"Content-Type: text/html\r\n"
+
+	h, err := mail.ReadHeader(twoTypes+"\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := h.Validate()
+	testIntegerEquals(t, "MIME header errors", len(errs), 1)
+
+	h, err = mail.ReadHeader("From: alice@example.com\r\n"+
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n"+
+		twoTypes+"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs = h.Validate()
+	testIntegerEquals(t, "RFC 5322 header errors", len(errs), 1)
+
+	// only RFC 5322 headers are limited to one Subject
+	h, err = mail.ReadHeader("Subject: one\r\n"+
+		"Subject: two\r\n"+
+		"\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Valid() {
+		t.Errorf("MIME header with two Subject fields should be valid: %v", h.Validate())
+	}
+}
+
+func TestReceivedChain(t *testing.T) {
+	msg, err := mail.ReadMessage("Received: from relay.example.net by mx.example.org;\r\n" +
+		" Mon, 2 Nov 2015 10:00:02 -0800\r\n" +
+		"Received: garbled hop with no date\r\n" +
+		"Received: from client.example.com by relay.example.net;\r\n" +
+		" Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 09:59:58 -0800\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hops := msg.Header.Received()
+	if len(hops) != 3 {
+		t.Fatalf("incorrect number of Received fields: expected 3, got %d", len(hops))
+	}
+	testStringEquals(t, "first hop", hops[0].By, "mx.example.org")
+	testStringEquals(t, "second hop", hops[1].By, "")
+	if hops[1].When != nil {
+		t.Errorf("unexpected date on garbled hop: %v", hops[1].When)
+	}
+	testStringEquals(t, "third hop", hops[2].By, "relay.example.net")
+}
+
+func TestReferencesAndInReplyTo(t *testing.T) {
+	h, err := mail.ReadHeader("References: <root@example.com>\r\n"+
+		" <reply.1@example.org> <reply.2@example.net>\r\n"+
+		"In-Reply-To: <reply.2@example.net> (Bob's message of Monday)\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := h.References()
+	if len(refs) != 3 {
+		t.Fatalf("incorrect number of References: expected 3, got %d: %v", len(refs), refs)
+	}
+	testStringEquals(t, "References[0]", refs[0], "<root@example.com>")
+	testStringEquals(t, "References[1]", refs[1], "<reply.1@example.org>")
+	testStringEquals(t, "References[2]", refs[2], "<reply.2@example.net>")
+
+	irt := h.InReplyTo()
+	if len(irt) != 1 {
+		t.Fatalf("incorrect number of In-Reply-To ids: expected 1, got %d: %v", len(irt), irt)
+	}
+	testStringEquals(t, "In-Reply-To", irt[0], "<reply.2@example.net>")
+
+	h, err = mail.ReadHeader("Subject: no replies here\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.References() != nil || h.InReplyTo() != nil {
+		t.Error("expected no References or In-Reply-To ids")
+	}
+}
+
+func TestLongSubjectWords(t *testing.T) {
+	long := strings.Repeat("0123456789", 20)
+	for _, subject := range []string{long, "See " + long + " now", "Grüße " + long} {
+		h, err := mail.ReadHeaderUTF8("Subject: "+subject+"\r\n\r\n", mail.RFC5322Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the word fits within the hard limit, so it isn't broken
+		text := h.AsText(false)
+		unfolded := strings.Replace(strings.TrimSuffix(text, "\r\n"), "\r\n", "", -1)
+		testStringEquals(t, "unfolded", unfolded, "Subject: "+subject)
+
+		// encoded-words can be folded without changing the text
+		text = h.AsText(true)
+		lines := strings.Split(strings.TrimSuffix(text, "\r\n"), "\r\n")
+		if len(lines) < 3 {
+			t.Errorf("long word not split: %q", text)
+		}
+		// the first encoded-word can't be moved away from the name
+		for _, l := range lines[1:] {
+			if len(l) > 78 {
+				t.Errorf("line too long (%d characters): %q", len(l), l)
+			}
+		}
+		reparsed, err := mail.ReadHeader(text+"\r\n", mail.RFC5322Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, "reparsed", reparsed.Subject(), subject)
+	}
+
+	// beyond RFC 5322's limit of 998 characters, the word has to be broken
+	huge := strings.Repeat(long, 10)
+	h, err := mail.ReadHeader("Subject: "+huge+"\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := h.AsText(false)
+	for _, l := range strings.Split(strings.TrimSuffix(text, "\r\n"), "\r\n") {
+		if len(l) > 998 {
+			t.Errorf("line too long (%d characters)", len(l))
+		}
+	}
+	unfolded := strings.Replace(strings.TrimSuffix(text, "\r\n"), "\r\n", "", -1)
+	if strings.Replace(unfolded, " ", "", -1) != "Subject:"+huge {
+		t.Errorf("characters lost: %q", text)
+	}
+}
+
+func TestLongReferences(t *testing.T) {
+	long := "<" + strings.Repeat("x", 76) + "@example.com>"
+	testIntegerEquals(t, "Length of the long message-id", len(long), 90)
+	refs := []string{
+		"<root@example.com>",
+		"<reply.1@example.org>",
+		long,
+		"<reply.2@example.net>",
+		"<reply.3@example.net>",
+	}
+
+	for _, first := range []int{0, 2} {
+		ids := append([]string{}, refs[first:]...)
+		h, err := mail.ReadHeader("References: "+strings.Join(ids, " ")+"\r\n\r\n", mail.RFC5322Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := h.AsText(false)
+		for _, l := range strings.Split(strings.TrimSuffix(text, "\r\n"), "\r\n") {
+			if len(l) > 78 && l != " "+long {
+				t.Errorf("line too long (%d characters): %q", len(l), l)
+			}
+		}
+
+		reparsed, err := mail.ReadHeader(text+"\r\n", mail.RFC5322Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, "References", strings.Join(reparsed.References(), " "), strings.Join(ids, " "))
+	}
+}
+
+func TestHeaderEach(t *testing.T) {
+	h, err := mail.ReadHeader("Received: by c.example.com; Mon, 2 Nov 2015 10:00:02 -0800\r\n"+
+		"Subject: hello\r\n"+
+		"Received: by b.example.com; Mon, 2 Nov 2015 10:00:01 -0800\r\n"+
+		"Received: by a.example.com; Mon, 2 Nov 2015 10:00:00 -0800\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names, received []string
+	h.Each(func(name, value string) bool {
+		names = append(names, name)
+		if name == "Received" {
+			received = append(received, value)
+		}
+		return true
+	})
+	testStringEquals(t, "names", strings.Join(names, ","), "Received,Subject,Received,Received")
+	if len(received) != 3 {
+		t.Fatalf("incorrect number of Received fields: expected 3, got %d", len(received))
+	}
+	for i, host := range []string{"c", "b", "a"} {
+		if !strings.HasPrefix(received[i], "by "+host+".example.com") {
+			t.Errorf("Received field %d out of order: %q", i, received[i])
+		}
+	}
+
+	n := 0
+	h.Each(func(name, value string) bool {
+		n++
+		return name != "Subject"
+	})
+	testIntegerEquals(t, "fields visited before stopping", n, 2)
+}
+
+func TestReadHeaderUTF8(t *testing.T) {
+	text := "From: Jürgen Müller <juergen@example.com>\r\n" +
+		"To: \"Zoë, Chloé\" <zoe@example.com>\r\n" +
+		"Subject: Grüße aus Köln\r\n" +
+		"X-Note: naïve café\r\n" +
+		"\r\n"
+
+	h, err := mail.ReadHeaderUTF8(text, mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Subject", h.Subject(), "Grüße aus Köln")
+	from := h.Addresses(mail.FromFieldName)
+	if len(from) != 1 {
+		t.Fatalf("incorrect number of From addresses: expected 1, got %d", len(from))
+	}
+	testStringEquals(t, "From name", from[0].Name(false), "Jürgen Müller")
+	to := h.Addresses(mail.ToFieldName)
+	if len(to) != 1 {
+		t.Fatalf("incorrect number of To addresses: expected 1, got %d", len(to))
+	}
+	testStringEquals(t, "To name", to[0].Name(false), "\"Zoë, Chloé\"")
+	testStringEquals(t, "X-Note", h.Get("X-Note"), "naïve café")
+	for _, f := range h.Fields {
+		if f.Error() != nil {
+			t.Errorf("%s: %v", f.Name(), f.Error())
+		}
+	}
+	testStringEquals(t, "AsText", h.AsText(false),
+		"From: Jürgen Müller <juergen@example.com>\r\n"+
+			"To: \"Zoë, Chloé\" <zoe@example.com>\r\n"+
+			"Subject: Grüße aus Köln\r\n"+
+			"X-Note: naïve café\r\n")
+
+	// without UTF-8 support, the display-name can't be used
+	h, err = mail.ReadHeader(text, mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "ASCII From name", h.Addresses(mail.FromFieldName)[0].Name(false), "")
+}
+
+func TestResentBlocks(t *testing.T) {
+	h, err := mail.ReadHeader("Resent-From: carol@example.net\r\n"+
+		"Resent-To: dave@example.org\r\n"+
+		"Resent-Date: Wed, 04 Nov 2015 09:00:00 +0000\r\n"+
+		"Resent-Message-ID: <resent.2@example.net>\r\n"+
+		"Received: by mx.example.net; Tue, 03 Nov 2015 12:00:00 +0000\r\n"+
+		"Resent-From: bob@example.com\r\n"+
+		"Resent-To: carol@example.net, erin@example.net\r\n"+
+		"Resent-Date: Tue, 03 Nov 2015 11:00:00 +0000\r\n"+
+		"From: alice@example.com\r\n"+
+		"To: bob@example.com\r\n"+
+		"Date: Mon, 02 Nov 2015 10:00:00 +0000\r\n"+
+		"Subject: Minutes\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStringEquals(t, "ResentFrom", h.ResentFrom()[0].String(), "carol@example.net")
+	testIntegerEquals(t, "ResentTo count", len(h.ResentTo()), 1)
+	testIntegerEquals(t, "ResentDate", int(h.ResentDate().Unix()), 1446627600)
+	testIntegerEquals(t, "Date", int(h.Date().Unix()), 1446458400)
+
+	blocks := h.ResentBlocks()
+	if len(blocks) != 2 {
+		t.Fatalf("incorrect number of resent blocks: expected 2, got %d", len(blocks))
+	}
+	testIntegerEquals(t, "Fields in first block", len(blocks[0].Fields), 4)
+	testStringEquals(t, "First MessageID", blocks[0].MessageID, "<resent.2@example.net>")
+	testStringEquals(t, "Second From", blocks[1].From[0].String(), "bob@example.com")
+	testIntegerEquals(t, "Second To count", len(blocks[1].To), 2)
+	testIntegerEquals(t, "Second Date", int(blocks[1].Date.Unix()), 1446548400)
+	testStringEquals(t, "Second MessageID", blocks[1].MessageID, "")
+}
+
+func TestKeywords(t *testing.T) {
+	h, err := mail.ReadHeader("Keywords: budget,  \"Q4, draft\" ,=?utf-8?q?r=C3=A9sum=C3=A9?=\r\n"+
+		" =?utf-8?q?_final?=,,\r\n"+
+		"Subject: Minutes\r\n"+
+		"Keywords: (note) plain  words, a:b\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Keywords", strings.Join(h.Keywords(), "|"),
+		"budget|Q4, draft|résumé final|plain words|a:b")
+
+	h, _ = mail.ReadHeader("Subject: none\r\n\r\n", mail.RFC5322Header)
+	if k := h.Keywords(); k != nil {
+		t.Errorf("unexpected keywords: %q", k)
+	}
+}
+
+func TestAddResentBlock(t *testing.T) {
+	h, err := mail.ReadHeader("Resent-From: bob@example.com\r\n"+
+		"Resent-Date: Tue, 03 Nov 2015 11:00:00 +0000\r\n"+
+		"From: alice@example.com\r\n"+
+		"Date: Mon, 02 Nov 2015 10:00:00 +0000\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, _ := mail.ParseAddressList("Carol <carol@example.net>")
+	to, _ := mail.ParseAddressList("dave@example.org, erin@example.org")
+	date := time.Date(2015, 11, 4, 9, 0, 0, 0, time.UTC)
+	h.AddResentBlock(from, to, date, "resent.2@example.net")
+
+	names := []string{}
+	for _, f := range h.Fields {
+		names = append(names, f.Name())
+	}
+	testStringEquals(t, "field order", strings.Join(names, " "),
+		"Resent-Date Resent-From Resent-To Resent-Message-ID Resent-From Resent-Date From Date")
+	testStringEquals(t, "Resent-To", h.Get("Resent-To"), "dave@example.org, erin@example.org")
+
+	blocks := h.ResentBlocks()
+	if len(blocks) != 2 {
+		t.Fatalf("incorrect number of resent blocks: expected 2, got %d", len(blocks))
+	}
+	testStringEquals(t, "From", blocks[0].From[0].String(), "Carol <carol@example.net>")
+	testIntegerEquals(t, "To count", len(blocks[0].To), 2)
+	testIntegerEquals(t, "Date", int(blocks[0].Date.Unix()), int(date.Unix()))
+	testStringEquals(t, "MessageID", blocks[0].MessageID, "<resent.2@example.net>")
+	testStringEquals(t, "Earlier From", blocks[1].From[0].String(), "bob@example.com")
+}
+
+func TestRawField(t *testing.T) {
+	dkim := "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel;\r\n" +
+		"\th=from:subject:date; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		"\tb=dzdVyOfAKCdLXdJOc9G2q8LoXSlEniSbav+yuU4zGeeruD00lszZVoG4ZHRNiYzR"
+	from := "from:   Alice  Example <alice@EXAMPLE.com> "
+	date := "Date: Mon, 2 Nov 2015 10:00:00 -0800 (PST)"
+	h, err := mail.ReadHeader(dkim+"\r\n"+from+"\r\n"+date+"\r\n\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIntegerEquals(t, "Number of fields", len(h.Fields), 3)
+	testStringEquals(t, "DKIM-Signature", h.Fields[0].Raw(), dkim)
+	testStringEquals(t, "From", h.Fields[1].Raw(), from)
+	testStringEquals(t, "Date", h.Fields[2].Raw(), date)
+
+	h.Add("Subject", "added")
+	testStringEquals(t, "Added field", h.Fields[3].Raw(), "")
+}
+
+func TestCanonicalize(t *testing.T) {
+	// the example in RFC 6376 section 3.4.5
+	h, err := mail.ReadHeader("A: X\r\n"+
+		"B : Y\t\r\n"+
+		"\tZ  \r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStringEquals(t, "Simple A", h.CanonicalizeSimple("a"), "A: X\r\n")
+	testStringEquals(t, "Simple B", h.CanonicalizeSimple("b"), "B : Y\t\r\n\tZ  \r\n")
+	testStringEquals(t, "Relaxed A", h.CanonicalizeRelaxed("a"), "a:X\r\n")
+	testStringEquals(t, "Relaxed B", h.CanonicalizeRelaxed("b"), "b:Y Z\r\n")
+	testStringEquals(t, "Missing", h.CanonicalizeRelaxed("c"), "")
+
+	// DKIM uses the last instance of a field
+	h, err = mail.ReadHeader("Received: by a.example.com; Mon, 2 Nov 2015 10:00:00 -0800\r\n"+
+		"Received:  by  b.example.com;\r\n Mon, 2 Nov 2015 09:00:00 -0800\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Relaxed Received", h.CanonicalizeRelaxed("Received"),
+		"received:by b.example.com; Mon, 2 Nov 2015 09:00:00 -0800\r\n")
+
+	// even if it's an address field, which is merged into the first
+	h, err = mail.ReadHeader("To: a@example.com\r\n"+
+		"Subject: x\r\n"+
+		"To: b@example.com\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Simple To", h.CanonicalizeSimple("To"), "To: b@example.com\r\n")
+	testStringEquals(t, "Relaxed To", h.CanonicalizeRelaxed("To"), "to:b@example.com\r\n")
+	testStringEquals(t, "Raw To", h.Fields[0].Raw(), "To: a@example.com")
+}
+
+func TestContentDispositionDates(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Disposition: attachment; filename=report.pdf;\r\n"+
+		" creation-date=\"Mon, 02 Nov 2015 10:00:00 -0800\";\r\n"+
+		" modification-date=\"Tue, 03 Nov 2015 11:30:00 +0000\"\r\n"+
+		"\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cd := h.ContentDisposition()
+	if cd == nil {
+		t.Fatal("missing Content-Disposition")
+	}
+	if cd.CreationDate() == nil || cd.ModificationDate() == nil {
+		t.Fatal("missing dates")
+	}
+	testIntegerEquals(t, "creation-date", int(cd.CreationDate().Unix()), 1446487200)
+	testIntegerEquals(t, "modification-date", int(cd.ModificationDate().Unix()), 1446550200)
+
+	h, err = mail.ReadHeader("Content-Disposition: attachment; creation-date=\"yesterday\"\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ContentDisposition().CreationDate() != nil {
+		t.Error("unparseable creation-date was accepted")
+	}
+	if h.ContentDisposition().ModificationDate() != nil {
+		t.Error("missing modification-date was found")
+	}
+}
+
+func TestEmptyFieldValue(t *testing.T) {
+	for _, value := range []string{"", " ", "   ", ":", ": :"} {
+		for _, name := range []string{"Date", "Message-Id", "From", "X-Whatever"} {
+			f := mail.NewHeaderField(name, value)
+			if !f.Valid() {
+				testStringEquals(t, name+" unparsed value", f.UnparsedValue(), value)
+			}
+		}
+	}
+}
+
+func TestTruncatedHeader(t *testing.T) {
+	inputs := []string{
+		"From ",
+		"From",
+		"From \r",
+		"From alice@example.com Mon Nov  2 10:00:00 2015\r",
+		"From alice@example.com Mon Nov  2 10:00:00 2015\r\nSubject: hi",
+		"Subject:",
+		"Subject:  ",
+		"Subject: hello\r",
+		"Subject: hello\r\nTo: alice@exa",
+		"Subject: hello\r\n ",
+		"Subject",
+		"\xef\xbb",
+		"",
+	}
+	for _, in := range inputs {
+		h, err := mail.ReadHeader(in, mail.RFC5322Header)
+		if err != nil {
+			t.Errorf("unexpected error reading %q: %v", in, err)
+		}
+		if h == nil {
+			t.Errorf("no header returned for %q", in)
+		}
+	}
+
+	h, _ := mail.ReadHeader("From alice@example.com Mon Nov  2 10:00:00 2015\r\nSubject: hi", mail.RFC5322Header)
+	testStringEquals(t, "Subject after From line", h.Subject(), "hi")
+}
+
+func TestSender(t *testing.T) {
+	h, err := mail.ReadHeader("From: alice@example.com\r\n"+
+		"Sender: Bob <bob@example.com>\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := h.Sender()
+	if sender == nil {
+		t.Fatal("no sender")
+	}
+	testStringEquals(t, "Sender", sender.String(), "Bob <bob@example.com>")
+
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Sender: @@@\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender := msg.Header.Sender(); sender != nil {
+		t.Errorf("unexpected sender %q", sender.String())
+	}
+	if strings.Contains(msg.RFC822(false), "Sender:") {
+		t.Error("empty Sender field was not dropped")
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Language: en-us, ZH-hant-tw, de-CH-x-phonebk\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := h.ContentLanguage()
+	if cl == nil {
+		t.Fatal("no Content-Language field")
+	}
+	if !cl.Valid() {
+		t.Errorf("unexpected error: %v", cl.Error())
+	}
+	testStringEquals(t, "Languages", strings.Join(cl.Languages, " "), "en-US zh-Hant-TW de-CH-x-phonebk")
+	testStringEquals(t, "Primary language", cl.PrimaryLanguage(), "en")
+
+	h, err = mail.ReadHeader("Content-Language: fr, en-thisistoolong, zh-Hant\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl = h.ContentLanguage()
+	if cl == nil {
+		t.Fatal("no Content-Language field")
+	}
+	if cl.Valid() {
+		t.Error("expected an error for an invalid language tag")
+	}
+	testStringEquals(t, "Valid languages", strings.Join(cl.Languages, " "), "fr zh-Hant")
+}
+
+func TestRemoveFirstAndLast(t *testing.T) {
+	h, err := mail.ReadHeader("Received: from a by b; Mon, 2 Nov 2015 10:00:03 -0800\r\n"+
+		"Subject: hi\r\n"+
+		"Received: from c by d; Mon, 2 Nov 2015 10:00:02 -0800\r\n"+
+		"Received: from e by f; Mon, 2 Nov 2015 10:00:01 -0800\r\n"+
+		"\r\n", mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.RemoveFirst("received")
+	h.RemoveLast("RECEIVED")
+	testIntegerEquals(t, "Number of fields", len(h.Fields), 2)
+	testStringEquals(t, "Remaining field", h.AsText(false),
+		"Subject: hi\r\nReceived: from c by d; Mon, 2 Nov 2015 10:00:02 -0800\r\n")
+
+	h.RemoveLast("Received")
+	h.RemoveFirst("Received")
+	testStringEquals(t, "Header without Received", h.AsText(false), "Subject: hi\r\n")
+}
+
+func TestEncodingType(t *testing.T) {
+	for _, e := range []mail.EncodingType{mail.QPEncoding, mail.Base64Encoding, mail.UuencodeEncoding, mail.BinaryEncoding} {
+		parsed, err := mail.ParseEncoding(e.String())
+		if err != nil {
+			t.Errorf("ParseEncoding(%q): %v", e, err)
+		} else if parsed != e {
+			t.Errorf("ParseEncoding(%q): expected %d, got %d", e, e, parsed)
+		}
+	}
+
+	for _, s := range []string{"8bit", "BINARY", "Quoted-Printable", "uuencode"} {
+		if _, err := mail.ParseEncoding(s); err != nil {
+			t.Errorf("ParseEncoding(%q): %v", s, err)
+		}
+	}
+	if _, err := mail.ParseEncoding("x-gzip"); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+	if _, err := mail.ParseEncoding(""); err == nil {
+		t.Error("expected an error for an empty encoding")
+	}
+
+	h, err := mail.ReadHeader("Content-Transfer-Encoding: 8bit\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Encoding", h.ContentTransferEncoding().Encoding.String(), "7bit")
+}
+
+func TestContentTransferEncodingKeywords(t *testing.T) {
+	keywords := map[string]mail.EncodingType{
+		"7bit":             mail.BinaryEncoding,
+		"8bit":             mail.BinaryEncoding,
+		"binary":           mail.BinaryEncoding,
+		"quoted-printable": mail.QPEncoding,
+		"base64":           mail.Base64Encoding,
+		"x-uuencode":       mail.UuencodeEncoding,
+	}
+	for keyword, e := range keywords {
+		h, err := mail.ReadHeader("Content-Transfer-Encoding: "+strings.ToUpper(keyword)+"\r\n\r\n", mail.MIMEHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cte := h.ContentTransferEncoding()
+		if cte == nil || !cte.Valid() {
+			t.Errorf("%s: no valid Content-Transfer-Encoding field", keyword)
+		} else if cte.Encoding != e {
+			t.Errorf("%s: expected %v, got %v", keyword, e, cte.Encoding)
+		}
+	}
+}
+
+func TestContentTypeParameters(t *testing.T) {
+	h, err := mail.ReadHeader("Content-Type: multipart/signed; micalg=PGP-SHA256;\r\n"+
+		" protocol=\"Application/PGP-Signature\"; boundary=b\r\n"+
+		"\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := h.ContentType()
+	testStringEquals(t, "Protocol", ct.Protocol(), "application/pgp-signature")
+	testStringEquals(t, "MicAlg", ct.MicAlg(), "pgp-sha256")
+	testStringEquals(t, "ReportType", ct.ReportType(), "")
+
+	h, err = mail.ReadHeader("Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct = h.ContentType()
+	testStringEquals(t, "ReportType", ct.ReportType(), "delivery-status")
+	testStringEquals(t, "Protocol", ct.Protocol(), "")
+}
+
+func TestLocalHostname(t *testing.T) {
+	defer func(h string) { mail.LocalHostname = h }(mail.LocalHostname)
+
+	const bounce = "From: <>\r\n" +
+		"To: alice@example.org\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Message-Id: <1234@mail.example.com>\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello.\r\n"
+
+	// written elsewhere: blame the postmaster of the Message-Id domain
+	mail.LocalHostname = "mx.example.net"
+	msg, err := mail.ReadMessage(bounce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := msg.Header.Addresses(mail.FromFieldName)
+	testIntegerEquals(t, "From addresses", len(from), 1)
+	testStringEquals(t, "From", from[0].Localpart+"@"+from[0].Domain, "postmaster@example.com")
+
+	// written here: don't
+	mail.LocalHostname = "MX.Example.COM"
+	msg, err = mail.ReadMessage(bounce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range msg.Header.Addresses(mail.FromFieldName) {
+		if a.Localpart == "postmaster" {
+			t.Errorf("From blamed on %s", a.String())
+		}
+	}
+}
+
+// A Content-Duration field (RFC 3803), holding a number of seconds.
+type durationField struct {
+	*mail.HeaderField
+	Seconds int
+}
+
+func (f *durationField) Parse(s string) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		f.SetError(fmt.Errorf("Invalid duration: %q", s))
+		return
+	}
+	f.Seconds = n
+	f.SetValue(strconv.Itoa(n))
+}
+
+func TestRegisterField(t *testing.T) {
+	mail.RegisterField("content-duration", func(name string) mail.Field {
+		return &durationField{HeaderField: mail.NewUnstructuredField(name)}
+	})
+
+	f, ok := mail.NewHeaderField("Content-Duration", " 42 ").(*durationField)
+	if !ok {
+		t.Fatal("Content-Duration doesn't use the registered field")
+	}
+	testStringEquals(t, "Name", f.Name(), "Content-Duration")
+	testIntegerEquals(t, "Seconds", f.Seconds, 42)
+	testStringEquals(t, "Value", f.Value(), "42")
+	if !f.Valid() {
+		t.Error(f.Error())
+	}
+	if mail.NewHeaderField("Content-Duration", "forever").Valid() {
+		t.Error("expected an invalid Content-Duration")
+	}
+
+	h, err := mail.ReadHeader("Content-Duration: 7\r\n\r\n", mail.MIMEHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Fields) != 1 {
+		t.Fatalf("expected 1 field, got %d", len(h.Fields))
+	}
+	if f, ok := h.Fields[0].(*durationField); !ok || f.Seconds != 7 {
+		t.Errorf("ReadHeader didn't use the registered field: %#v", h.Fields[0])
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic when registering Subject")
+		}
+	}()
+	mail.RegisterField("subject", func(name string) mail.Field {
+		return mail.NewUnstructuredField(name)
+	})
+}
+
+func TestHeaderDiff(t *testing.T) {
+	const s = "From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n"
+	before, err := mail.ReadHeader(s, mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := mail.ReadHeader(s, mail.RFC5322Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := before.Diff(after); d != nil {
+		t.Errorf("identical headers differ: %q", d)
+	}
+
+	after.Repair()
+	after.Set(mail.SubjectFieldName, "Re: Hello")
+	after.Add("X-Repaired", "yes")
+	d := before.Diff(after)
+	want := []string{
+		"- Date: Mon, 02 Nov 2015 10:00:00 -0800",
+		"~ Subject: Hello -> Re: Hello",
+		"+ X-Repaired: yes",
+	}
+	testStringEquals(t, "Diff", strings.Join(d, "\n"), strings.Join(want, "\n"))
+}
@@ -2,7 +2,11 @@ package mail
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
 	"strconv"
+	"strings"
 )
 
 const crlf = "\015\012"
@@ -11,39 +15,129 @@ type Message struct {
 	*Part
 	RFC822Size   int `json:"size"`
 	InternalDate int `json:"-"`
+
+	// true if this message is always written as RFC822(true) writes it;
+	// see Downgrade()
+	avoidUTF8 bool
 }
 
 func NewMessage() *Message {
 	return &Message{Part: &Part{}}
 }
 
+// The nesting limit ReadMessage and Parse use. Each multipart or
+// message/rfc822 entity adds one or two levels, so this is far beyond what
+// legitimate mail needs.
+const DefaultMaxNestingDepth = 50
+
+// ErrNestingTooDeep is returned when a message's MIME structure is nested
+// more deeply than the parser's limit allows.
+var ErrNestingTooDeep = errors.New("MIME structure nested too deeply")
+
+// ErrNot7Bit is returned by Downgrade() when it can't make a message 7-bit
+// clean.
+var ErrNot7Bit = errors.New("message cannot be downgraded to 7-bit")
+
+// ReadMessage parses \a rfc5322 as a message. Any input is accepted without
+// panicking, so untrusted mail can be parsed safely, but what becomes of input
+// that is very far from RFC 5322 is unspecified.
 func ReadMessage(rfc5322 string) (*Message, error) {
+	return ReadMessageLimit(rfc5322, DefaultMaxNestingDepth)
+}
+
+// ReadMessageLimit is like ReadMessage, but stops descending into multiparts
+// and encapsulated messages more than maxDepth levels deep; see ParseLimit().
+func ReadMessageLimit(rfc5322 string, maxDepth int) (*Message, error) {
+	m := NewMessage()
+	err := m.ParseLimit(rfc5322, maxDepth)
+	return m, err
+}
+
+// ReadMessageStrict is like ReadMessage, but doesn't repair the headers of
+// the message and its parts: invalid fields are kept, no From or Date field
+// is synthesized, redundant fields aren't removed, and Header.Valid() reports
+// false for a header that is invalid as written. This suits programs that
+// need to see the message as it was sent, e.g. for forensics or archival.
+//
+// The Content-Type and Content-Transfer-Encoding fields of leaf parts are
+// still adjusted to describe how RFC822() would write those parts.
+func ReadMessageStrict(rfc5322 string) (*Message, error) {
 	m := NewMessage()
-	err := m.Parse(rfc5322)
+	m.maxDepth = DefaultMaxNestingDepth
+	m.strict = true
+	err := m.parse(rfc5322, 0)
 	return m, err
 }
 
+// ReadMessageFrom reads a message from r and parses it. The entire message is
+// currently read into memory before parsing begins, so this uses at least as
+// much memory as ReadMessage.
+func ReadMessageFrom(r io.Reader) (*Message, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ReadMessage(string(b))
+}
+
 func (m *Message) Parse(rfc5322 string) error {
-	h, err := ReadHeader(rfc5322, RFC5322Header)
+	return m.ParseLimit(rfc5322, DefaultMaxNestingDepth)
+}
+
+// ParseLimit is like Parse, but doesn't descend into multiparts and
+// encapsulated messages more than \a maxDepth levels deep. Such entities are
+// kept unparsed in their Data, and ErrNestingTooDeep is returned along with
+// the rest of the message. A limit of zero or less means no limit.
+//
+// When this message is itself encapsulated in another, the outermost
+// message's limit applies.
+func (m *Message) ParseLimit(rfc5322 string, maxDepth int) error {
+	m.maxDepth = maxDepth
+	return m.parse(rfc5322, 0)
+}
+
+// Parses \a rfc5322, which starts at \a offset in the text being parsed, into
+// this message. The offsets recorded in each Part are relative to the start
+// of that text.
+func (m *Message) parse(rfc5322 string, offset int) error {
+	// messages encapsulated in message/global may use UTF-8 (RFC 6532)
+	allowUTF8 := false
+	if m.parent != nil && m.parent.Header != nil {
+		ct := m.parent.Header.ContentType()
+		allowUTF8 = ct != nil && ct.Type == "message" && ct.Subtype == "global"
+	}
+	h, err := readHeader(rfc5322, RFC5322Header,
+		DefaultMaxHeaderFields, DefaultMaxHeaderBytes, allowUTF8)
 	if err != nil {
 		return err
 	}
 	m.Header = h
 	m.RFC822Size = len(rfc5322)
-	h.Repair()
-	h.RepairWithBody(m.Part, rfc5322[h.numBytes:])
+	strict := m.strictParsing()
+	if !strict {
+		h.Repair()
+		h.RepairWithBody(m.Part, rfc5322[h.numBytes:])
+	}
 
 	ct := h.ContentType()
 	if ct != nil && ct.Type == "multipart" {
-		m.parseMultipart(rfc5322, ct.parameter("boundary"), ct.Subtype == "digest")
+		m.parseMultipart(rfc5322, ct.parameter("boundary"), ct.Subtype == "digest", offset)
+		m.BodyOffset = offset + h.numBytes
+		m.BodyEnd = offset + len(rfc5322)
 	} else {
-		bp := m.parseBodypart(rfc5322[h.numBytes:], h)
+		bp := m.parseBodypart(rfc5322[h.numBytes:], h, offset+h.numBytes)
 		m.Part = bp
 	}
+	m.HeaderOffset = offset
 
 	//m.fix8BitHeaderFields()
-	m.Header.Simplify()
+	if !strict {
+		m.Header.Simplify()
+	}
 
+	if m.parent == nil && m.Part.nestedTooDeep() {
+		return ErrNestingTooDeep
+	}
 	return nil
 }
 
@@ -59,31 +153,328 @@ func (m *Message) RFC822(avoidUTF8 bool) string {
 	} else {
 		buf.Grow(50000)
 	}
+	m.writeRFC822(&buf, avoidUTF8, false)
+	return buf.String()
+}
 
-	buf.WriteString(m.Header.AsText(avoidUTF8))
-	buf.WriteString(crlf)
-	buf.WriteString(m.Body(avoidUTF8))
-
+// Returns the message formatted like RFC822(\a avoidUTF8), except that if
+// \a allow8bit is true, text that would otherwise be quoted-printable encoded
+// is sent verbatim with Content-Transfer-Encoding: 8bit where possible. That
+// is only appropriate when the transport is 8-bit clean, e.g. an SMTP server
+// that supports 8BITMIME.
+func (m *Message) Serialize(avoidUTF8, allow8bit bool) string {
+	var buf strings.Builder
+	m.writeRFC822(&buf, avoidUTF8, allow8bit)
 	return buf.String()
 }
 
+// WriteTo writes the message to \a w in the same format as RFC822(false),
+// without first assembling the entire message in memory. It returns the
+// number of bytes written and the first error encountered.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	m.writeRFC822(cw, false, false)
+	return cw.n, cw.err
+}
+
+// Returns the length of the message as RFC822(false) formats it, which may
+// differ from RFC822Size, the size of the text it was parsed from, since the
+// message is repaired and canonicalized.
+//
+// The message is formatted to find out, but isn't changed: as with RFC822(),
+// a multipart whose boundary must be replaced is counted with a new one that
+// isn't stored. Since GenerateBoundary() always returns boundaries of the
+// same length, the result doesn't depend on which one is chosen.
+func (m *Message) Size() int {
+	n, _ := m.WriteTo(ioutil.Discard)
+	return int(n)
+}
+
+func (m *Message) writeRFC822(w io.Writer, avoidUTF8, allow8bit bool) {
+	newPartWriter(avoidUTF8 || m.avoidUTF8, allow8bit && !m.avoidUTF8).writeMessage(w, m)
+}
+
+// Returns true if this message can't be submitted without the SMTPUTF8
+// extension (RFC 6531), i.e. if the From, To, Cc, Bcc or Sender field
+// contains an address whose localpart isn't ASCII or whose domain can't be
+// converted to ASCII. RFC822(true) would replace such addresses with
+// placeholders. Non-ASCII display-names don't need SMTPUTF8, since they can be
+// RFC 2047 encoded.
+func (m *Message) NeedsSMTPUTF8() bool {
+	if m.Header == nil {
+		return false
+	}
+	for _, f := range m.Header.Fields {
+		switch f.Name() {
+		case FromFieldName, ToFieldName, CcFieldName, BccFieldName, SenderFieldName:
+		default:
+			continue
+		}
+		af, ok := f.(*AddressField)
+		if !ok {
+			continue
+		}
+		for i := range af.Addresses {
+			if af.Addresses[i].needsUnicode() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a copy of this message that can be sent over a 7-bit channel
+// without the SMTPUTF8 extension. The copy is the message as RFC822(true)
+// formats it: Non-ASCII header text is RFC 2047 encoded, addresses that need
+// Unicode are replaced by "this-address@needs-unicode.invalid", and bodies are
+// quoted-printable or base64 encoded. Returns ErrNot7Bit if the result would
+// still contain 8-bit data. This message is not modified.
+//
+// As with any parsed message, the copy's header text is stored decoded.
+// RFC822(), Serialize(), WriteTo() and the other functions that write the
+// copy always avoid UTF-8 and never use the 8bit encoding, whatever their
+// arguments, so that it stays 7-bit even after changes.
+func (m *Message) Downgrade() (*Message, error) {
+	// text changed since parsing may not have the right
+	// content-transfer-encoding yet. parsing chooses one, so the
+	// second round produces the final form.
+	d, err := ReadMessage(m.RFC822(true))
+	if err != nil {
+		return nil, err
+	}
+	s := d.RFC822(true)
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 128 {
+			return nil, ErrNot7Bit
+		}
+	}
+	d, err = ReadMessage(s)
+	if err != nil {
+		return nil, err
+	}
+	d.avoidUTF8 = true
+	return d, nil
+}
+
 // Returns the text representation of the body of this message.
 func (m *Message) Body(avoidUTF8 bool) string {
+	return m.SerializeBody(avoidUTF8, false)
+}
+
+// Returns the body of this message as it appears in Serialize(\a avoidUTF8,
+// \a allow8bit).
+func (m *Message) SerializeBody(avoidUTF8, allow8bit bool) string {
 	buf := new(bytes.Buffer)
+	newPartWriter(avoidUTF8 || m.avoidUTF8, allow8bit && !m.avoidUTF8).writeBody(buf, m)
+	return buf.String()
+}
 
+// Returns the Part holding the body of a single-part message, which shares
+// the message's header, or nil if this is a multipart message.
+func (m *Message) singlePart() *Part {
 	ct := m.Header.ContentType()
 	if ct != nil && ct.Type == "multipart" {
-		m.appendMultipart(buf, avoidUTF8)
+		return nil
+	}
+	// FIXME: Is this the right place to restore this linkage?
+	if len(m.Parts) > 0 {
+		firstChild := m.Parts[0]
+		firstChild.Header = m.Header
+		return firstChild
+	}
+	// a single-part message holds its body itself
+	return m.Part
+}
+
+// Rebuilds the MIME structure of this message after its Parts have been
+// changed, e.g. after an attachment has been appended to Parts. A part that
+// isn't a multipart but has children is turned into a multipart/mixed whose
+// first child holds the part's own body and Content-* fields. Every multipart
+// gets a boundary that occurs nowhere within it, and the Number and parent of
+// each part are set to match its position. A message that has parts but no
+// header gets a header whose Content-Type is multipart/mixed, and a part
+// without a header gets one describing its Text or Data.
+//
+// Encapsulated messages are flattened too.
+func (m *Message) Flatten() {
+	if m.Header == nil && len(m.Parts) > 0 {
+		// built by hand, with nothing but the parts
+		m.Header = &Header{mode: RFC5322Header}
+		m.Header.Add(MIMEVersionFieldName, "1.0")
+		m.Header.Add(ContentTypeFieldName, "multipart/mixed; boundary="+GenerateBoundary())
+	}
+	m.Part.flatten()
+	if m.Header != nil && m.Header.mode == RFC5322Header {
+		m.Header.Simplify()
+	}
+	m.settleBoundaries()
+}
+
+// Does the work for Message.Flatten() for this Part and the parts below it.
+func (p *Part) flatten() {
+	if p.Header != nil && len(p.Parts) > 0 {
+		ct := p.Header.ContentType()
+		if (ct == nil || ct.Type != "multipart") && !isMessage(ct) {
+			p.wrapInMultipart()
+		}
+	}
+	for i, c := range p.Parts {
+		if c.Header == nil {
+			c.Header = defaultHeader(c)
+		}
+		c.parent = p
+		c.Number = i + 1
+		c.flatten()
+	}
+	if len(p.Parts) == 0 && p.message != nil && p.message.Part != nil {
+		p.message.Flatten()
+	}
+}
+
+// Returns a MIME header for \a p, a Part built without one: that of a
+// text/plain part if p has Text, and that of a base64-encoded
+// application/octet-stream part if it has only Data.
+func defaultHeader(p *Part) *Header {
+	if p.Text == "" && p.Data != "" {
+		h := &Header{mode: MIMEHeader}
+		h.Add(ContentTypeFieldName, "application/octet-stream")
+		h.Add(ContentTransferEncodingFieldName, "base64")
+		return h
+	}
+	return textBodyPart("plain", p.Text).Header
+}
+
+// Turns this Part into a multipart/mixed. Its Content-* fields and body move
+// to a new first child, unless the first child already uses this Part's
+// header, in which case that child is the body (see singlePart()).
+func (p *Part) wrapInMultipart() {
+	h := &Header{mode: MIMEHeader, utf8: p.Header.utf8}
+	ct := p.Header.ContentTypeString()
+	i := 0
+	for i < len(p.Header.Fields) {
+		f := p.Header.Fields[i]
+		if strings.HasPrefix(strings.ToLower(f.Name()), "content-") {
+			h.addField(f)
+			p.Header.RemoveAt(i)
+		} else {
+			i++
+		}
+	}
+	if h.ContentType() == nil {
+		h.Add(ContentTypeFieldName, ct)
+	}
+	h.Simplify()
+
+	if p.Parts[0].Header == p.Header || p.Parts[0].Header == nil {
+		p.Parts[0].Header = h
 	} else {
-		// FIXME: Is this the right place to restore this linkage?
-		if len(m.Parts) > 0 {
-			firstChild := m.Parts[0]
-			firstChild.Header = m.Header
-			m.appendAnyPart(buf, firstChild, ct, avoidUTF8)
+		body := &Part{
+			Header:  h,
+			hasText: p.hasText,
+			Text:    p.Text,
+			Data:    p.Data,
 		}
+		p.Parts = append([]*Part{body}, p.Parts...)
 	}
+	p.hasText = false
+	p.Text = ""
+	p.Data = ""
 
-	return buf.String()
+	p.Header.Add(ContentTypeFieldName, "multipart/mixed; boundary="+GenerateBoundary())
+}
+
+// A countingWriter passes writes on to w until one fails, and counts the
+// bytes written. Once a write has failed, all further writes are ignored.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// Returns the decoded text of the message's text/plain body, descending into
+// multiparts as needed. The second result is false if there is no such body.
+func (m *Message) PlainText() (string, bool) {
+	p := m.Part.textPart("plain")
+	if p == nil {
+		return "", false
+	}
+	return p.Text, true
+}
+
+// Returns the decoded text of the message's text/html body, descending into
+// multiparts as needed. The second result is false if there is no such body.
+func (m *Message) HTML() (string, bool) {
+	p := m.Part.textPart("html")
+	if p == nil {
+		return "", false
+	}
+	return p.Text, true
+}
+
+// Returns the attachments in this message, in the order in which they
+// appear. See Part.IsAttachment.
+func (m *Message) Attachments() []*Part {
+	var l []*Part
+	m.Part.Walk(func(p *Part, depth int) bool {
+		if p.IsAttachment() {
+			l = append(l, p)
+			return false
+		}
+		return true
+	})
+	return l
+}
+
+// Returns the part whose Content-ID is \a cid, or nil if there is none. \a cid
+// may be given with or without angle brackets, or as a cid: URL as found in
+// HTML bodies. The comparison is case-sensitive.
+func (m *Message) PartByContentID(cid string) *Part {
+	cid = strings.TrimPrefix(cid, "cid:")
+	cid = strings.TrimSuffix(strings.TrimPrefix(cid, "<"), ">")
+	if cid == "" {
+		return nil
+	}
+	var r *Part
+	m.Part.Walk(func(p *Part, depth int) bool {
+		if r != nil {
+			return false
+		}
+		if p.Header != nil {
+			id := p.Header.Get(ContentIDFieldName)
+			if strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">") == cid {
+				r = p
+			}
+		}
+		return r == nil
+	})
+	return r
+}
+
+// Returns the message-id of the root of this message's thread, as far as can
+// be told from this message alone: the first References entry, or failing
+// that the first In-Reply-To entry, or failing that this message's own
+// Message-ID. Returns an empty string if there is none of these.
+func (m *Message) ThreadID() string {
+	if m.Header == nil {
+		return ""
+	}
+	if refs := m.Header.References(); len(refs) > 0 {
+		return refs[0]
+	}
+	if irt := m.Header.InReplyTo(); len(irt) > 0 {
+		return irt[0]
+	}
+	return m.Header.MessageID()
 }
 
 // Returns a pointer to the Bodypart whose IMAP part number is \a s and
@@ -1,7 +1,18 @@
 package mail_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/paulrosania/go-mail"
 )
 
 func TestPlainBody(t *testing.T) {
@@ -121,3 +132,1133 @@ func TestMalformedMultipartTerminator(t *testing.T) {
 	// 32756 = byte length of original file
 	testIntegerEquals(t, "Part 2 data size", len(parts[1].Data), 32756)
 }
+
+func TestDecodedData(t *testing.T) {
+	msg := loadFixture(t, "multipart")
+
+	// 32756 = byte length of original file
+	testIntegerEquals(t, "Part 2 decoded data size", len(msg.Parts[1].DecodedData()), 32756)
+	if !bytes.HasPrefix(msg.Parts[1].DecodedData(), []byte("\x89PNG")) {
+		t.Error("decoded data is not a PNG image")
+	}
+	read, err := ioutil.ReadAll(msg.Parts[1].DecodedReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, msg.Parts[1].DecodedData()) {
+		t.Error("DecodedReader and DecodedData differ")
+	}
+
+	// the copy belongs to the caller
+	data := msg.Parts[1].DecodedData()
+	data[0] = 0
+	if msg.Parts[1].Data[0] != 0x89 {
+		t.Error("modifying DecodedData changed the part")
+	}
+
+	msg, err = mail.ReadMessage("From: a@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: x-uuencode\r\n" +
+		"\r\n" +
+		"begin 644 cat.txt\r\n" +
+		"$8V%T(0``\r\n" +
+		"`\r\n" +
+		"end\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Uudecoded data", string(msg.DecodedData()), "cat!")
+}
+
+func TestFilename(t *testing.T) {
+	msg := loadFixture(t, "multipart")
+
+	parts := msg.Parts
+	if len(parts) != 2 {
+		t.Fatalf("incorrect number of message parts: expected 2, got %d", len(parts))
+	}
+
+	testStringEquals(t, "Part 1 filename", parts[0].Filename(), "")
+	testStringEquals(t, "Part 2 filename", parts[1].Filename(), "catmustache.png")
+
+	msg, err := mail.ReadMessage("From: a@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: application/octet-stream; name=\"=?utf-8?q?=E2=98=BA.bin?=\"\r\n" +
+		"\r\n" +
+		"data\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Message filename", msg.Filename(), "☺.bin")
+}
+
+func TestAttachments(t *testing.T) {
+	msg := loadFixture(t, "multipart")
+
+	if msg.Parts[0].IsAttachment() {
+		t.Errorf("multipart/alternative part should not be an attachment")
+	}
+
+	attachments := msg.Attachments()
+	if len(attachments) != 1 {
+		t.Fatalf("incorrect number of attachments: expected 1, got %d", len(attachments))
+	}
+	testStringEquals(t, "Attachment filename", attachments[0].Filename(), "catmustache.png")
+
+	msg, err := mail.ReadMessage("From: a@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See the forwarded message.\r\n" +
+		"--outer\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"From: b@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 09:00:00 -0800\r\n" +
+		"Content-Type: multipart/mixed; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Report attached.\r\n" +
+		"--inner\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=report.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0xLjQK\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attachments = msg.Attachments()
+	if len(attachments) != 1 {
+		t.Fatalf("incorrect number of nested attachments: expected 1, got %d", len(attachments))
+	}
+	testStringEquals(t, "Nested attachment filename", attachments[0].Filename(), "report.pdf")
+	testStringEquals(t, "Nested attachment data", attachments[0].Data, "%PDF-1.4\n")
+}
+
+func TestPartByContentID(t *testing.T) {
+	msg := loadFixture(t, "multipart")
+
+	for _, cid := range []string{"ii_150b178a80ecad03", "<ii_150b178a80ecad03>", "cid:ii_150b178a80ecad03"} {
+		p := msg.PartByContentID(cid)
+		if p != msg.Parts[1] {
+			t.Errorf("%s did not resolve to the image part", cid)
+		}
+	}
+
+	if p := msg.PartByContentID("II_150B178A80ECAD03"); p != nil {
+		t.Error("Content-ID lookup should be case-sensitive")
+	}
+	if p := msg.PartByContentID("missing@example.com"); p != nil {
+		t.Error("unexpected part for a missing Content-ID")
+	}
+}
+
+func TestPlainTextAndHTML(t *testing.T) {
+	msg := loadFixture(t, "multipart")
+
+	text, ok := msg.PlainText()
+	if !ok {
+		t.Error("missing text/plain body")
+	}
+	testStringEquals(t, "Plain text", text, "Cat! 🐱😀\r\n\r\n[image: Inline image 1]\r\n")
+
+	html, ok := msg.HTML()
+	if !ok {
+		t.Error("missing text/html body")
+	}
+	testStringEquals(t, "HTML", html, "<div dir=\"ltr\">Cat!\u00a0🐱😀<div><br></div><div><img src=\"cid:ii_150b178a80ecad03\" alt=\"Inline image 1\" style=\"margin-right: 0px;\"><br clear=\"all\"><div><br></div>\r\n</div></div>\r\n")
+
+	msg = loadFixture(t, "plain")
+
+	text, ok = msg.PlainText()
+	if !ok {
+		t.Error("missing text/plain body")
+	}
+	testStringEquals(t, "Plain text", text, "This is a simple text email.\r\n")
+
+	if _, ok = msg.HTML(); ok {
+		t.Error("unexpected text/html body in text/plain message")
+	}
+}
+
+func TestReadMessageFrom(t *testing.T) {
+	body, err := ioutil.ReadFile("fixtures/multipart.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := mail.ReadMessage(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := map[string]io.Reader{
+		"strings.Reader": strings.NewReader(string(body)),
+		"bytes.Buffer":   bytes.NewBuffer(body),
+	}
+	for name, r := range readers {
+		msg, err := mail.ReadMessageFrom(r)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		testStringEquals(t, name+" message", msg.RFC822(false), expected.RFC822(false))
+		testIntegerEquals(t, name+" message size", msg.RFC822Size, expected.RFC822Size)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteTo(t *testing.T) {
+	for _, name := range []string{"plain", "multipart"} {
+		msg := loadFixture(t, name)
+
+		var buf bytes.Buffer
+		n, err := msg.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := msg.RFC822(false)
+		testStringEquals(t, name+" message", buf.String(), expected)
+		testIntegerEquals(t, name+" bytes written", int(n), len(expected))
+
+		if _, err := msg.WriteTo(failingWriter{}); err == nil {
+			t.Errorf("%s: expected an error from a failing writer", name)
+		}
+	}
+}
+
+func TestWriteToDeeplyNested(t *testing.T) {
+	// each level is a multipart containing the level below as message/rfc822
+	s := "Subject: innermost\r\n\r\nhello\r\n"
+	for i := 0; i < 20; i++ {
+		b := fmt.Sprintf("b%d", i)
+		s = "Subject: level " + fmt.Sprint(i) + "\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=" + b + "\r\n" +
+			"\r\n" +
+			"--" + b + "\r\n" +
+			"Content-Type: message/rfc822\r\n" +
+			"\r\n" +
+			s +
+			"--" + b + "--\r\n"
+	}
+
+	start := time.Now()
+	msg, err := mail.ReadMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := msg.RFC822(false)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("parsing and writing 20 levels took %v", d)
+	}
+	if !strings.Contains(out, "Subject: innermost\r\n") ||
+		!strings.Contains(out, "\r\n\r\nhello\r\n") {
+		t.Errorf("innermost message lost:\n%s", out)
+	}
+}
+
+func TestSerialize8Bit(t *testing.T) {
+	b := mail.NewBuilder()
+	b.SetFrom(mail.NewAddress("", "alice", "example.com"))
+	b.SetText("Café closes at five.\n")
+	single, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Attach("notes.txt", "application/octet-stream", []byte("\x00\x01"))
+	multi, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []*mail.Message{single, multi} {
+		qp := m.Serialize(false, false)
+		testStringEquals(t, "default", qp, m.RFC822(false))
+		if !strings.Contains(qp, "Content-Transfer-Encoding: quoted-printable\r\n") ||
+			!strings.Contains(qp, "Caf=C3=A9") {
+			t.Errorf("expected quoted-printable text, got:\n%s", qp)
+		}
+
+		eight := m.Serialize(false, true)
+		if !strings.Contains(eight, "Content-Transfer-Encoding: 8bit\r\n") ||
+			!strings.Contains(eight, "Café closes at five.\r\n") ||
+			strings.Contains(eight, "quoted-printable") {
+			t.Errorf("expected 8bit text, got:\n%s", eight)
+		}
+
+		parsed, err := mail.ReadMessage(eight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, _ := parsed.PlainText()
+		testStringEquals(t, "8bit text", text, "Café closes at five.\r\n")
+	}
+}
+
+func TestHTMLWithBogusMetaCharset(t *testing.T) {
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<html><head><meta http-equiv=\"Content-Type\" content=\"text/html; charset=x-no-such-charset\"></head>\r\n" +
+		"<body>Hello</body></html>\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, ok := msg.HTML()
+	if !ok {
+		t.Fatal("missing text/html body")
+	}
+	if !strings.Contains(html, "<body>Hello</body>") {
+		t.Errorf("unexpected HTML body: %q", html)
+	}
+}
+
+func TestHTMLMetaCharset(t *testing.T) {
+	for _, meta := range []string{"<meta charset=\"windows-1251\">", "<META charset=windows-1251 />"} {
+		msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<html><head>" + meta + "</head>\r\n" +
+			"<body>\xcf\xf0\xe8\xe2\xe5\xf2, \xec\xe8\xf0!</body></html>\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		html, ok := msg.HTML()
+		if !ok {
+			t.Fatal("missing text/html body")
+		}
+		if !strings.Contains(html, "<body>Привет, мир!</body>") {
+			t.Errorf("%s: unexpected HTML body: %q", meta, html)
+		}
+	}
+}
+
+func TestThreadID(t *testing.T) {
+	header := "From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Message-ID: <self@example.com>\r\n"
+	cases := []struct{ fields, id string }{
+		{"References: <root@example.com> <parent@example.com>\r\n" +
+			"In-Reply-To: <parent@example.com>\r\n", "<root@example.com>"},
+		{"In-Reply-To: <parent@example.com>\r\n", "<parent@example.com>"},
+		{"", "<self@example.com>"},
+	}
+	for _, c := range cases {
+		msg, err := mail.ReadMessage(header + c.fields + "\r\nHello\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, "ThreadID", msg.ThreadID(), c.id)
+	}
+}
+
+func TestVerifyContentMD5(t *testing.T) {
+	header := "From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n"
+
+	cases := []struct {
+		fields, body string
+		ok           bool
+		err          bool
+	}{
+		{"Content-MD5: E3XJWovO9NuKew8MMEUE0A==\r\n", "Hello, world\r\n", true, false},
+		{"Content-MD5: E3XJWovO9NuKew8MMEUE0A==\r\n", "Goodbye, world\r\n", false, false},
+		{"Content-Type: application/octet-stream\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"Content-MD5: uV9n9h67A2GWIteY9F/C0w==\r\n", "AAEC\r\n", true, false},
+		{"Content-MD5: not a digest\r\n", "Hello, world\r\n", false, true},
+	}
+	for i, c := range cases {
+		msg, err := mail.ReadMessage(header + c.fields + "\r\n" + c.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := msg.VerifyContentMD5()
+		if ok != c.ok || (err != nil) != c.err {
+			t.Errorf("case %d: expected %v, error %v; got %v, %v", i, c.ok, c.err, ok, err)
+		}
+	}
+
+	msg, err := mail.ReadMessage(header + "\r\nHello, world\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.VerifyContentMD5(); err != mail.ErrNoContentMD5 {
+		t.Errorf("expected ErrNoContentMD5, got %v", err)
+	}
+}
+
+const nestedMultipart = "From: alice@example.com\r\n" +
+	"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+	"Subject: fwd\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9 soft=\r\nbreak\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: bob@example.com\r\n" +
+	"Date: Mon, 02 Nov 2015 09:00:00 -0800\r\n" +
+	"Subject: inner\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"plain\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>html</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+func TestBareLFMultipart(t *testing.T) {
+	crlf, err := mail.ReadMessage(nestedMultipart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, err := mail.ReadMessage(strings.Replace(nestedMultipart, "\r\n", "\n", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIntegerEquals(t, "Number of parts", len(lf.Parts), 3)
+	testIntegerEquals(t, "Number of parts", len(lf.Parts), len(crlf.Parts))
+	text, _ := lf.PlainText()
+	testStringEquals(t, "Text", text, "Café softbreak\r\n")
+	testIntegerEquals(t, "Number of inner parts", len(lf.Parts[2].Parts), 2)
+	testStringEquals(t, "HTML", lf.Parts[2].Parts[1].Text, "<p>html</p>\r\n")
+	testStringEquals(t, "Serialized", lf.RFC822(false), crlf.RFC822(false))
+}
+
+func TestBareCRBoundary(t *testing.T) {
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"hello\r--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"world\r--b--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msg.Parts) != 2 {
+		t.Fatalf("incorrect number of parts: expected 2, got %d", len(msg.Parts))
+	}
+	testStringEquals(t, "Part 1", msg.Parts[0].Text, "hello\r\n")
+	testStringEquals(t, "Part 2", msg.Parts[1].Text, "world\r\n")
+}
+
+func TestNestingLimit(t *testing.T) {
+	var buf strings.Builder
+	buf.WriteString("From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\n", i, i)
+	}
+	buf.WriteString("Content-Type: text/plain\r\n\r\nbottom\r\n")
+	for i := 499; i >= 0; i-- {
+		fmt.Fprintf(&buf, "--b%d--\r\n", i)
+	}
+
+	msg, err := mail.ReadMessage(buf.String())
+	if err != mail.ErrNestingTooDeep {
+		t.Fatalf("expected ErrNestingTooDeep, got %v", err)
+	}
+	depth := 0
+	for p := msg.Part; len(p.Parts) > 0; p = p.Parts[0] {
+		depth++
+	}
+	if depth > mail.DefaultMaxNestingDepth {
+		t.Errorf("parsed %d levels, limit is %d", depth, mail.DefaultMaxNestingDepth)
+	}
+	if !strings.Contains(msg.RFC822(false), "bottom\r\n--b499--") {
+		t.Error("unparsed parts were not kept")
+	}
+
+	msg, err = mail.ReadMessageLimit(buf.String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := msg.PlainText()
+	testStringEquals(t, "Text", text, "bottom\r\n")
+}
+
+func TestMessageGlobal(t *testing.T) {
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: message/global\r\n" +
+		"\r\n" +
+		"From: bob@example.com\r\n" +
+		"Subject: inner\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"plain\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>html</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIntegerEquals(t, "Number of parts", len(msg.Parts), 1)
+	testIntegerEquals(t, "Number of inner parts", len(msg.Parts[0].Parts), 2)
+	testStringEquals(t, "Inner text", msg.Parts[0].Parts[0].Text, "plain\r\n")
+}
+
+func TestDefaultContentType(t *testing.T) {
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"\r\n" +
+		"plain\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+		"\r\n" +
+		"Gr\xfc\xdfe\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--b--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Parts) != 3 {
+		t.Fatalf("incorrect number of parts: expected 3, got %d", len(msg.Parts))
+	}
+
+	tests := []struct{ ct, cs string }{
+		{"text/plain", "us-ascii"},
+		{"text/plain", "iso-8859-1"},
+		{"image/png", ""},
+	}
+	for i, test := range tests {
+		h := msg.Parts[i].Header
+		testStringEquals(t, fmt.Sprintf("Part %d type", i+1), h.ContentTypeString(), test.ct)
+		testStringEquals(t, fmt.Sprintf("Part %d charset", i+1), h.Charset(), test.cs)
+	}
+
+	digest, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: multipart/digest; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"\r\n" +
+		"Subject: first\r\n" +
+		"\r\n" +
+		"one\r\n" +
+		"--b--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Digest part type", digest.Parts[0].Header.ContentTypeString(), "message/rfc822")
+	testStringEquals(t, "Digest part charset", digest.Parts[0].Header.Charset(), "")
+}
+
+func TestInlineDisposition(t *testing.T) {
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd := msg.Header.ContentDisposition()
+	if cd == nil {
+		t.Fatal("inline disposition of an image was removed")
+	}
+	testStringEquals(t, "Disposition", cd.Disposition, "inline")
+
+	msg, err = mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"\r\n" +
+		"text\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ContentDisposition() != nil {
+		t.Error("redundant inline disposition of text was kept")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	msg := loadFixture(t, "multipart")
+
+	var types []string
+	msg.Walk(func(p *mail.Part, depth int) bool {
+		types = append(types, fmt.Sprintf("%d:%s", depth, p.Header.ContentTypeString()))
+		return true
+	})
+	testStringEquals(t, "Walk", strings.Join(types, " "),
+		"0:multipart/related 1:multipart/alternative 2:text/plain 2:text/html 1:image/png")
+
+	n := 0
+	msg.Walk(func(p *mail.Part, depth int) bool {
+		n++
+		return p.Header.ContentTypeString() != "multipart/alternative"
+	})
+	testIntegerEquals(t, "Parts visited outside the alternative", n, 3)
+}
+
+func TestPartOffsets(t *testing.T) {
+	raw, err := ioutil.ReadFile("fixtures/multipart.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(raw)
+	msg, err := mail.ReadMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIntegerEquals(t, "Message header offset", msg.HeaderOffset, 0)
+	testIntegerEquals(t, "Message body end", msg.BodyEnd, len(s))
+
+	text := msg.Parts[0].Parts[0]
+	if !strings.HasPrefix(s[text.HeaderOffset:], "Content-Type: text/plain") {
+		t.Errorf("incorrect text header offset: %q", s[text.HeaderOffset:text.BodyOffset])
+	}
+	testStringEquals(t, "Text body", s[text.BodyOffset:text.BodyEnd],
+		"Cat! =F0=9F=90=B1=F0=9F=98=80\n\n[image: Inline image 1]\n")
+
+	image := msg.Parts[1]
+	if !strings.HasPrefix(s[image.HeaderOffset:image.BodyOffset], "Content-Type: image/png") ||
+		!strings.HasSuffix(s[image.HeaderOffset:image.BodyOffset], "X-Attachment-Id: ii_150b178a80ecad03\n\n") {
+		t.Errorf("incorrect image header: %q", s[image.HeaderOffset:image.BodyOffset])
+	}
+	body := s[image.BodyOffset:image.BodyEnd]
+	if !strings.HasPrefix(body, "iVBORw0KGgo") || !strings.HasSuffix(body, "SUVORK5CYII=") {
+		t.Errorf("incorrect image body: %q...%q", body[:20], body[len(body)-20:])
+	}
+}
+
+func TestSize(t *testing.T) {
+	msg := loadFixture(t, "multipart")
+
+	// the image is written as base64 in CRLF-terminated lines of 72
+	// characters, while the fixture's lines hold 76 and end with LF
+	raw, err := ioutil.ReadFile("fixtures/multipart.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := msg.Parts[1]
+	b64 := strings.Replace(string(raw[image.BodyOffset:image.BodyEnd]), "\n", "", -1)
+	decoded, encoded, _ := image.Size()
+	testIntegerEquals(t, "Decoded size", decoded, len(b64)/4*3-strings.Count(b64, "="))
+	testIntegerEquals(t, "Encoded size", encoded, len(b64)+2*((len(b64)+71)/72))
+
+	text := msg.Parts[0].Parts[0]
+	decoded, _, lines := text.Size()
+	testIntegerEquals(t, "Decoded text size", decoded, len("Cat! 🐱😀\r\n\r\n[image: Inline image 1]\r\n"))
+	testIntegerEquals(t, "Text lines", lines, 3)
+
+	testIntegerEquals(t, "Message length", msg.Size(), len(msg.RFC822(false)))
+	if msg.Size() == msg.RFC822Size {
+		t.Error("canonical size unexpectedly equals the size of the LF-only input")
+	}
+
+	// measuring a message whose boundary has to be replaced doesn't
+	// replace it
+	msg, err = mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: multipart/mixed; boundary=xyz\r\n" +
+		"\r\n" +
+		"--xyz\r\n" +
+		"\r\n" +
+		"first\r\n" +
+		"--xyz--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Parts[0].Text = "--xyz\r\n"
+	testIntegerEquals(t, "Length with a new boundary", msg.Size(), len(msg.RFC822(false)))
+	testStringEquals(t, "Boundary after Size", msg.Header.ContentType().Parameters[0].Value, "xyz")
+}
+
+func TestWriteDeclaredCharset(t *testing.T) {
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Caf=E9\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the text is written quoted-printable whatever it was parsed as
+	msg.Header.RemoveAllNamed(mail.ContentTransferEncodingFieldName)
+	msg.Header.Add(mail.ContentTransferEncodingFieldName, "quoted-printable")
+
+	msg.Text = "Grüße aus Köln\r\n"
+	s := msg.RFC822(true)
+	if !strings.Contains(s, "Content-Type: text/plain; charset=iso-8859-1\r\n") ||
+		!strings.HasSuffix(s, "\r\n\r\nGr=FC=DFe aus K=F6ln\r\n") {
+		t.Errorf("Latin-1 text not written as Latin-1:\n%s", s)
+	}
+
+	// ISO-8859-1 has no smiley, so this has to be sent as UTF-8
+	msg.Text = "Grüße ☺\r\n"
+	s = msg.RFC822(true)
+	if !strings.Contains(s, "Content-Type: text/plain; charset=utf-8\r\n") ||
+		!strings.HasSuffix(s, "\r\n\r\nGr=C3=BC=C3=9Fe =E2=98=BA\r\n") {
+		t.Errorf("text not relabelled as UTF-8:\n%s", s)
+	}
+}
+
+func TestChangedTransferEncoding(t *testing.T) {
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"Gr\xc3\xbc\xc3\x9fe\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the body is written quoted-printable, and the field has to say so
+	s := msg.RFC822(false)
+	if !strings.Contains(s, "Content-Transfer-Encoding: quoted-printable\r\n") ||
+		!strings.HasSuffix(s, "\r\n\r\nGr=C3=BC=C3=9Fe\r\n") {
+		t.Errorf("incorrect Content-Transfer-Encoding:\n%s", s)
+	}
+}
+
+func TestBodyCharsets(t *testing.T) {
+	header := "From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"MIME-Version: 1.0\r\n"
+	tests := []struct {
+		body, text string
+	}{
+		{"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"Gr\xfc\xdfe aus K\xf6ln\r\n",
+			"Grüße aus Köln\r\n"},
+		{"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Gr=FC=DFe aus K=F6ln\r\n",
+			"Grüße aus Köln\r\n"},
+		// unlabelled, so the charset has to be guessed
+		{"\r\n" +
+			"Gr\xfc\xdfe aus K\xf6ln\r\n",
+			"Grüße aus Köln\r\n"},
+		{"\r\n" +
+			"Gr\xc3\xbc\xc3\x9fe aus K\xc3\xb6ln\r\n",
+			"Grüße aus Köln\r\n"},
+		{"\r\n" +
+			"Hello\r\n",
+			"Hello\r\n"},
+	}
+
+	for _, test := range tests {
+		msg, err := mail.ReadMessage(header + test.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, "Text", msg.Text, test.text)
+	}
+}
+
+func TestLatin1RoundTrip(t *testing.T) {
+	header := "From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"MIME-Version: 1.0\r\n"
+	bodies := []string{
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"Gr\xfc\xdfe aus K\xf6ln\r\n",
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Gr=FC=DFe aus K=F6ln\r\n",
+		// unlabelled, so the charset has to be guessed
+		"\r\n" +
+			"Gr\xfc\xdfe aus K\xf6ln\r\n",
+	}
+
+	for _, body := range bodies {
+		msg, err := mail.ReadMessage(header + body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, "Text", msg.Text, "Grüße aus Köln\r\n")
+
+		s := msg.RFC822(true)
+		if !strings.Contains(s, "Content-Type: text/plain; charset=iso-8859-1\r\n") ||
+			!strings.HasSuffix(s, "\r\n\r\nGr=FC=DFe aus K=F6ln\r\n") {
+			t.Errorf("Latin-1 text not written as Latin-1:\n%s", s)
+		}
+
+		reparsed, err := mail.ReadMessage(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStringEquals(t, "Reparsed text", reparsed.Text, msg.Text)
+
+		// without avoidUTF8, the text is written as UTF-8 and labelled so
+		s = msg.RFC822(false)
+		if !strings.Contains(s, "Content-Type: text/plain; charset=utf-8\r\n") ||
+			!strings.HasSuffix(s, "\r\n\r\nGr=C3=BC=C3=9Fe aus K=C3=B6ln\r\n") {
+			t.Errorf("text not written as UTF-8:\n%s", s)
+		}
+		testStringEquals(t, "Charset after RFC822", msg.Header.Charset(), "iso-8859-1")
+
+		// ISO-8859-1 has no smiley, so this has to be sent as UTF-8
+		msg.Text = "Grüße ☺\r\n"
+		s = msg.RFC822(true)
+		if !strings.Contains(s, "Content-Type: text/plain; charset=utf-8\r\n") ||
+			!strings.HasSuffix(s, "\r\n\r\nGr=C3=BC=C3=9Fe =E2=98=BA\r\n") {
+			t.Errorf("text not relabelled as UTF-8:\n%s", s)
+		}
+	}
+}
+
+func TestNeedsSMTPUTF8(t *testing.T) {
+	tests := []struct {
+		header string
+		needs  bool
+	}{
+		{"From: Alice <alice@example.com>\r\nTo: bob@example.org\r\n", false},
+		// display-names and IDNA domains can be encoded as ASCII
+		{"From: Jürgen <juergen@example.com>\r\nTo: user@münchen.example\r\n", false},
+		{"From: alice@example.com\r\nTo: jürgen@example.org\r\n", true},
+		{"From: alice@example.com\r\nCc: bob@example.org, δοκιμή@example.org\r\n", true},
+	}
+	for _, test := range tests {
+		msg, err := mail.ReadMessage(test.header +
+			"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+			"\r\n" +
+			"Hello\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.NeedsSMTPUTF8() != test.needs {
+			t.Errorf("NeedsSMTPUTF8 for %q: expected %v", test.header, test.needs)
+		}
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	s := "From: Jürgen <jürgen@example.com>\r\n" +
+		"To: Alice <alice@münchen.example>\r\n" +
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?= aus =?iso-8859-1?q?Berlin?=\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"Schöne Grüße ☺\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: binary\r\n" +
+		"\r\n" +
+		"\x00\x01\xfe\xff\r\n" +
+		"--b--\r\n"
+	msg, err := mail.ReadMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// text that's been changed since parsing has to be encoded too
+	msg.Parts[0].Text = "Tschüß ☺\r\n"
+
+	d, err := msg.Downgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := msg.RFC822(false)
+	if _, err := msg.Downgrade(); err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "original after Downgrade", msg.RFC822(false), before)
+	// the copy stays 7-bit however it's written
+	var buf bytes.Buffer
+	if _, err := d.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	outputs := []string{d.RFC822(true), d.RFC822(false), buf.String(),
+		d.Serialize(false, true), d.SerializeBody(false, true)}
+	for _, out := range outputs {
+		for i := 0; i < len(out); i++ {
+			if out[i] >= 128 {
+				t.Fatalf("8-bit data at offset %d of downgraded message:\n%s", i, out)
+			}
+		}
+	}
+
+	testStringEquals(t, "Subject", d.Header.Subject(), "Grüße aus Berlin")
+	testStringEquals(t, "From", d.Header.Addresses("From")[0].String(), "this-address@needs-unicode.invalid")
+	testStringEquals(t, "To", d.Header.Addresses("To")[0].String(), "Alice <alice@xn--mnchen-3ya.example>")
+	testStringEquals(t, "Text", d.Parts[0].Text, "Tschüß ☺\r\n")
+	testStringEquals(t, "Data", d.Parts[1].Data, msg.Parts[1].Data)
+
+	if !strings.Contains(msg.RFC822(false), "jürgen@example.com") {
+		t.Error("the original message was modified")
+	}
+}
+
+func TestDowngradeKeepsBoundary(t *testing.T) {
+	// the punycode form of the domain contains the boundary
+	msg, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=mnchen-3ya\r\n" +
+		"\r\n" +
+		"--mnchen-3ya\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"From: bob@example.com\r\n" +
+		"To: alice@münchen.example\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"hello\r\n" +
+		"--mnchen-3ya--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := msg.RFC822(false)
+	if _, err := msg.Downgrade(); err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "original after Downgrade", msg.RFC822(false), before)
+}
+
+func BenchmarkParseLargeAttachment(b *testing.B) {
+	data := make([]byte, 10*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	s := "From: alice@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attachment.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		mail.EncodeBase64(data, 76) +
+		"--b--\r\n"
+
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, err := mail.ReadMessage(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(msg.Parts[1].Data) != len(data) {
+			b.Fatalf("incorrect data length %d", len(msg.Parts[1].Data))
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	attachment := func() *mail.Part {
+		h, err := mail.ReadHeader("Content-Type: application/octet-stream\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"\r\n", mail.MIMEHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &mail.Part{Header: h, Data: "\x00\x01\x02 attached"}
+	}
+
+	// a single-part message becomes a multipart/mixed
+	msg := loadFixture(t, "plain")
+	text := msg.Text
+	msg.Parts = append(msg.Parts, attachment())
+	msg.Flatten()
+
+	reparsed, err := mail.ReadMessage(msg.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Content-Type", reparsed.Header.ContentTypeString(), "multipart/mixed")
+	testStringEquals(t, "Subject", reparsed.Header.Subject(), "Text Email")
+	testIntegerEquals(t, "Number of parts", len(reparsed.Parts), 2)
+	testStringEquals(t, "Body", reparsed.Parts[0].Text, text)
+	testStringEquals(t, "Attachment", reparsed.Parts[1].Data, "\x00\x01\x02 attached")
+	for i, p := range reparsed.Parts {
+		testIntegerEquals(t, "Number", p.Number, i+1)
+	}
+
+	// a multipart message keeps its structure and gains a part
+	msg = loadFixture(t, "multipart")
+	n := len(msg.Parts)
+	msg.Parts = append(msg.Parts, attachment())
+	msg.Flatten()
+	testIntegerEquals(t, "Number of the new part", msg.Parts[n].Number, n+1)
+
+	reparsed, err = mail.ReadMessage(msg.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Content-Type", reparsed.Header.ContentTypeString(), "multipart/related")
+	testIntegerEquals(t, "Number of parts", len(reparsed.Parts), n+1)
+	testStringEquals(t, "Attachment", reparsed.Parts[n].Data, "\x00\x01\x02 attached")
+
+	// parts built without a header get a default one
+	msg = loadFixture(t, "multipart")
+	msg.Parts = append(msg.Parts, &mail.Part{Text: "x"},
+		&mail.Part{Text: "Grüße\r\n"}, &mail.Part{Data: "\x00\xff"})
+	msg.Flatten()
+
+	reparsed, err = mail.ReadMessage(msg.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIntegerEquals(t, "Number of parts", len(reparsed.Parts), n+3)
+	testStringEquals(t, "Text", reparsed.Parts[n].Text, "x\r\n")
+	testStringEquals(t, "Content-Type", reparsed.Parts[n+1].Header.ContentTypeString(), "text/plain")
+	testStringEquals(t, "Unicode text", reparsed.Parts[n+1].Text, "Grüße\r\n")
+	testStringEquals(t, "Data", reparsed.Parts[n+2].Data, "\x00\xff")
+
+	// a message built by hand needn't have a header
+	msg = mail.NewMessage()
+	msg.Parts = append(msg.Parts, attachment(), attachment())
+	msg.Flatten()
+	testIntegerEquals(t, "Number of the second part", msg.Parts[1].Number, 2)
+
+	reparsed, err = mail.ReadMessage(msg.RFC822(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Content-Type", reparsed.Header.ContentTypeString(), "multipart/mixed")
+	testIntegerEquals(t, "Number of parts", len(reparsed.Parts), 2)
+	for i, p := range reparsed.Parts {
+		testStringEquals(t, "Attachment", p.Data, "\x00\x01\x02 attached")
+		testIntegerEquals(t, "Number", p.Number, i+1)
+	}
+}
+
+func TestReadMessageStrict(t *testing.T) {
+	s := "To: alice@example.com\r\n" +
+		"Subject: No sender\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"\r\n" +
+		"Who sent this?\r\n"
+
+	repaired, err := mail.ReadMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !repaired.Header.Valid() {
+		t.Error("repaired header is invalid")
+	}
+	if repaired.Header.Get(mail.FromFieldName) == "" {
+		t.Error("repaired message has no From field")
+	}
+
+	strict, err := mail.ReadMessageStrict(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strict.Header.Valid() {
+		t.Error("strictly parsed header without From is valid")
+	}
+	testStringEquals(t, "From", strict.Header.Get(mail.FromFieldName), "")
+	testIntegerEquals(t, "Fields", len(strict.Header.Fields), 3)
+	testStringEquals(t, "Subject", strict.Header.Subject(), "No sender")
+	testStringEquals(t, "Text", strict.Text, "Who sent this?\r\n")
+}
+
+// FuzzReadMessage checks that no input makes the parser panic or hang. What
+// it makes of garbage doesn't matter, only that it survives it and can write
+// the result out again.
+func FuzzReadMessage(f *testing.F) {
+	fixtures, err := filepath.Glob("fixtures/*.eml")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range fixtures {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(b))
+	}
+	// inputs that once caused panics
+	f.Add("0000000000000000000000000:")
+	f.Add("0:0\nFrom:>\nMessAge-Id:0")
+	f.Add("Content-TYpe:multipArt\n--0")
+	f.Add("Content-TrAnsfer-EnCoding:00")
+	f.Add("Content-TYpe:teXt/html")
+	f.Add("Content-Type: message/rfc822\r\n\r\n" +
+		"Content-Type: text/plain; " + strings.Repeat("n", 71) + "=abcdefghij\r\n\r\nbody\r\n")
+	f.Add("Content-Type: text/plain; name*-1=foo\r\n\r\nbody\r\n")
+	f.Add("Content-Type: text/plain; name*9999999999999=x\r\n\r\nbody\r\n")
+	f.Add("Content-Type: multipart/mixed \"\xda\xda\xda\xda\xda\xda\xda\xda\" boundary\r\n\r\n")
+	f.Add("Content-TYpe:multipArt/000000000000 Bou Boun\xb3\xb3\xb3\xb3dArY=001a113cf310b9e6f 0523353f0f\t--001a11\x10\x00f310b9e6fa05233\x1f3f0f\nContent-TYpe:teXt\x00\x000000 000000000\x10000000000000000000 \nContent-TYpe:00\x8c")
+	f.Add("From: \"=?utf-8?q?=\" <alice@example.com>\r\n\r\n")
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, read := range []func(string) (*mail.Message, error){
+			mail.ReadMessage, mail.ReadMessageStrict,
+		} {
+			m, err := read(s)
+			if err != nil || m == nil {
+				continue
+			}
+			_ = m.RFC822(false)
+			_ = m.RFC822(true)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// The fields whose addresses are converted to and from net/mail.Address.
+var netMailAddressFields = map[string]bool{
+	FromFieldName:         true,
+	SenderFieldName:       true,
+	ReplyToFieldName:      true,
+	ToFieldName:           true,
+	CcFieldName:           true,
+	BccFieldName:          true,
+	ResentFromFieldName:   true,
+	ResentSenderFieldName: true,
+	ResentToFieldName:     true,
+	ResentCcFieldName:     true,
+	ResentBccFieldName:    true,
+}
+
+// Returns this message as a net/mail.Message, for use with the standard
+// library. Header field values are unfolded, and the body is the same as
+// Body(false).
+//
+// The conversion is lossy: net/mail.Header does not preserve the order of
+// fields, and address groups are flattened to their members.
+func (m *Message) ToNetMail() *netmail.Message {
+	// the Content-Type has to name the charset and boundary the body uses
+	pw := newPartWriter(false, false)
+	var body strings.Builder
+	pw.writeBody(&body, m)
+	ct := pw.messageContentType(m)
+
+	h := make(netmail.Header)
+	for _, f := range m.Header.Fields {
+		if _, ok := f.(*ContentType); ok && ct != nil {
+			f = ct
+		}
+		key := textproto.CanonicalMIMEHeaderKey(f.Name())
+		var v string
+		if af, ok := f.(*AddressField); ok && netMailAddressFields[f.Name()] {
+			v = toNetMailAddressList(af.Addresses)
+		} else {
+			v = strings.Replace(f.rfc822(false), crlf, "", -1)
+		}
+		h[key] = append(h[key], v)
+	}
+	return &netmail.Message{Header: h, Body: strings.NewReader(body.String())}
+}
+
+// Returns \a addrs as a list suitable for net/mail.Header.AddressList().
+func toNetMailAddressList(addrs Addresses) string {
+	l := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if a.t == NormalAddressType {
+			na := netmail.Address{Name: a.name, Address: a.Localpart + "@" + a.Domain}
+			l = append(l, na.String())
+		} else {
+			l = append(l, a.toString(false))
+		}
+	}
+	return strings.Join(l, ", ")
+}
+
+// Reads the entire body of \a nm and parses it, along with its header, into a
+// new Message. Address fields that net/mail can parse are converted through
+// net/mail.Address; all other fields are parsed from their text.
+//
+// Since the message is parsed like any other, the same repairs are made as
+// by ReadMessage(), and they can't be undone. Fields appear in alphabetical
+// order, since net/mail.Header doesn't record the original order.
+func FromNetMail(nm *netmail.Message) (*Message, error) {
+	body, err := ioutil.ReadAll(nm.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(nm.Header))
+	for k := range nm.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		values := nm.Header[k]
+		if netMailAddressFields[headerCase(k)] {
+			converted := make([]string, len(values))
+			for i, v := range values {
+				converted[i] = v
+				if l, err := netmail.ParseAddressList(v); err == nil {
+					converted[i] = fromNetMailAddressList(l)
+				}
+			}
+			values = converted
+		}
+		for _, v := range values {
+			buf.WriteString(k)
+			buf.WriteString(": ")
+			buf.WriteString(v)
+			buf.WriteString(crlf)
+		}
+	}
+	buf.WriteString(crlf)
+	buf.Write(body)
+
+	return ReadMessage(buf.String())
+}
+
+// Returns \a l as the text of an address field, with any non-ASCII
+// display-names encoded. Localparts and domains are kept as they are, even
+// if they aren't ASCII.
+func fromNetMailAddressList(l []*netmail.Address) string {
+	s := make([]string, 0, len(l))
+	for _, na := range l {
+		lp := na.Address
+		domain := ""
+		if i := strings.LastIndexByte(na.Address, '@'); i >= 0 {
+			lp = na.Address[:i]
+			domain = na.Address[i+1:]
+		}
+		a := NewAddress(na.Name, lp, domain)
+		if a.name == "" {
+			s = append(s, a.lpdomain())
+		} else {
+			s = append(s, a.Name(true)+" <"+a.lpdomain()+">")
+		}
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,127 @@
+package mail_test
+
+import (
+	"io/ioutil"
+	netmail "net/mail"
+	"strings"
+	"testing"
+
+	"github.com/paulrosania/go-mail"
+)
+
+const netMailMessage = "From: Alice Example <alice@example.com>\r\n" +
+	"To: bob@example.com, \"Carol C.\" <carol@example.org>\r\n" +
+	"Subject: Lunch on Friday\r\n" +
+	"Date: Mon, 02 Nov 2015 10:00:00 -0800\r\n" +
+	"Message-ID: <lunch.1@example.com>\r\n" +
+	"\r\n" +
+	"Shall we try the new place?\r\n"
+
+func TestToNetMail(t *testing.T) {
+	m, err := mail.ReadMessage(netMailMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nm := m.ToNetMail()
+	testStringEquals(t, "Subject", nm.Header.Get("Subject"), "Lunch on Friday")
+	testStringEquals(t, "Message-Id", nm.Header.Get("Message-Id"), "<lunch.1@example.com>")
+
+	from, err := nm.Header.AddressList("From")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIntegerEquals(t, "From count", len(from), 1)
+	testStringEquals(t, "From name", from[0].Name, "Alice Example")
+	testStringEquals(t, "From address", from[0].Address, "alice@example.com")
+
+	to, err := nm.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIntegerEquals(t, "To count", len(to), 2)
+	testStringEquals(t, "To[1] name", to[1].Name, "Carol C.")
+	testStringEquals(t, "To[1] address", to[1].Address, "carol@example.org")
+
+	date, err := nm.Header.Date()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIntegerEquals(t, "Date", int(date.Unix()), 1446487200)
+
+	body, err := ioutil.ReadAll(nm.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Body", string(body), "Shall we try the new place?\r\n")
+}
+
+func TestFromNetMail(t *testing.T) {
+	nm, err := netmail.ReadMessage(strings.NewReader(netMailMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.FromNetMail(nm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "From", m.Header.Get("From"), "Alice Example <alice@example.com>")
+	testStringEquals(t, "To", m.Header.Get("To"), "bob@example.com, \"Carol C.\" <carol@example.org>")
+	testStringEquals(t, "Subject", m.Header.Subject(), "Lunch on Friday")
+	testStringEquals(t, "Message-ID", m.Header.MessageID(), "<lunch.1@example.com>")
+	text, _ := m.PlainText()
+	testStringEquals(t, "Text", text, "Shall we try the new place?\r\n")
+
+	// and back again
+	to, err := m.ToNetMail().Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIntegerEquals(t, "To count", len(to), 2)
+	testStringEquals(t, "To[0] address", to[0].Address, "bob@example.com")
+}
+
+func TestFromNetMailRepeatedFields(t *testing.T) {
+	nm, err := netmail.ReadMessage(strings.NewReader("From: =?utf-8?q?J=C3=BCrgen?= <juergen@example.com>\r\n" +
+		"Sender: jürgen@example.com\r\n" +
+		"To: bob@example.com\r\n" +
+		"To: \"Carol C.\" <carol@example.org>\r\n" +
+		"Subject: Lunch\r\n" +
+		"\r\n" +
+		"Shall we?\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.FromNetMail(nm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := m.Header.Addresses("To")
+	testIntegerEquals(t, "To count", len(to), 2)
+	testStringEquals(t, "To[1]", to[1].String(), "\"Carol C.\" <carol@example.org>")
+	testStringEquals(t, "From", m.Header.Addresses("From")[0].String(), "Jürgen <juergen@example.com>")
+	// a localpart that isn't ASCII is kept, not replaced by a placeholder
+	testStringEquals(t, "Sender", m.Header.Addresses("Sender")[0].String(), "jürgen@example.com")
+}
+
+func TestToNetMailSettlesCharset(t *testing.T) {
+	m, err := mail.ReadMessage("From: alice@example.com\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Gr=FC=DFe aus K=F6ln\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Text = "Köln ☺\r\n"
+
+	nm := m.ToNetMail()
+	testStringEquals(t, "Content-Type", nm.Header.Get("Content-Type"), "text/plain; charset=utf-8")
+	body, err := ioutil.ReadAll(nm.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStringEquals(t, "Body", string(body), "K=C3=B6ln =E2=98=BA\r\n")
+}
@@ -14,32 +14,31 @@ import (
 type parserState struct {
 	at  int
 	err error
-
-	next *parserState
-	mark int
-}
-
-func newParserState(other *parserState) *parserState {
-	ps := &parserState{mark: 1}
-	if other != nil {
-		ps.at = other.at
-		ps.next = other
-		ps.mark = other.mark + 1
-	}
-	return ps
 }
 
 type parser struct {
-	*parserState
+	parserState
 	str string
 
+	// the states saved by mark(), innermost last
+	marks []parserState
+
 	mime bool
 	lc   string
+
+	// true if Text() should accept raw UTF-8 (RFC 6532)
+	utf8 bool
 }
 
 func newParser(s string) *parser {
-	st := newParserState(nil)
-	return &parser{str: s, parserState: st}
+	return &parser{str: s}
+}
+
+// Makes this parser start over on \a s, as if it had just been created by
+// newParser(), except that memory used for marks is kept. This saves
+// allocations when many short strings are parsed in turn.
+func (p *parser) reset(s string) {
+	*p = parser{str: s, marks: p.marks[:0]}
 }
 
 // Returns true if \a c belongs to the RFC 2822 'atext' production, and false
@@ -231,6 +230,8 @@ const (
 	EncodedPhrase
 )
 
+// A Content-Transfer-Encoding. BinaryEncoding covers 7bit, 8bit and binary,
+// all of which mean that the data isn't encoded.
 type EncodingType int
 
 const (
@@ -240,6 +241,41 @@ const (
 	BinaryEncoding
 )
 
+// Returns the name used for \a e in the Content-Transfer-Encoding field, e.g.
+// "quoted-printable". BinaryEncoding is called "7bit".
+func (e EncodingType) String() string {
+	switch e {
+	case QPEncoding:
+		return "quoted-printable"
+	case Base64Encoding:
+		return "base64"
+	case UuencodeEncoding:
+		return "x-uuencode"
+	case BinaryEncoding:
+		return "7bit"
+	}
+	return fmt.Sprintf("EncodingType(%d)", int(e))
+}
+
+// Returns the encoding named by the Content-Transfer-Encoding value \a s,
+// which is case-insensitive, or an error if \a s isn't a known encoding.
+// "7bit", "8bit", "binary" and the like all result in BinaryEncoding.
+func ParseEncoding(s string) (EncodingType, error) {
+	t := strings.ToLower(s)
+	if t == "7bit" || t == "8bit" || t == "8bits" || t == "binary" || t == "unknown" {
+		return BinaryEncoding, nil
+	} else if t == "quoted-printable" {
+		return QPEncoding, nil
+	} else if t == "base64" {
+		return Base64Encoding, nil
+	} else if t == "x-uuencode" || t == "uuencode" {
+		return UuencodeEncoding, nil
+	} else if strings.Contains(t, "bit") && t != "" && t[0] >= '0' && t[0] <= '9' {
+		return BinaryEncoding, nil
+	}
+	return BinaryEncoding, fmt.Errorf("Invalid c-t-e value: %q", s)
+}
+
 // Steps past a MIME encoded-word (as defined in RFC 2047) and returns its
 // decoded unicode representation, or an empty string if the cursor does not
 // point to a valid encoded-word. The caller is responsible for checking that
@@ -325,7 +361,8 @@ func (p *parser) encodedWord(t EncodedTextType) string {
 
 	text := buf.String()
 	if encoding == QPEncoding {
-		text = deQP(text, false)
+		// RFC 2047 section 4.2: "_" represents a space
+		text = deQP(text, true)
 	} else {
 		text = de64(text)
 	}
@@ -417,7 +454,7 @@ func (p *parser) Text() string {
 		if !encodedWord {
 			var buf bytes.Buffer
 			c := p.NextChar()
-			for !p.AtEnd() && c < 128 && c != ' ' && c != 9 && c != 10 && c != 13 {
+			for !p.AtEnd() && (c < 128 || p.utf8) && c != ' ' && c != 9 && c != 10 && c != 13 {
 				buf.WriteByte(c)
 				p.Step(1)
 				c = p.NextChar()
@@ -596,19 +633,17 @@ func (p *parser) AtEnd() bool {
 // an identifier of the current mark. The companion function restore() restores
 // the last or a specified mark. The returned mark is never 0.
 func (p *parser) mark() int {
-	p.parserState = newParserState(p.parserState)
-	return p.next.mark
+	p.marks = append(p.marks, p.parserState)
+	p.err = nil
+	return len(p.marks)
 }
 
 // Restores the last mark()ed cursor position and error state of this parser
-// object.
+// object. Marks made after \a m are forgotten.
 func (p *parser) restore(m int) {
-	c := p.parserState
-	for c != nil && c.mark != m && c.next != nil {
-		c = c.next
-	}
-	if c != nil && c.mark == m {
-		p.parserState = c
+	if m > 0 && m <= len(p.marks) {
+		p.parserState = p.marks[m-1]
+		p.marks = p.marks[:m-1]
 	}
 }
 
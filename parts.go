@@ -2,7 +2,11 @@ package mail
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"strings"
 
 	"github.com/paulrosania/go-charset/charset"
@@ -20,38 +24,263 @@ type Part struct {
 	Text    string `json:"text,omitempty"`
 	Data    string `json:"data,omitempty"`
 
+	// The byte offsets of this part's header, of its body, and of the end
+	// of its body, in the text it was parsed from. The body is the text
+	// following the blank line that ends the header, and doesn't include
+	// the line break preceding a multipart boundary. All three are zero
+	// for parts that weren't parsed.
+	HeaderOffset int `json:"-"`
+	BodyOffset   int `json:"-"`
+	BodyEnd      int `json:"-"`
+
 	numBytes        int
 	numEncodedBytes int
 	numEncodedLines int
 
-	err error
+	maxDepth int
+	strict   bool
+	err      error
+}
+
+// A partWriter writes messages and MIME entities as text. The Content-Type
+// fields it writes may differ from those in the parts' headers: A multipart
+// entity whose boundary is missing or occurs within the entity is written
+// with a new boundary, and a text part may be written in another charset than
+// the one it names (see charset()). The parts themselves are not changed.
+type partWriter struct {
+	avoidUTF8 bool
+	allow8bit bool
+
+	// the boundary chosen for each multipart Content-Type field
+	boundaries map[*ContentType]string
+}
+
+// Returns a partWriter that writes text the way Message.Serialize(\a
+// avoidUTF8, \a allow8bit) does.
+func newPartWriter(avoidUTF8, allow8bit bool) *partWriter {
+	return &partWriter{
+		avoidUTF8:  avoidUTF8,
+		allow8bit:  allow8bit,
+		boundaries: make(map[*ContentType]string),
+	}
+}
+
+// Writes the header and body of the message \a m to \a w.
+func (pw *partWriter) writeMessage(w io.Writer, m *Message) {
+	eightBit := false
+	if bp := m.singlePart(); bp != nil {
+		eightBit = bp.sendAs8Bit(pw.allow8bit)
+	}
+	io.WriteString(w, m.Header.asText(pw.avoidUTF8, eightBit, pw.messageContentType(m)))
+	io.WriteString(w, crlf)
+	pw.writeBody(w, m)
+}
+
+// Writes the body of the message \a m to \a w.
+func (pw *partWriter) writeBody(w io.Writer, m *Message) {
+	ct := m.Header.ContentType()
+	if bp := m.singlePart(); bp != nil {
+		pw.appendAnyPart(w, bp, ct)
+	} else {
+		pw.appendMultipart(w, m.Part)
+	}
 }
 
-// Appends the text of this multipart MIME entity to the buffer \a buf.
-func (p *Part) appendMultipart(buf *bytes.Buffer, avoidUTF8 bool) {
+// Returns the Content-Type field to write in the header of the message \a m.
+func (pw *partWriter) messageContentType(m *Message) *ContentType {
+	if bp := m.singlePart(); bp != nil {
+		return pw.contentType(bp)
+	}
+	return pw.contentType(m.Part)
+}
+
+// Returns the Content-Type field to write in the header of \a p. That's p's
+// own, or a copy of it if p is a multipart that needs a new boundary or a
+// text part whose text is written in another charset.
+func (pw *partWriter) contentType(p *Part) *ContentType {
+	if p.Header == nil {
+		return nil
+	}
 	ct := p.Header.ContentType()
+	if ct == nil {
+		return nil
+	}
+	n, v := "", ""
+	switch ct.Type {
+	case "multipart":
+		n, v = "boundary", pw.boundary(p)
+		if v == ct.parameter(n) {
+			return ct
+		}
+	case "text":
+		n, v = "charset", pw.charset(p)
+		if v == p.Header.Charset() {
+			return ct
+		}
+	default:
+		return ct
+	}
+	c := *ct
+	c.Parameters = append([]MIMEParameter(nil), ct.Parameters...)
+	c.addParameter(n, v)
+	return &c
+}
+
+// Returns the charset in which to write the text of \a bp. If avoidUTF8 is
+// true, that's the charset its Content-Type names, provided that charset can
+// represent the text, so that e.g. ISO-8859-1 text is written as ISO-8859-1.
+// Otherwise the text is written as UTF-8, which needs a new label unless the
+// text is all ASCII. Charsets we don't know are left alone, since we can't
+// have converted from them.
+func (pw *partWriter) charset(bp *Part) string {
+	cs := bp.Header.Charset()
+	if cs == "utf-8" || charset.Info(cs) == nil {
+		return cs
+	}
+	if pw.avoidUTF8 {
+		if _, ok := toCharset(bp.Text, cs); ok {
+			return cs
+		}
+	} else if isAscii(bp.Text) {
+		return cs
+	}
+	return "utf-8"
+}
+
+// Returns the boundary to write for the multipart entity \a p: the one its
+// Content-Type names, unless that is empty or occurs within one of p's
+// children, in which case a new one is chosen with GenerateBoundary().
+//
+// The children are written to a substringWriter to find out, so their text
+// isn't kept, and the choice is remembered, so that deeply nested entities
+// don't cost time exponential in their depth.
+func (pw *partWriter) boundary(p *Part) string {
+	ct := p.Header.ContentType()
+	if delim, ok := pw.boundaries[ct]; ok {
+		return delim
+	}
+
 	delim := ct.parameter("boundary")
-	buf.WriteString("--" + delim)
+	for delim == "" || pw.childrenContain(p, "--"+delim) {
+		delim = GenerateBoundary()
+	}
+	pw.boundaries[ct] = delim
+	return delim
+}
+
+// Returns true if \a s occurs within the text of any of the children of the
+// multipart entity \a p.
+func (pw *partWriter) childrenContain(p *Part, s string) bool {
+	ct := p.Header.ContentType()
+	sw := &substringWriter{s: s}
 	for _, c := range p.Parts {
-		buf.WriteString(crlf)
+		pw.appendChild(sw, c, ct)
+		if sw.found {
+			return true
+		}
+	}
+	return false
+}
+
+// A substringWriter looks for s in the text written to it, without keeping
+// more of that text than a match could span.
+type substringWriter struct {
+	s     string
+	found bool
 
-		buf.WriteString(c.Header.AsText(avoidUTF8))
-		buf.WriteString(crlf)
-		p.appendAnyPart(buf, c, ct, avoidUTF8)
+	// the last len(s)-1 bytes written, which may begin a match
+	tail []byte
+}
 
-		buf.WriteString(crlf)
-		buf.WriteString("--")
-		buf.WriteString(delim)
+func (sw *substringWriter) Write(b []byte) (int, error) {
+	return sw.WriteString(string(b))
+}
+
+func (sw *substringWriter) WriteString(t string) (int, error) {
+	if sw.found {
+		return len(t), nil
+	}
+	n := len(sw.s) - 1
+	head := t
+	if len(head) > n {
+		head = head[:n]
+	}
+	if strings.Contains(string(sw.tail)+head, sw.s) || strings.Contains(t, sw.s) {
+		sw.found = true
+		return len(t), nil
 	}
-	buf.WriteString("--")
-	buf.WriteString(crlf)
+	if len(t) > n {
+		sw.tail = append(sw.tail[:0], t[len(t)-n:]...)
+	} else {
+		sw.tail = append(sw.tail, t...)
+		if len(sw.tail) > n {
+			sw.tail = append(sw.tail[:0], sw.tail[len(sw.tail)-n:]...)
+		}
+	}
+	return len(t), nil
 }
 
-// This function appends the text of the MIME bodypart \a bp with Content-Type
-// \a ct to the buffer \a buf.
+// Writes the text of the multipart MIME entity \a p to \a w.
+func (pw *partWriter) appendMultipart(w io.Writer, p *Part) {
+	ct := p.Header.ContentType()
+	delim := pw.boundary(p)
+	io.WriteString(w, "--"+delim)
+	for _, c := range p.Parts {
+		io.WriteString(w, crlf)
+		pw.appendChild(w, c, ct)
+		io.WriteString(w, crlf+"--"+delim)
+	}
+	io.WriteString(w, "--"+crlf)
+}
+
+// Writes the header and body of the child \a c, whose parent has the
+// Content-Type \a ct, to \a w.
+func (pw *partWriter) appendChild(w io.Writer, c *Part, ct *ContentType) {
+	io.WriteString(w, c.Header.asText(pw.avoidUTF8, c.sendAs8Bit(pw.allow8bit), pw.contentType(c)))
+	io.WriteString(w, crlf)
+	pw.appendAnyPart(w, c, ct)
+}
+
+// Returns true if \a allow8bit is true and this is a quoted-printable text
+// part that can be sent verbatim using the 8bit Content-Transfer-Encoding
+// instead, i.e. one whose lines are short enough for SMTP and which contains
+// no NULs or bare CRs or LFs.
+func (p *Part) sendAs8Bit(allow8bit bool) bool {
+	if !allow8bit || p.Header == nil {
+		return false
+	}
+	cte := p.Header.ContentTransferEncoding()
+	if cte == nil || cte.Encoding != QPEncoding {
+		return false
+	}
+	ct := p.Header.ContentType()
+	if ct != nil && ct.Type != "text" {
+		return false
+	}
+	return fits8Bit(p.Text)
+}
+
+// Makes sure that the boundary of each multipart entity in this tree occurs
+// nowhere within that entity, choosing new boundaries with GenerateBoundary()
+// where necessary.
+func (p *Part) settleBoundaries() {
+	pw := newPartWriter(false, false)
+	p.Walk(func(part *Part, depth int) bool {
+		if part.Header == nil {
+			return true
+		}
+		if ct := part.Header.ContentType(); ct != nil && ct.Type == "multipart" {
+			ct.addParameter("boundary", pw.boundary(part))
+		}
+		return true
+	})
+}
+
+// This function writes the text of the MIME bodypart \a bp with Content-Type
+// \a ct to \a w.
 //
 // The details of this function are certain to change.
-func (p *Part) appendAnyPart(buf *bytes.Buffer, bp *Part, ct *ContentType, avoidUTF8 bool) {
+func (pw *partWriter) appendAnyPart(w io.Writer, bp *Part, ct *ContentType) {
 	childct := bp.Header.ContentType()
 	e := BinaryEncoding
 	cte := bp.Header.ContentTransferEncoding()
@@ -59,45 +288,290 @@ func (p *Part) appendAnyPart(buf *bytes.Buffer, bp *Part, ct *ContentType, avoid
 		e = cte.Encoding
 	}
 
-	if (childct != nil && childct.Type == "message") ||
+	if bp.err == ErrNestingTooDeep {
+		io.WriteString(w, bp.Data)
+	} else if (childct != nil && childct.Type == "message") ||
 		(ct != nil && ct.Type == "multipart" && ct.Subtype == "digest" && childct == nil) {
-		if childct != nil && childct.Subtype != "rfc822" {
-			p.appendTextPart(buf, bp, childct)
+		if childct != nil && !isMessage(childct) {
+			pw.appendTextPart(w, bp, childct)
+		} else if bp.message != nil {
+			pw.writeMessage(w, bp.message)
 		} else {
-			buf.WriteString(bp.message.RFC822(avoidUTF8))
+			io.WriteString(w, bp.Data)
 		}
 	} else if childct == nil || strings.ToLower(childct.Type) == "text" {
-		p.appendTextPart(buf, bp, childct)
+		if !bp.hasText && bp.Data != "" {
+			// a text part whose contents are bytes, not text, as
+			// with an attachment made by Builder
+			pw.appendData(w, bp, e)
+		} else {
+			pw.appendTextPart(w, bp, childct)
+		}
 	} else if childct.Type == "multipart" {
-		bp.appendMultipart(buf, avoidUTF8)
+		pw.appendMultipart(w, bp)
+	} else {
+		pw.appendData(w, bp, e)
+	}
+}
+
+// Writes the Data of \a bp to \a w, encoded with \a e.
+func (pw *partWriter) appendData(w io.Writer, bp *Part, e EncodingType) {
+	if e == Base64Encoding {
+		bw := NewBase64Encoder(w, 72)
+		io.WriteString(bw, bp.Data)
+		bw.Close()
 	} else {
-		buf.WriteString(encodeCTE(bp.Data, e, 72))
+		io.WriteString(w, encodeCTE(bp.Data, e, 72))
 	}
 }
 
-// This function appends the text of the MIME bodypart \a bp with Content-Type
-// \a ct to the buffer \a buf.
+// This function writes the text of the MIME bodypart \a bp with Content-Type
+// \a ct to \a w. If allow8bit is true, the text may be written verbatim
+// rather than quoted-printable encoded; see sendAs8Bit().
 //
 // The details of this function are certain to change.
-func (p *Part) appendTextPart(buf *bytes.Buffer, bp *Part, ct *ContentType) {
+func (pw *partWriter) appendTextPart(w io.Writer, bp *Part, ct *ContentType) {
 	e := BinaryEncoding
 	cte := bp.Header.ContentTransferEncoding()
-	if cte != nil {
+	if cte != nil && !bp.sendAs8Bit(pw.allow8bit) {
 		e = cte.Encoding
 	}
 
-	var c *charset.Charset
-	if ct != nil && ct.parameter("charset") != "" {
-		c = charset.Info(ct.parameter("charset"))
+	body := bp.Text
+	if cs := pw.charset(bp); pw.avoidUTF8 && cs != "utf-8" {
+		if t, ok := toCharset(body, cs); ok {
+			body = t
+		}
 	}
-	if c == nil {
-		// TODO: infer encoding from text
+
+	io.WriteString(w, encodeCTE(body, e, 72))
+}
+
+// Returns the decoded contents of this Part as a byte slice, with any
+// base-64, quoted-printable or uuencoding removed. This is the same data as
+// Data, and is empty for text parts, whose contents are in Text instead.
+//
+// Each call returns a new copy, which the caller may modify. Callers that
+// only read the data, e.g. to save a large attachment, can avoid the copy by
+// using Data or DecodedReader() instead.
+func (p *Part) DecodedData() []byte {
+	return []byte(p.Data)
+}
+
+// Returns a Reader for the decoded contents of this Part, which are the
+// same as DecodedData()'s, without copying them.
+func (p *Part) DecodedReader() io.Reader {
+	return strings.NewReader(p.Data)
+}
+
+// Returns the size of this Part as recorded when it was parsed: the number of
+// bytes after decoding, the number of bytes once encoded with the part's
+// Content-Transfer-Encoding as it will be written, and the number of lines in
+// the encoded form. The line count is only recorded for text and
+// message/rfc822 parts, as IMAP needs it for those, and is 0 otherwise. All
+// three are 0 for parts that weren't parsed.
+func (p *Part) Size() (decoded, encoded, lines int) {
+	return p.numBytes, p.numEncodedBytes, p.numEncodedLines
+}
+
+// ErrNoContentMD5 is returned by VerifyContentMD5() when there is no
+// Content-MD5 field to verify.
+var ErrNoContentMD5 = errors.New("mail: no Content-MD5 field")
+
+// Checks the Content-MD5 field of this Part (RFC 1864) against its decoded
+// contents. Returns true if the digest matches and false if it doesn't.
+// Returns ErrNoContentMD5 if there is no Content-MD5 field, and another error
+// if the field does not contain a base64-encoded MD5 digest.
+//
+// Text is checked in its declared charset with CRLF line endings, which is
+// what the sender should have digested.
+func (p *Part) VerifyContentMD5() (bool, error) {
+	if p.Header == nil {
+		return false, ErrNoContentMD5
+	}
+	f := p.Header.field(ContentMd5FieldName, 0)
+	if f == nil {
+		return false, ErrNoContentMD5
+	}
+	digest, err := base64.StdEncoding.DecodeString(simplify(f.Value()))
+	if err != nil || len(digest) != md5.Size {
+		return false, fmt.Errorf("Invalid Content-MD5 value: %q", f.Value())
 	}
 
-	// TODO: encode into original charset
-	body := bp.Text
+	data := p.Data
+	if p.hasText {
+		cs := "us-ascii"
+		if ct := p.Header.ContentType(); ct != nil && ct.parameter("charset") != "" {
+			cs = ct.parameter("charset")
+		}
+		text, err := decode(p.Text, cs)
+		if err != nil {
+			text = p.Text
+		}
+		data = text
+	}
+	h := md5.New()
+	io.WriteString(h, data)
+	return bytes.Equal(h.Sum(nil), digest), nil
+}
+
+// Returns the filename of this Part, taken from the Content-Disposition
+// filename parameter or, failing that, the Content-Type name parameter.
+// Encoded-words are decoded. Returns an empty string if neither exists.
+func (p *Part) Filename() string {
+	if p.Header == nil {
+		return ""
+	}
 
-	buf.WriteString(encodeCTE(body, e, 72))
+	fn := ""
+	if cd := p.Header.ContentDisposition(); cd != nil {
+		fn = cd.parameter("filename")
+	}
+	if fn == "" {
+		if ct := p.Header.ContentType(); ct != nil {
+			fn = ct.parameter("name")
+		}
+	}
+
+	if strings.Contains(fn, "=?") {
+		tp := newParser(fn)
+		t := tp.Text()
+		if tp.AtEnd() {
+			fn = t
+		}
+	}
+	return fn
+}
+
+// Returns true if \a ct is message/rfc822 or message/global, ie. if the part
+// it describes contains an encapsulated message.
+func isMessage(ct *ContentType) bool {
+	return ct != nil && ct.Type == "message" &&
+		(ct.Subtype == "rfc822" || ct.Subtype == "global")
+}
+
+// Returns true if this Part is nested so deeply that its contents shouldn't
+// be parsed. The limit is that of the outermost Message; see
+// Message.ParseLimit().
+func (p *Part) tooDeep() bool {
+	depth := 0
+	root := p
+	for root.parent != nil {
+		root = root.parent
+		depth++
+	}
+	return root.maxDepth > 0 && depth >= root.maxDepth
+}
+
+// Returns true if this Part belongs to a message read by
+// ReadMessageStrict(), whose headers must not be repaired. As with
+// tooDeep(), the outermost Message decides.
+func (p *Part) strictParsing() bool {
+	root := p
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root.strict
+}
+
+// Returns true if this Part or any part within it was left unparsed because
+// it is nested too deeply.
+func (p *Part) nestedTooDeep() bool {
+	if p.err == ErrNestingTooDeep {
+		return true
+	}
+	for _, c := range p.Parts {
+		if c.nestedTooDeep() {
+			return true
+		}
+	}
+	return p.message != nil && p.message.Part.nestedTooDeep()
+}
+
+// Returns true if this Part is a leaf whose Content-Disposition is attachment,
+// or which has a filename and isn't a text/plain or text/html body.
+func (p *Part) IsAttachment() bool {
+	if p.Header == nil || len(p.Parts) > 0 {
+		return false
+	}
+
+	ct := p.Header.ContentType()
+	if ct != nil && (ct.Type == "multipart" || isMessage(ct)) {
+		return false
+	}
+
+	cd := p.Header.ContentDisposition()
+	if cd != nil && cd.Disposition == "attachment" {
+		return true
+	}
+
+	if p.Filename() == "" {
+		return false
+	}
+	return ct != nil && !(ct.Type == "text" &&
+		(ct.Subtype == "plain" || ct.Subtype == "html"))
+}
+
+// Calls \a fn for this Part and each Part below it, depth first and in
+// order, with the depth of each relative to this Part, which is 0. Walk
+// descends into multiparts and encapsulated messages. If \a fn returns
+// false, the parts below the one it was called for are skipped.
+func (p *Part) Walk(fn func(part *Part, depth int) bool) {
+	p.walk(fn, 0)
+}
+
+func (p *Part) walk(fn func(part *Part, depth int) bool, depth int) {
+	if !fn(p, depth) {
+		return
+	}
+	for _, c := range p.Parts {
+		c.walk(fn, depth+1)
+	}
+	if len(p.Parts) == 0 && p.message != nil && p.message.Part != nil {
+		p.message.Part.walk(fn, depth+1)
+	}
+}
+
+// Returns the leaf Part in the tree rooted at this Part that holds the
+// text/\a subtype body, or nil if there is none. Attachments and embedded
+// messages are skipped. Within a multipart/alternative the last matching
+// alternative wins, since RFC 2046 orders them by increasing faithfulness.
+func (p *Part) textPart(subtype string) *Part {
+	if p.Header == nil {
+		return nil
+	}
+
+	ct := p.Header.ContentType()
+	if ct != nil && ct.Type == "message" {
+		return nil
+	}
+
+	if len(p.Parts) == 0 {
+		if !p.hasText || p.IsAttachment() {
+			return nil
+		}
+		if (ct == nil && subtype == "plain") ||
+			(ct != nil && ct.Type == "text" && ct.Subtype == subtype) {
+			return p
+		}
+		return nil
+	}
+
+	if ct != nil && ct.Subtype == "alternative" {
+		for i := len(p.Parts) - 1; i >= 0; i-- {
+			if t := p.Parts[i].textPart(subtype); t != nil {
+				return t
+			}
+		}
+		return nil
+	}
+
+	for _, c := range p.Parts {
+		if t := c.textPart(subtype); t != nil {
+			return t
+		}
+	}
+	return nil
 }
 
 // Returns the text representation of this Bodypart.
@@ -124,8 +598,8 @@ func (p *Part) AsText(avoidUTF8 bool) string {
 	}
 
 	if len(p.Parts) > 0 {
-		buf := bytes.NewBuffer(make([]byte, 0))
-		p.appendMultipart(buf, avoidUTF8)
+		var buf strings.Builder
+		newPartWriter(avoidUTF8, false).appendMultipart(&buf, p)
 		r = buf.String()
 	} else if p.Header.ContentType() == nil ||
 		p.Header.ContentType().Type == "text" {
@@ -141,8 +615,9 @@ func (p *Part) AsText(avoidUTF8 bool) string {
 // dividing the part into bodyparts wherever the boundary \a divider occurs and
 // adding each bodypart to \a children, and setting the correct \a parent. \a
 // divider does not contain the leading or trailing hyphens. \a digest is true
-// for multipart/digest and false for other types.
-func (p *Part) parseMultipart(rfc5322, divider string, digest bool) {
+// for multipart/digest and false for other types. \a offset is the position
+// of \a rfc5322 in the text being parsed.
+func (p *Part) parseMultipart(rfc5322, divider string, digest bool, offset int) {
 	i := 0
 	start := 0
 	last := false
@@ -150,9 +625,9 @@ func (p *Part) parseMultipart(rfc5322, divider string, digest bool) {
 	end := len(rfc5322)
 	for !last && i <= end {
 		if i >= end ||
-			rfc5322[i] == '-' && rfc5322[i+1] == '-' &&
-				(i == 0 || rfc5322[i-1] == 31 || rfc5322[i-1] == 10) &&
-				rfc5322[i+2] == divider[0] &&
+			i+2+len(divider) <= end &&
+				rfc5322[i] == '-' && rfc5322[i+1] == '-' &&
+				(i == 0 || rfc5322[i-1] == 13 || rfc5322[i-1] == 10) &&
 				rfc5322[i+2:i+2+len(divider)] == divider {
 			j := i
 			l := false
@@ -160,7 +635,7 @@ func (p *Part) parseMultipart(rfc5322, divider string, digest bool) {
 				l = true
 			} else {
 				j = i + 2 + len(divider)
-				if rfc5322[j] == '-' && rfc5322[j+1] == '-' {
+				if j+1 < end && rfc5322[j] == '-' && rfc5322[j+1] == '-' {
 					j += 2
 					l = true
 				}
@@ -177,28 +652,40 @@ func (p *Part) parseMultipart(rfc5322, divider string, digest bool) {
 					j++
 				}
 				if start > 0 && start < len(rfc5322) {
-					h, _ := ReadHeader(rfc5322[start:j], MIMEHeader)
+					// parts of internationalized messages may
+					// have UTF-8 headers, too
+					allowUTF8 := p.Header != nil && p.Header.utf8
+					h, _ := readHeader(rfc5322[start:j], MIMEHeader,
+						DefaultMaxHeaderFields, DefaultMaxHeaderBytes, allowUTF8)
+					headerOffset := offset + start
 					start += h.numBytes
 					if digest {
 						h.defaultType = MessageRFC822ContentType
 					}
 
-					h.Repair()
+					strict := p.strictParsing()
+					if !strict {
+						h.Repair()
+					}
 
-					// Strip the [CR]LF that belongs to the boundary.
-					if rfc5322[i-1] == 10 {
+					// Strip the CRLF, LF or CR that belongs to the
+					// boundary, unless it ends the part's header.
+					if i > start && rfc5322[i-1] == 10 {
+						i--
+					}
+					if i > start && rfc5322[i-1] == 13 {
 						i--
-						if rfc5322[i-1] == 13 {
-							i--
-						}
 					}
 
-					bp := p.parseBodypart(rfc5322[start:i], h)
+					bp := p.parseBodypart(rfc5322[start:i], h, offset+start)
+					bp.HeaderOffset = headerOffset
 					bp.Number = pn
 					p.Parts = append(p.Parts, bp)
 					pn++
 
-					h.RepairWithBody(bp, "")
+					if !strict {
+						h.RepairWithBody(bp, "")
+					}
 				}
 				last = l
 				start = j
@@ -218,18 +705,18 @@ func guessTextCodec(body string) *charset.Charset {
 	// step 1. try iso-2022-jp. this goes first because it's so
 	// restrictive, and because 2022 strings also match the ascii and
 	// utf-8 tests.
-	if body[0] == 0x1B &&
+	if len(body) >= 3 && body[0] == 0x1B &&
 		(body[1] == '(' || body[1] == '$') &&
 		(body[2] == 'B' || body[2] == 'J' || body[2] == '@') {
-		_, err := decode(body, "iso-2022-jp")
-		if err != nil {
+		_, err := toUnicode(body, "iso-2022-jp")
+		if err == nil {
 			return charset.Info("iso-2022-jp")
 		}
 	}
 
 	// step 2. could it be pure ascii?
-	_, err := decode(body, "us-ascii")
-	if err != nil {
+	_, err := toUnicode(body, "us-ascii")
+	if err == nil {
 		return charset.Info("us-ascii")
 	}
 
@@ -239,14 +726,18 @@ func guessTextCodec(body string) *charset.Charset {
 	// exclusively.
 
 	// step 3. does it look good as utf-8?
-	_, err = decode(body, "utf8")
-	if err != nil {
+	_, err = toUnicode(body, "utf8")
+	if err == nil {
 		// FIXME: skipped a check for ascii
 		return charset.Info("utf8")
 	}
 
 	// step 4. guess a codec based on the bodypart content.
-	// TODO: implement codec guesser
+	if name := guessLegacyCodec(body); name != "" {
+		if c := charset.Info(name); c != nil {
+			return c
+		}
+	}
 
 	// step 5. is utf-8 at all plausible?
 	// FIXME: not reachable since we don't yet discriminate between valid and well-formed
@@ -264,7 +755,7 @@ func guessHtmlCodec(body string) *charset.Charset {
 
 	// HTML prescribes that 8859-1 is the default. Let's see if 8859-1 works.
 	if guess == nil {
-		_, err := decode(body, "iso-8859-1")
+		_, err := toUnicode(body, "iso-8859-1")
 		if err == nil {
 			guess = charset.Info("iso-8859-1")
 		}
@@ -273,7 +764,7 @@ func guessHtmlCodec(body string) *charset.Charset {
 	if guess == nil {
 		// Some people believe that Windows codepage 1252 is
 		// ISO-8859-1. Let's see if that works.
-		_, err := decode(body, "cp-1252")
+		_, err := toUnicode(body, "cp-1252")
 		if err == nil {
 			guess = charset.Info("cp-1252")
 		}
@@ -284,49 +775,96 @@ func guessHtmlCodec(body string) *charset.Charset {
 	// is it more likely to be correct than our guess above?
 
 	b := simplify(strings.ToLower(body))
+	for _, d := range metaCharsets(b) {
+		meta := charset.Info(d.name)
+		if meta == nil {
+			// an unknown charset can't be better than our guess
+			continue
+		}
+		m, merr := toUnicode(body, meta.Name)
+		g := ""
+		var gerr error
+		if guess != nil {
+			g, gerr = toUnicode(body, guess.Name)
+		}
+		ub, _ := toUnicode(b, meta.Name)
+		if ((m != "" && m == g) ||
+			(merr == nil &&
+				(guess == nil || gerr != nil)) ||
+			(merr == nil && guess == nil) ||
+			(merr == nil && guess != nil && isFallbackCharset(guess)) ||
+			(merr == nil && guess != nil && gerr != nil)) &&
+			strings.Contains(ascii(ub), d.tag) {
+			guess = meta
+		}
+	}
+
+	return guess
+}
+
+// A charset declared by an HTML <meta> tag, and the start of the tag that
+// declares it.
+type metaCharset struct {
+	name, tag string
+}
+
+// Returns the charsets declared in \a b, which must be lower-case and
+// simplified HTML, in the order they occur. Both the old
+// <meta http-equiv="content-type" content="..."> form and the HTML5
+// <meta charset="..."> form (quoted or not) are found.
+func metaCharsets(b string) []metaCharset {
+	const httpEquiv = "<meta http-equiv=\"content-type\" content=\""
+	const html5 = "<meta charset="
+
+	var r []metaCharset
 	i := 0
 	for {
-		tag := "<meta http-equiv=\"content-type\" content=\""
-		next := strings.Index(b[i:], tag)
-		if next < 0 {
+		e := strings.Index(b[i:], httpEquiv)
+		h := strings.Index(b[i:], html5)
+		if e < 0 && h < 0 {
 			break
 		}
 
-		i += next
-		i += len(tag)
-		j := i
-		for j < len(b) && b[j] != '"' {
-			j++
+		if e >= 0 && (h < 0 || e < h) {
+			i += e + len(httpEquiv)
+			j := i
+			for j < len(b) && b[j] != '"' {
+				j++
+			}
+			hf := NewHeaderField("Content-Type", b[i:j])
+			if cs := hf.(*ContentType).parameter("charset"); cs != "" {
+				r = append(r, metaCharset{cs, httpEquiv})
+			}
+			continue
 		}
-		hf := NewHeaderField("Content-Type", b[i:j])
-		cs := hf.(*ContentType).parameter("charset")
-		var meta *charset.Charset
-		if cs != "" {
-			meta = charset.Info(cs)
+
+		start := i + h
+		i = start + len(html5)
+		end := " />"
+		if i < len(b) && (b[i] == '"' || b[i] == '\'') {
+			end = b[i : i+1]
+			i++
 		}
-		m := ""
-		g := ""
-		var merr, gerr error
-		if meta != nil {
-			m, merr = decode(body, meta.Name)
+		j := i
+		for j < len(b) && !strings.ContainsRune(end, rune(b[j])) {
+			j++
 		}
-		if guess != nil {
-			g, gerr = decode(body, guess.Name)
-		}
-		ub, _ := decode(b, meta.Name)
-		if meta != nil &&
-			((m != "" && m == g) ||
-				(merr == nil &&
-					(guess == nil || gerr != nil)) ||
-				(merr == nil && guess == nil) ||
-				(merr == nil && guess != nil && guess.Name == "iso-8859-1") ||
-				(merr == nil && guess != nil && gerr != nil)) &&
-			strings.Contains(ascii(ub), tag) {
-			guess = meta
+		if cs := strings.TrimSpace(b[i:j]); cs != "" {
+			r = append(r, metaCharset{cs, b[start:j]})
 		}
 	}
+	return r
+}
 
-	return guess
+// Returns true if \a c is one of the single-byte charsets guessHtmlCodec()
+// falls back on. Nearly any text decodes in those, so a charset declared in
+// the HTML which also works is more likely to be right.
+func isFallbackCharset(c *charset.Charset) bool {
+	switch strings.ToLower(c.Name) {
+	case "iso-8859-1", "iso-8859-15", "iso-8859-2", "windows-1252", "cp-1252":
+		return true
+	}
+	return false
 }
 
 // Parses the part of \a rfc2822 from \a start to \a end (not including \a end)
@@ -337,19 +875,25 @@ func guessHtmlCodec(body string) *charset.Charset {
 // The \a parent argument is provided so that nested message/rfc822 bodyparts
 // without a Date field may be fixed with reference to the Date field in the
 // enclosing bodypart.
-func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
+//
+// \a offset is the position of \a rfc5322 in the text being parsed, and is
+// used to record the part's offsets.
+func (p *Part) parseBodypart(rfc5322 string, h *Header, offset int) *Part {
 	start := 0
 	end := len(rfc5322)
-	if rfc5322[start] == 13 {
+	if start < end && rfc5322[start] == 13 {
 		start++
 	}
-	if rfc5322[start] == 10 {
+	if start < end && rfc5322[start] == 10 {
 		start++
 	}
 
 	bp := &Part{
-		parent: p,
-		Header: h,
+		parent:       p,
+		Header:       h,
+		HeaderOffset: offset,
+		BodyOffset:   offset,
+		BodyEnd:      offset + len(rfc5322),
 	}
 
 	body := ""
@@ -380,7 +924,13 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 		e = cte.Encoding
 	}
 	if body != "" {
-		if e == Base64Encoding || e == UuencodeEncoding {
+		if e == UuencodeEncoding {
+			var err error
+			body, err = deUueChecked(body)
+			if err != nil {
+				bp.err = err
+			}
+		} else if e == Base64Encoding {
 			body = decodeCTE(body, e)
 		} else {
 			body = decodeCTE(toCRLF(body), e)
@@ -388,13 +938,11 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 	}
 
 	ct := h.ContentType()
-	if ct == nil {
-		switch h.defaultType {
-		case TextPlainContentType:
-			h.Add("Content-Type", "text/plain")
-		case MessageRFC822ContentType:
-			h.Add("Content-Type", "message/rfc822")
-		}
+	if ct == nil && bp.strictParsing() {
+		// use the default without adding it to the header
+		ct = newHeaderField(ContentTypeFieldName, h.ContentTypeString(), false).(*ContentType)
+	} else if ct == nil {
+		h.Add("Content-Type", h.ContentTypeString())
 		ct = h.ContentType()
 	}
 	if ct.Type == "text" {
@@ -419,7 +967,7 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 				// Content-Type field - without checking whether the
 				// body actually is ASCII. If it isn't, we'd better
 				// call our charset guesser.
-				_, err := decode(body, c.Name)
+				_, err := toUnicode(body, c.Name)
 				if err != nil {
 					specified = false
 				}
@@ -431,7 +979,7 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 		}
 
 		bp.hasText = true
-		t, decodeErr := decode(toCRLF(body), c.Name)
+		t, decodeErr := toUnicode(toCRLF(body), c.Name)
 		bp.Text = t
 
 		if c.Name == "GB2312" || c.Name == "ISO-2022-JP" ||
@@ -476,7 +1024,7 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 			guessed := ""
 			var gerr error
 			if g != nil {
-				guessed, gerr = decode(toCRLF(body), g.Name)
+				guessed, gerr = toUnicode(toCRLF(body), g.Name)
 			}
 			if g == nil {
 				// if we couldn't guess anything, keep what we had if
@@ -491,6 +1039,7 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 				if gerr == nil && decodeErr != nil {
 					c = g
 					bp.Text = guessed
+					decodeErr = nil
 				}
 			}
 		}
@@ -512,7 +1061,7 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 		// if we ended up using a 16-bit codec and were using q-p, we
 		// need to reevaluate without any trailing CRLF
 		if e == QPEncoding && strings.HasPrefix(c.Name, "UTF-16") {
-			bp.Text, _ = decode(stripCRLF(body), c.Name)
+			bp.Text, _ = toUnicode(stripCRLF(body), c.Name)
 		}
 
 		if decodeErr != nil && bp.err == nil {
@@ -549,7 +1098,7 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 				h.RemoveAllNamed(ContentTransferEncodingFieldName)
 				cte = nil
 			} else if cte.Encoding != QPEncoding {
-				cte.Encoding = QPEncoding
+				cte.setEncoding(QPEncoding)
 			}
 		} else if qp {
 			h.Add("Content-Transfer-Encoding", "quoted-printable")
@@ -576,7 +1125,7 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 				h.RemoveAllNamed(ContentTransferEncodingFieldName)
 				cte = nil
 			} else if cte != nil {
-				cte.Encoding = e
+				cte.setEncoding(e)
 			} else {
 				h.Add("Content-Transfer-Encoding", "base64")
 				cte = h.ContentTransferEncoding()
@@ -584,16 +1133,19 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 		}
 	}
 
-	if ct.Type == "multipart" {
-		bp.parseMultipart(rfc5322[start:end], ct.parameter("boundary"), ct.Subtype == "digest")
-	} else if ct.Type == "message" && ct.Subtype == "rfc822" {
+	if (ct.Type == "multipart" || isMessage(ct)) && bp.tooDeep() {
+		// leave it in Data, to be written out verbatim
+		bp.err = ErrNestingTooDeep
+	} else if ct.Type == "multipart" {
+		bp.parseMultipart(rfc5322[start:end], ct.parameter("boundary"), ct.Subtype == "digest", offset+start)
+	} else if isMessage(ct) {
 		// There are sometimes blank lines before the message.
-		for rfc5322[start] == 13 || rfc5322[start] == 10 {
+		for start < end && (rfc5322[start] == 13 || rfc5322[start] == 10) {
 			start++
 		}
 		m := NewMessage()
 		m.parent = bp
-		m.Parse(rfc5322[start:end])
+		m.parse(rfc5322[start:end], offset+start)
 		for _, p := range m.Parts {
 			bp.Parts = append(bp.Parts, p)
 			p.parent = bp
@@ -603,11 +1155,17 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 	}
 
 	bp.numBytes = len(body)
-	if cte != nil {
-		body = encodeCTE(body, cte.Encoding, 72)
+	countLines := bp.hasText || isMessage(ct)
+	if cte != nil && cte.Encoding == Base64Encoding && !countLines {
+		// no need to encode a large attachment just to measure it
+		bp.numEncodedBytes = e64Length(len(body), 72)
+	} else {
+		if cte != nil {
+			body = encodeCTE(body, cte.Encoding, 72)
+		}
+		bp.numEncodedBytes = len(body)
 	}
-	bp.numEncodedBytes = len(body)
-	if bp.hasText || (ct.Type == "message" && ct.Subtype == "rfc822") {
+	if countLines {
 		n := 0
 		i := 0
 		l := len(body)
@@ -623,7 +1181,9 @@ func (p *Part) parseBodypart(rfc5322 string, h *Header) *Part {
 		bp.numEncodedLines = n
 	}
 
-	h.Simplify()
+	if !bp.strictParsing() {
+		h.Simplify()
+	}
 
 	return bp
 }
@@ -0,0 +1,216 @@
+package mail
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A DeliveryStatus is the content of a message/delivery-status bodypart, as
+// described in RFC 3464: the per-message fields, of which only Reporting-MTA
+// is kept, and one RecipientStatus for each recipient the report concerns.
+type DeliveryStatus struct {
+	ReportingMTA string
+	Recipients   []RecipientStatus
+}
+
+// A RecipientStatus holds the per-recipient fields of a delivery status
+// notification. The address type (e.g. "rfc822;") is stripped from the
+// recipients and from DiagnosticCode (e.g. "smtp;"), and xtext in rfc822
+// recipients is decoded. Action is lowercase, e.g. "failed" or "delivered",
+// and Status is the RFC 3463 status code, e.g. "5.1.1".
+type RecipientStatus struct {
+	OriginalRecipient string
+	FinalRecipient    string
+	Action            string
+	Status            string
+	DiagnosticCode    string
+}
+
+// Returns the delivery status report in this message and true, or a null
+// pointer and false if the message contains no message/delivery-status (or
+// message/global-delivery-status) bodypart. The first such bodypart is used.
+func (m *Message) DeliveryStatus() (*DeliveryStatus, bool) {
+	p := m.partOfType("message/delivery-status", "message/global-delivery-status")
+	if p == nil {
+		return nil, false
+	}
+	return parseDeliveryStatus(p.Data), true
+}
+
+// Returns the first Part in this message whose content type is one of \a
+// types, or a null pointer if there is none.
+func (m *Message) partOfType(types ...string) *Part {
+	var r *Part
+	m.Walk(func(p *Part, depth int) bool {
+		if r != nil {
+			return false
+		}
+		if p.Header != nil {
+			ct := p.Header.ContentTypeString()
+			for _, t := range types {
+				if ct == t {
+					r = p
+				}
+			}
+		}
+		return r == nil
+	})
+	return r
+}
+
+// An MDN is the content of a message/disposition-notification bodypart, as
+// described in RFC 8098: a read receipt or similar notice of what became of a
+// message. As in RecipientStatus, address types are stripped from the
+// recipients. Disposition is the disposition field as is, e.g.
+// "manual-action/MDN-sent-manually; displayed", and DispositionType is its
+// lowercase disposition type, e.g. "displayed" or "deleted".
+type MDN struct {
+	ReportingUA       string
+	OriginalRecipient string
+	FinalRecipient    string
+	OriginalMessageID string
+	Disposition       string
+	DispositionType   string
+}
+
+// Returns the disposition notification in this message and true, or a null
+// pointer and false if the message contains no
+// message/disposition-notification (or message/global-disposition-notification)
+// bodypart. The first such bodypart is used.
+func (m *Message) DispositionNotification() (*MDN, bool) {
+	p := m.partOfType("message/disposition-notification", "message/global-disposition-notification")
+	if p == nil {
+		return nil, false
+	}
+	return parseMDN(p.Data), true
+}
+
+// Parses \a s as the content of a message/disposition-notification bodypart.
+func parseMDN(s string) *MDN {
+	fields := map[string]string{}
+	// all the fields belong to one block, but tolerate blank lines
+	for _, block := range reportBlocks(s) {
+		for n, v := range block {
+			if _, seen := fields[n]; !seen {
+				fields[n] = v
+			}
+		}
+	}
+
+	mdn := &MDN{
+		ReportingUA:       fields["reporting-ua"],
+		OriginalRecipient: recipient(fields["original-recipient"]),
+		FinalRecipient:    recipient(fields["final-recipient"]),
+		OriginalMessageID: fields["original-message-id"],
+		Disposition:       fields["disposition"],
+	}
+	// disposition-type follows the semicolon and may be followed by
+	// modifiers after a slash
+	t := typedValue(mdn.Disposition)
+	if i := strings.IndexByte(t, '/'); i >= 0 {
+		t = t[:i]
+	}
+	mdn.DispositionType = strings.ToLower(strings.TrimSpace(t))
+	return mdn
+}
+
+// Parses \a s as the content of a message/delivery-status bodypart.
+func parseDeliveryStatus(s string) *DeliveryStatus {
+	ds := &DeliveryStatus{}
+	for i, block := range reportBlocks(s) {
+		if i == 0 {
+			ds.ReportingMTA = typedValue(block["reporting-mta"])
+			continue
+		}
+		ds.Recipients = append(ds.Recipients, RecipientStatus{
+			OriginalRecipient: recipient(block["original-recipient"]),
+			FinalRecipient:    recipient(block["final-recipient"]),
+			Action:            strings.ToLower(block["action"]),
+			Status:            block["status"],
+			DiagnosticCode:    typedValue(block["diagnostic-code"]),
+		})
+	}
+	return ds
+}
+
+// Splits \a s, the content of a delivery status or disposition notification,
+// into blocks separated by blank lines, and each block into fields. Folded
+// fields are unfolded, field names are lowercased and values are simplified.
+// Only the first occurrence of each field in a block is kept.
+func reportBlocks(s string) []map[string]string {
+	var blocks []map[string]string
+	var block map[string]string
+	name := ""
+	for _, l := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n") {
+		if strings.TrimSpace(l) == "" {
+			block = nil
+			continue
+		}
+		if block == nil {
+			block = map[string]string{}
+			blocks = append(blocks, block)
+			name = ""
+		}
+		if l[0] == ' ' || l[0] == '\t' {
+			if name != "" {
+				block[name] = simplify(block[name] + " " + l)
+			}
+			continue
+		}
+		colon := strings.IndexByte(l, ':')
+		if colon < 0 {
+			name = ""
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(l[:colon]))
+		if _, seen := block[name]; seen {
+			name = ""
+			continue
+		}
+		block[name] = simplify(l[colon+1:])
+	}
+	return blocks
+}
+
+// Returns the part of \a v after the type and semicolon, e.g.
+// "mx.example.com" for "dns; mx.example.com". If \a v has no type, it is
+// returned as is.
+func typedValue(v string) string {
+	i := strings.IndexByte(v, ';')
+	if i < 0 {
+		return v
+	}
+	return strings.TrimSpace(v[i+1:])
+}
+
+// Returns the address in the recipient field value \a v, decoding xtext if
+// the address type is rfc822.
+func recipient(v string) string {
+	a := typedValue(v)
+	if i := strings.IndexByte(v, ';'); i >= 0 &&
+		strings.ToLower(strings.TrimSpace(v[:i])) == "rfc822" {
+		a = deXtext(a)
+	}
+	return a
+}
+
+// Decodes the xtext (RFC 3461 section 4) \a s, in which "+" followed by two
+// hex digits stands for the byte with that value. Invalid escapes are left
+// alone.
+func deXtext(s string) string {
+	if !strings.Contains(s, "+") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
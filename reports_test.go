@@ -0,0 +1,78 @@
+package mail_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/paulrosania/go-mail"
+)
+
+func TestDeliveryStatus(t *testing.T) {
+	msg := loadFixture(t, "dsn")
+
+	ds, ok := msg.DeliveryStatus()
+	if !ok {
+		t.Fatal("no delivery status")
+	}
+	testStringEquals(t, "Reporting-MTA", ds.ReportingMTA, "mx.example.net")
+	if len(ds.Recipients) != 2 {
+		t.Fatalf("incorrect number of recipients: expected 2, got %d", len(ds.Recipients))
+	}
+
+	bob := ds.Recipients[0]
+	testStringEquals(t, "Final-Recipient", bob.FinalRecipient, "bob@example.org")
+	testStringEquals(t, "Original-Recipient", bob.OriginalRecipient, "Bob+Smith@example.org")
+	testStringEquals(t, "Action", bob.Action, "failed")
+	testStringEquals(t, "Status", bob.Status, "5.1.1")
+	testStringEquals(t, "Diagnostic-Code", bob.DiagnosticCode,
+		"550 5.1.1 <bob@example.org>: Recipient address rejected: User unknown in local recipient table")
+
+	carol := ds.Recipients[1]
+	testStringEquals(t, "Final-Recipient", carol.FinalRecipient, "carol@example.org")
+	testStringEquals(t, "Original-Recipient", carol.OriginalRecipient, "")
+	testStringEquals(t, "Action", carol.Action, "delayed")
+	testStringEquals(t, "Status", carol.Status, "4.4.1")
+	testStringEquals(t, "Diagnostic-Code", carol.DiagnosticCode,
+		"connect to mail.example.org[192.0.2.1]:25: Connection timed out")
+
+	if _, ok := loadFixture(t, "plain").DeliveryStatus(); ok {
+		t.Error("unexpected delivery status in a plain message")
+	}
+}
+
+func TestDeliveryStatusWithoutFrom(t *testing.T) {
+	b, err := ioutil.ReadFile("fixtures/dsn.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := strings.Replace(string(b), "From: Mail Delivery System <MAILER-DAEMON@mx.example.net>\n", "", 1)
+	msg, err := mail.ReadMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := msg.Header.Addresses("From")
+	if len(from) != 1 {
+		t.Fatalf("incorrect number of From addresses: expected 1, got %d", len(from))
+	}
+	testStringEquals(t, "From", from[0].String(), "\"mx.example.net postmaster\" <postmaster@example.org>")
+}
+
+func TestDispositionNotification(t *testing.T) {
+	msg := loadFixture(t, "mdn")
+
+	mdn, ok := msg.DispositionNotification()
+	if !ok {
+		t.Fatal("no disposition notification")
+	}
+	testStringEquals(t, "Reporting-UA", mdn.ReportingUA, "joes-pc.cs.example.org; Foomail 97.1")
+	testStringEquals(t, "Original-Recipient", mdn.OriginalRecipient, "Bob@example.org")
+	testStringEquals(t, "Final-Recipient", mdn.FinalRecipient, "bob@example.org")
+	testStringEquals(t, "Original-Message-ID", mdn.OriginalMessageID, "<lunch@example.com>")
+	testStringEquals(t, "Disposition", mdn.Disposition, "manual-action/MDN-sent-manually; displayed")
+	testStringEquals(t, "Disposition type", mdn.DispositionType, "displayed")
+
+	if _, ok := loadFixture(t, "dsn").DispositionNotification(); ok {
+		t.Error("unexpected disposition notification in a DSN")
+	}
+}
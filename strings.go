@@ -2,8 +2,13 @@ package mail
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/paulrosania/go-charset/charset"
 	_ "github.com/paulrosania/go-charset/data"
@@ -96,6 +101,9 @@ func simplify(str string) string {
 		}
 		i++
 	}
+	if first == len(str) {
+		return ""
+	}
 
 	// scan on to find the last nonwhitespace character and detect any
 	// sequences of two or more whitespace characters within the
@@ -196,15 +204,21 @@ func headerCase(str string) string {
 		i++
 	}
 
-	// MIME-* and *-ID headers are special
+	// MIME-*, DKIM-*, *-ID and *-SPF headers are special
 	s := buf.String()
 	l := len(s)
 	if l > 5 && s[:5] == "Mime-" {
 		s = "MIME-" + s[5:]
 	}
+	if l > 5 && s[:5] == "Dkim-" {
+		s = "DKIM-" + s[5:]
+	}
 	if l > 3 && s[l-3:] == "-Id" {
 		s = s[:l-3] + "-ID"
 	}
+	if l > 4 && s[l-4:] == "-Spf" {
+		s = s[:l-4] + "-SPF"
+	}
 
 	return s
 }
@@ -254,6 +268,35 @@ func decodeCTE(s string, e EncodingType) string {
 	return s
 }
 
+// EncodeBase64 returns \a data in base64, in lines of at most \a lineLength
+// characters ending in CRLF. If \a lineLength is 0, the result is a single
+// line devoid of whitespace. This is the encoding used for base64 bodyparts.
+func EncodeBase64(data []byte, lineLength int) string {
+	return e64(string(data), lineLength)
+}
+
+// DecodeBase64 decodes the base64 text \a s and returns the result. Like the
+// parser, it overlooks errors: whitespace and other characters outside the
+// base64 alphabet are skipped, and decoding stops at the first padding
+// character.
+func DecodeBase64(s string) []byte {
+	return []byte(de64(s))
+}
+
+// EncodeQuotedPrintable returns \a data in quoted-printable, as used for
+// bodyparts: lines are kept below 76 characters with soft line breaks, and
+// line breaks in \a data are kept as hard line breaks.
+func EncodeQuotedPrintable(data []byte) string {
+	return eQP(string(data), false, false)
+}
+
+// DecodeQuotedPrintable decodes the quoted-printable text \a s and returns the
+// result. Errors are overlooked, and hard line breaks become CRLF; see
+// NewQPDecoder() for a streaming equivalent.
+func DecodeQuotedPrintable(s string) []byte {
+	return []byte(deQP(s, false))
+}
+
 // Returns section \a n of this string, where a section is defined as a run of
 // sequences separated by \a s. If \a s is the empty string or \a n is 0,
 // section() returns this entire string. If this string contains fewer
@@ -271,12 +314,33 @@ func section(str, s string, n int) string {
 	return ""
 }
 
+// Returns true if \a s consists only of ASCII letters.
+func isAlpha(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= 'a' && s[i] <= 'z') && !(s[i] >= 'A' && s[i] <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
 // An implementation of uudecode, sufficient to handle some occurences of
 // "content-transfer-encoding: x-uuencode" seen. Possibly not correct according
 // to POSIX 1003.2b, who knows.
+//
+// Problems are overlooked; see deUueChecked().
 func deUue(s string) string {
+	r, _ := deUueChecked(s)
+	return r
+}
+
+// Uudecodes \a s like deUue(), and also returns an error if \a s has no begin
+// line, has a line deUue() can't make sense of, or ends without an end line.
+// In the first two cases, \a s is returned undecoded; in the last, whatever
+// could be decoded is returned.
+func deUueChecked(s string) (string, error) {
 	if s == "" {
-		return s
+		return s, errors.New("Uuencoded data has no begin line")
 	}
 	i := 0
 	if !strings.HasPrefix(s, "begin") {
@@ -285,7 +349,7 @@ func deUue(s string) string {
 			begin = strings.Index(s, "\rbegin")
 		}
 		if begin < 0 {
-			return s
+			return s, errors.New("Uuencoded data has no begin line")
 		}
 		i = begin + 1
 	}
@@ -310,9 +374,9 @@ func deUue(s string) string {
 				(i+3 == len(s) ||
 					s[i+3] == 13 || s[i+3] == 10 ||
 					s[i+3] == 9 || s[i+3] == 32) {
-				return buf.String()
+				return buf.String(), nil
 			} else if c < 32 {
-				return s
+				return s, fmt.Errorf("Invalid uuencoded line: %s", simplify(s[i:i+1]))
 			} else {
 				linelength = (c - 32) & 63
 			}
@@ -330,10 +394,10 @@ func deUue(s string) string {
 			if i+1 < len(s) {
 				c1 = 63 & (s[i+1] - 32)
 			}
-			if i+1 < len(s) {
+			if i+2 < len(s) {
 				c2 = 63 & (s[i+2] - 32)
 			}
-			if i+1 < len(s) {
+			if i+3 < len(s) {
 				c3 = 63 & (s[i+3] - 32)
 			}
 			i += 4
@@ -351,9 +415,9 @@ func deUue(s string) string {
 			}
 		}
 	}
-	// we ran off the end without seeing an end line. what to do?
-	// return what we've seen so far?
-	return buf.String()
+	// we ran off the end without seeing an end line. return what we've
+	// seen so far, and say that it's incomplete.
+	return buf.String(), errors.New("Uuencoded data is truncated: no end line")
 }
 
 var from64 = []uint8{
@@ -383,35 +447,60 @@ var from64 = []uint8{
 
 // Decodes this string using the base-64 algorithm and returns the result.
 func de64(s string) string {
-	buf := bytes.NewBuffer(make([]byte, 0, len(s)*3/4+20)) // 20 = fudge
-	decoded := uint8(0)
-	m := 0
+	var st de64State
+	var r strings.Builder
+	r.Grow(len(s)*3/4 + 20) // 20 = fudge
+
+	// decode in chunks, so that the result isn't copied once more to
+	// turn it into a string
+	var buf [3072]byte
+	for s != "" && !st.done {
+		n := len(s)
+		if n > 4096 {
+			n = 4096
+		}
+		r.Write(st.decode(buf[:0], s[:n]))
+		s = s[n:]
+	}
+	return r.String()
+}
+
+// The state of a base-64 decoder between calls to decode(), so that input may
+// be split at any point.
+type de64State struct {
+	decoded uint8
+	m       int
+	done    bool
+}
+
+// Decodes \a s, appends the result to \a buf and returns the extended slice.
+// Once the padding character has been seen, all further input is ignored.
+func (st *de64State) decode(buf []byte, s string) []byte {
 	p := 0
-	done := false
-	for p < len(s) && !done {
+	for p < len(s) && !st.done {
 		c := s[p]
 		if c <= 'z' {
 			c = from64[c]
 		}
 		if c < 64 {
-			switch m {
+			switch st.m {
 			case 0:
-				decoded = c << 2
+				st.decoded = c << 2
 			case 1:
-				decoded += (c & 0xF0) >> 4
-				buf.WriteByte(decoded)
-				decoded = (c & 15) << 4
+				st.decoded += (c & 0xF0) >> 4
+				buf = append(buf, st.decoded)
+				st.decoded = (c & 15) << 4
 			case 2:
-				decoded += (c & 0xFC) >> 2
-				buf.WriteByte(decoded)
-				decoded = (c & 3) << 6
+				st.decoded += (c & 0xFC) >> 2
+				buf = append(buf, st.decoded)
+				st.decoded = (c & 3) << 6
 			case 3:
-				decoded += c
-				buf.WriteByte(decoded)
+				st.decoded += c
+				buf = append(buf, st.decoded)
 			}
-			m = (m + 1) & 3
+			st.m = (st.m + 1) & 3
 		} else if c == 64 {
-			done = true
+			st.done = true
 		} else if c == 65 {
 			// white space; perfectly normal and may be ignored.
 		} else {
@@ -421,7 +510,40 @@ func de64(s string) string {
 		}
 		p++
 	}
-	return buf.String()
+	return buf
+}
+
+type base64Decoder struct {
+	r   io.Reader
+	st  de64State
+	in  [4096]byte
+	out []byte
+	err error
+}
+
+// Returns a reader that decodes the base-64 data read from \a r. Like de64(),
+// it ignores white space and illegal characters, and stops at the first
+// padding character. Only a small, fixed amount of memory is used regardless
+// of the size of the input.
+func NewBase64Decoder(r io.Reader) io.Reader {
+	return &base64Decoder{r: r}
+}
+
+func (d *base64Decoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.st.done {
+			return 0, io.EOF
+		}
+		var n int
+		n, d.err = d.r.Read(d.in[:])
+		d.out = d.st.decode(d.out[:0], string(d.in[:n]))
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
 }
 
 const to64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
@@ -470,6 +592,7 @@ func e64(s string, lineLength int) string {
 		} else {
 			buf.WriteByte('=')
 		}
+		c += 4
 	}
 	if lineLength > 0 && c > 0 {
 		buf.WriteByte(13)
@@ -478,18 +601,149 @@ func e64(s string, lineLength int) string {
 	return buf.String()
 }
 
+// Returns the length of e64(s, \a lineLength) for any s of length \a n,
+// without encoding anything.
+func e64Length(n, lineLength int) int {
+	chars := 4 * ((n + 2) / 3)
+	if lineLength <= 0 || chars == 0 {
+		return chars
+	}
+	// e64() ends a line once it holds at least lineLength characters
+	perLine := 4 * ((lineLength + 3) / 4)
+	return chars + 2*((chars+perLine-1)/perLine)
+}
+
+type base64Encoder struct {
+	w          io.Writer
+	lineLength int
+	c          int
+	group      [3]byte
+	n          int
+	out        []byte
+	err        error
+}
+
+// Returns a writer that base-64 encodes everything written to it and writes
+// the result to \a w in lines of at most \a lineLength characters, each
+// ending in CRLF. If \a lineLength is 0, the result is a single line devoid of
+// whitespace. The output is the same as e64() would produce.
+//
+// Close must be called to write the final, padded group and line ending. It
+// does not close \a w.
+func NewBase64Encoder(w io.Writer, lineLength int) io.WriteCloser {
+	return &base64Encoder{w: w, lineLength: lineLength}
+}
+
+// Appends the encoded form of the first \a n bytes of the current group to
+// \a out, padding it if \a n is less than 3.
+func (e *base64Encoder) appendGroup(out []byte, n int) []byte {
+	g := e.group
+	for i := n; i < 3; i++ {
+		g[i] = 0
+	}
+	out = append(out, to64[(g[0]>>2)&63], to64[((g[0]<<4)&48)+((g[1]>>4)&15)])
+	if n > 1 {
+		out = append(out, to64[((g[1]<<2)&60)+((g[2]>>6)&3)])
+	} else {
+		out = append(out, '=')
+	}
+	if n > 2 {
+		out = append(out, to64[g[2]&63])
+	} else {
+		out = append(out, '=')
+	}
+	e.c += 4
+	if e.lineLength > 0 && e.c >= e.lineLength {
+		out = append(out, 13, 10)
+		e.c = 0
+	}
+	return out
+}
+
+func (e *base64Encoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// encode in pieces, so that a large write doesn't need a
+		// similarly large buffer.
+		chunk := p
+		if len(chunk) > 3072 {
+			chunk = chunk[:3072]
+		}
+		out := e.out[:0]
+		for _, b := range chunk {
+			e.group[e.n] = b
+			e.n++
+			if e.n == 3 {
+				out = e.appendGroup(out, 3)
+				e.n = 0
+			}
+		}
+		e.out = out
+		if _, e.err = e.w.Write(out); e.err != nil {
+			return written, e.err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (e *base64Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	out := e.out[:0]
+	if e.n > 0 {
+		out = e.appendGroup(out, e.n)
+		e.n = 0
+	}
+	if e.lineLength > 0 && e.c > 0 {
+		out = append(out, 13, 10)
+		e.c = 0
+	}
+	_, e.err = e.w.Write(out)
+	return e.err
+}
+
 // Decodes this string according to the quoted-printable algorithm, and returns
 // the result. Errors are overlooked, to cope with all the mail-munging
 // brokenware in the great big world.
 //
+// Soft line breaks ("=" at the end of a line) are removed. Hard line breaks
+// become CRLF whether they arrived as CRLF or LF, and the whitespace that
+// precedes them is removed, as RFC 2045 section 6.7 requires. Encoded CRs and
+// LFs such as "=0D=0A" are decoded like any other octet.
+//
 // If \a underscore is true, underscores in the input are translated into
-// spaces (as specified in RFC 2047).
+// spaces (as specified in RFC 2047). Otherwise they are left alone.
 func deQP(s string, underscore bool) string {
 	i := 0
 	buf := bytes.NewBuffer(make([]byte, 0, len(s)))
 	for i < len(s) {
 		var c byte
-		if s[i] != '=' {
+		if s[i] == ' ' || s[i] == '\t' {
+			// whitespace at the end of a line was added in transit
+			j := i
+			for j < len(s) && (s[j] == ' ' || s[j] == '\t') {
+				j++
+			}
+			if j < len(s) && (s[j] == 10 || s[j] == 13 && j+1 < len(s) && s[j+1] == 10) {
+				i = j
+			} else {
+				buf.WriteString(s[i:j])
+				i = j
+			}
+		} else if s[i] == 10 || s[i] == 13 && i+1 < len(s) && s[i+1] == 10 {
+			// a hard line break, which is CRLF however it arrived
+			if s[i] == 13 {
+				i++
+			}
+			i++
+			buf.WriteString(crlf)
+		} else if s[i] != '=' {
 			c = s[i]
 			i++
 			if underscore && c == '_' {
@@ -513,11 +767,17 @@ func deQP(s string, underscore bool) string {
 			} else if j < len(s)-1 && s[j] == 13 && s[j+1] == 10 {
 				eol = true
 				j += 2
+			} else if j == len(s) {
+				// a soft EOL whose line break was lost at the end
+				eol = true
 			} else if i+2 < len(s) {
 				// ... and one common case: a two-digit hex number, not EOL
 				n, e := strconv.ParseUint(s[i+1:i+1+2], 16, 8)
 				err = e
 				c = byte(n)
+			} else {
+				// too short for a hex number; keep the '=' as it is
+				err = io.ErrUnexpectedEOF
 			}
 
 			// write the proper decoded string and increase i.
@@ -535,6 +795,47 @@ func deQP(s string, underscore bool) string {
 	return buf.String()
 }
 
+type qpDecoder struct {
+	r       io.Reader
+	in      [4096]byte
+	pending []byte
+	out     []byte
+	err     error
+}
+
+// Returns a reader that decodes the quoted-printable data read from \a r,
+// overlooking errors just like deQP(). The input is decoded a line at a time,
+// so memory use is bounded by the length of the longest line rather than the
+// size of the input.
+func NewQPDecoder(r io.Reader) io.Reader {
+	return &qpDecoder{r: r}
+}
+
+func (d *qpDecoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			if len(d.pending) == 0 {
+				return 0, d.err
+			}
+			d.out = []byte(deQP(string(d.pending), false))
+			d.pending = nil
+			continue
+		}
+		var n int
+		n, d.err = d.r.Read(d.in[:])
+		d.pending = append(d.pending, d.in[:n]...)
+		// a quoted-printable escape never spans lines, so everything up to
+		// the last line feed can be decoded now.
+		if i := bytes.LastIndexByte(d.pending, 10); i >= 0 {
+			d.out = []byte(deQP(string(d.pending[:i+1]), false))
+			d.pending = append(d.pending[:0], d.pending[i+1:]...)
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
 const qphexdigits = "0123456789ABCDEF"
 
 // Encodes this string using the quoted-printable algorithm and returns the
@@ -726,6 +1027,36 @@ func needsQP(s string) bool {
 	return false
 }
 
+// Returns true if \a s can be sent as is using the 8bit
+// Content-Transfer-Encoding: it contains no NULs, every CR and LF is part of a
+// CRLF pair, and no line is longer than 998 octets (RFC 5322 section 2.1.1).
+func fits8Bit(s string) bool {
+	c := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == 0:
+			return false
+		case s[i] == 13:
+			if i+1 >= len(s) || s[i+1] != 10 {
+				return false
+			}
+		case s[i] == 10:
+			if i == 0 || s[i-1] != 13 {
+				return false
+			}
+			c = 0
+			continue
+		}
+		c++
+		if c > 999 {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts \a s from UTF-8 into the charset \a enc and returns the result.
+// Despite its name, this is the opposite of toUnicode().
 func decode(s string, enc string) (string, error) {
 	buf := bytes.NewBuffer(make([]byte, 0, len(s)))
 	cw, err := charset.NewWriter(enc, buf)
@@ -736,6 +1067,46 @@ func decode(s string, enc string) (string, error) {
 	return buf.String(), err
 }
 
+// Converts \a s from the charset \a cs into UTF-8 and returns the result,
+// along with an error if \a s isn't valid in \a cs. The result may contain
+// U+FFFD in place of bytes that couldn't be converted.
+func toUnicode(s, cs string) (string, error) {
+	switch strings.ToLower(cs) {
+	case "us-ascii", "ascii":
+		for i := 0; i < len(s); i++ {
+			if s[i] >= 128 {
+				return strings.ToValidUTF8(s, "\ufffd"), errors.New("8-bit data in ASCII text")
+			}
+		}
+		return s, nil
+	case "utf-8", "utf8":
+		if !utf8.ValidString(s) {
+			return strings.ToValidUTF8(s, "\ufffd"), errors.New("Invalid UTF-8")
+		}
+		return s, nil
+	}
+
+	r, err := charset.NewReader(cs, strings.NewReader(s))
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+// Returns \a text converted into the charset \a cs and true, or an empty
+// string and false if \a cs can't represent all of \a text.
+func toCharset(text, cs string) (string, bool) {
+	e, err := decode(text, cs)
+	if err != nil {
+		return "", false
+	}
+	if u, err := toUnicode(e, cs); err != nil || u != text {
+		return "", false
+	}
+	return e, true
+}
+
 // Do RFC 2047 decoding of \a s, totally ignoring what the encoded-text in \a s
 // contains.
 //
@@ -765,7 +1136,7 @@ func de2047(s string) string {
 	if ce >= es {
 		ce = es - 1
 	}
-	if s[es+1] != '?' {
+	if es+2 > len(s)-2 || s[es+1] != '?' {
 		return out
 	}
 
@@ -782,22 +1153,23 @@ func de2047(s string) string {
 	}
 
 	enc := s[cs:ce]
-	buf := bytes.NewBuffer(make([]byte, 0, len(encoded)))
-	cw, err := charset.NewWriter(enc, buf)
+	cr, err := charset.NewReader(enc, strings.NewReader(decoded))
 	if err != nil {
 		// if we didn't recognise the codec, we'll assume that it's
 		// ASCII if that would work and otherwise refuse to decode.
-		_, err = decode(decoded, "us-ascii")
-		if err != nil {
+		if !isAscii(decoded) {
 			return out
 		}
-		cw, err = charset.NewWriter("us-ascii", buf)
+		cr, err = charset.NewReader("us-ascii", strings.NewReader(decoded))
 		if err != nil {
-			panic(err)
+			return out
 		}
 	}
-	cw.Write([]byte(decoded)) // FIXME: Ignores errors
-	return buf.String()
+	bs, err := ioutil.ReadAll(cr)
+	if err != nil {
+		return out
+	}
+	return string(bs)
 }
 
 // This static function returns the RFC 2047-encoded version of \a s.
@@ -815,31 +1187,38 @@ func encodePhrase(s string) string {
 		if isAscii(w) && isBoring(ascii(w), TotallyBoring) {
 			buf.WriteString(ascii(w))
 		} else {
-			for i < len(words) && !(isAscii(words[i]) && isBoring(ascii(words[i]), TotallyBoring)) {
-				w += " " + words[i]
-				i++
+			// encode this word along with any following words that
+			// need it, so the spaces between them are kept
+			j := i + 1
+			for j < len(words) && !(isAscii(words[j]) && isBoring(ascii(words[j]), TotallyBoring)) {
+				j++
 			}
-			buf.WriteString(encodeWord(words[i]))
+			buf.WriteString(encodeWord(strings.Join(words[i:j], " ")))
+			i = j - 1
 		}
 	}
 
 	return buf.String()
 }
 
-// This static function returns the RFC 2047-encoded version of \a s.
+// This static function returns the RFC 2047-encoded version of \a s. Runs of
+// words that need encoding are encoded together, so that the spaces between
+// them survive, and other words are left alone. A word too long to fit on a
+// folded line is encoded too, since encodeWord() splits it into several
+// encoded-words which can be folded without changing the text.
 func encodeText(s string) string {
 	r := []string{}
 	ws := strings.Split(s, " ")
-	for i := 0; i < len(ws); i++ {
+	for i := 0; i < len(ws); {
 		l := []string{}
-		for i < len(ws) && !isAscii(ws[i]) {
+		for i < len(ws) && needsEncoding(ws[i]) {
 			l = append(l, ws[i])
 			i++
 		}
 		if len(l) > 0 {
 			r = append(r, encodeWord(strings.Join(l, " ")))
 		}
-		for i < len(ws) && isAscii(ws[i]) {
+		for i < len(ws) && !needsEncoding(ws[i]) {
 			r = append(r, ws[i])
 			i++
 		}
@@ -847,51 +1226,66 @@ func encodeText(s string) string {
 	return strings.Join(r, " ")
 }
 
-// This static function returns an RFC 2047 encoded-word representing \a w.
+// Returns true if the word \a w has to be RFC 2047 encoded in unstructured
+// text: if it isn't ASCII, if it would otherwise be mistaken for an
+// encoded-word, or if it's longer than the 77 characters that fit after the
+// space that starts a folded line.
+func needsEncoding(w string) bool {
+	return !isAscii(w) || (strings.HasPrefix(w, "=?") && strings.HasSuffix(w, "?=")) ||
+		len(w) > 77
+}
+
+// This static function returns an RFC 2047 encoded-word representing \a w,
+// or several if a single encoded-word would be too long. US-ASCII or
+// ISO-8859-1 is used if it can represent \a w, and UTF-8 otherwise. Q or B
+// encoding is chosen, whichever is shorter.
 func encodeWord(w string) string {
 	if w == "" {
 		return ""
 	}
 
-	return w
-	/*
-		// FIXME: encode properly
-		//Codec * c = Codec::byString( w );
-		//EString cw( c->fromUnicode( w ) );
-		cw := w
-
-		buf := bytes.NewBuffer(make([]byte, 0, len(w)))
-		buf.WriteString("=?")
-		buf.WriteString(c.name())
-		buf.WriteString("?")
-		t := buf.String()
-		qp := eQP(cw, true)
-		b64 := e64(cw)
-		if len(qp) <= len(b64)+3 &&
-			len(t)+len(qp) <= 73 {
-			buf.WriteString("q?")
-			buf.WriteString(qp)
-			buf.WriteString("?=")
-			t += buf.String() // FIXME: verify append is correct here, first half of buffer should already be in `t`
-		} else {
-			prefix := t + "b?"
-			t = ""
-			for b64 != "" {
-				allowed := 73 - len(prefix)
-				allowed = 4 * (allowed / 4)
-				word := prefix
-				word += b64[:allowed]
-				word += "?="
-				b64 = b64[allowed:]
-				t += word
-				if b64 != "" {
-					t += " "
-				}
-			}
+	cs := "us-ascii"
+	for _, r := range w {
+		if r > 0xFF {
+			cs = "utf-8"
+			break
+		} else if r >= 0x80 {
+			cs = "iso-8859-1"
 		}
+	}
+	cw := w
+	if cs == "iso-8859-1" {
+		cw, _ = decode(w, cs)
+	}
+
+	// an encoded-word may be at most 75 characters long, and may not
+	// contain part of a character
+	prefix := "=?" + cs + "?q?"
+	qp := eQP(cw, true, false)
+	b64 := e64(cw, 0)
+	if len(qp) <= len(b64)+3 && len(prefix)+len(qp)+2 <= 75 {
+		return prefix + qp + "?="
+	}
 
-		return t
-	*/
+	prefix = "=?" + cs + "?b?"
+	max := 3 * ((75 - len(prefix) - 2) / 4)
+	words := []string{}
+	for cw != "" {
+		n := len(cw)
+		if n > max {
+			n = max
+			for cs == "utf-8" && n > 0 && !utf8.RuneStart(cw[n]) {
+				n--
+			}
+			if n == 0 {
+				// not UTF-8 after all; split anywhere
+				n = max
+			}
+		}
+		words = append(words, prefix+e64(cw[:n], 0)+"?=")
+		cw = cw[n:]
+	}
+	return strings.Join(words, " ")
 }
 
 // Returns true if this string contains only tab, cr, lf and printable ASCII
@@ -967,8 +1361,13 @@ func isBoring(s string, b BoringType) bool {
 	return true
 }
 
-// Returns a copy of this string where every linefeed is CRLF, and where the
-// last two characters are CRLF.
+// Returns a copy of this string where every line break is CRLF, and where the
+// last two characters are CRLF. A bare LF or a bare CR is a line break, and
+// so is CR CR LF, which some broken gateways produce from CRLF. If \a s is
+// already in that form, it is returned as is, without copying.
+//
+// This is the canonicalization parseBodypart() applies to text and
+// quoted-printable bodies.
 func toCRLF(s string) string {
 	useCopy := true
 	if len(s) < 2 || s[len(s)-1] != 10 || s[len(s)-2] != 13 {
@@ -1019,6 +1418,19 @@ func toCRLF(s string) string {
 	return buf.String()
 }
 
+// Returns \a s with ASCII letters in lower case and all other bytes
+// unchanged. Unlike strings.ToLower(), this never changes the length of \a s,
+// even if it isn't valid UTF-8, so indices into the result are valid for \a s.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
 // Returns true if this string contains at least one instance of \a s, and the
 // characters before and after the occurence aren't letters.
 func containsWord(s, w string) bool {
@@ -1054,6 +1466,24 @@ func containsWord(s, w string) bool {
 	return false
 }
 
+// Returns true if \a w is an RFC 2047 encoded-word, "=?" charset "?"
+// encoding "?" encoded-text "?=", no longer than the 75 characters RFC 2047
+// permits.
+func isEncodedWord(w []byte) bool {
+	if len(w) < 8 || len(w) > 75 ||
+		!bytes.HasPrefix(w, []byte("=?")) || !bytes.HasSuffix(w, []byte("?=")) {
+		return false
+	}
+	for _, c := range w {
+		if c <= 32 || c >= 127 {
+			return false
+		}
+	}
+	f := bytes.Split(w[2:len(w)-2], []byte("?"))
+	return len(f) == 3 && len(f[0]) > 0 &&
+		len(f[1]) == 1 && bytes.IndexByte([]byte("bBqQ"), f[1][0]) >= 0
+}
+
 // Returns a copy of this string wrapped so that each line contains at most \a
 // linelength characters. The first line is prefixed by \a firstPrefix,
 // subsequent lines by \a otherPrefix. If \a spaceAtEOL is true, all lines
@@ -1065,7 +1495,12 @@ func containsWord(s, w string) bool {
 // Only space (ASCII 32) is a line-break opportunity. If there are multiple
 // spaces where a line is broken, all the spaces are replaced by a single CRLF.
 // Linefeeds added use CRLF.
-func wrap(s string, linelength int, firstPrefix, otherPrefix string, spaceAtEOL bool) string {
+//
+// If \a hardLimit is greater than zero, a word which makes a line longer than
+// \a hardLimit characters is broken there, as a last resort. Encoded-words and
+// UTF-8 characters are never broken. Note that this changes the text:
+// unfolding a header field leaves \a otherPrefix inside the word.
+func wrap(s string, linelength int, firstPrefix, otherPrefix string, spaceAtEOL bool, hardLimit int) string {
 	buf := bytes.NewBuffer(make([]byte, 0, len(s)))
 	buf.WriteString(firstPrefix)
 
@@ -1075,12 +1510,19 @@ func wrap(s string, linelength int, firstPrefix, otherPrefix string, spaceAtEOL
 	i := 0
 	linestart := 0
 	space := 0
+	// whether the line at linestart begins with an encoded-word, which
+	// mustn't be broken. that's decided once per line, when the line first
+	// grows past hardLimit. text that merely starts with "=?" is broken
+	// like any other.
+	checked := false
+	encoded := false
 	for i < len(s) {
 		c := s[i]
 		if c == ' ' {
 			space = buf.Len()
 		} else if c == '\n' {
 			linestart = buf.Len() + 1
+			checked = false
 		}
 		buf.WriteByte(c)
 		i++
@@ -1093,6 +1535,7 @@ func wrap(s string, linelength int, firstPrefix, otherPrefix string, spaceAtEOL
 			for linestart < buf.Len() && buf.String()[linestart] == ' ' {
 				linestart++
 			}
+			checked = false
 			move.Truncate(0)
 			if buf.Len() > linestart {
 				move.WriteString(buf.String()[linestart:])
@@ -1105,6 +1548,47 @@ func wrap(s string, linelength int, firstPrefix, otherPrefix string, spaceAtEOL
 			buf.WriteString("\r\n")
 			buf.WriteString(otherPrefix)
 			buf.WriteString(move.String())
+		} else if hardLimit > 0 && buf.Len() > linestart+hardLimit {
+			start := linestart
+			if start == 0 {
+				start = len(firstPrefix)
+			}
+			if !checked {
+				word := bytes.TrimLeft(buf.Bytes()[start:], "\r\n \t")
+				if n := bytes.IndexAny(word, "\r\n \t"); n >= 0 {
+					word = word[:n]
+				} else {
+					// the rest of the word hasn't been copied yet
+					rest := s[i:]
+					if len(rest) > 76 {
+						rest = rest[:76]
+					}
+					if n := strings.IndexAny(rest, "\r\n \t"); n >= 0 {
+						rest = rest[:n]
+					}
+					word = append(append([]byte(nil), word...), rest...)
+				}
+				encoded = isEncodedWord(word)
+				checked = true
+			}
+			if encoded {
+				continue
+			}
+			k := buf.Len() - 1
+			for k > start && !utf8.RuneStart(buf.Bytes()[k]) {
+				k--
+			}
+			if k <= start {
+				continue
+			}
+			move.Truncate(0)
+			move.Write(buf.Bytes()[k:])
+			buf.Truncate(k)
+			buf.WriteString("\r\n")
+			buf.WriteString(otherPrefix)
+			buf.WriteString(move.String())
+			linestart = k + 2
+			checked = false
 		}
 	}
 	return buf.String()
@@ -0,0 +1,408 @@
+package mail
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Relevant RFC: https://tools.ietf.org/html/rfc2047
+func TestDe2047(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"=?iso-8859-1?q?Andr=E9_Pirard?=", "André Pirard"},
+		{"=?utf-8?b?4pi6IHNtaWxl?=", "☺ smile"},
+		{"=?us-ascii?q?plain?=", "plain"},
+		{"not encoded", ""},
+		{"=?utf-8?q?=", ""},
+	}
+
+	for _, test := range tests {
+		if actual := de2047(test.in); actual != test.out {
+			t.Errorf("incorrect de2047(%q):\nexpected %q,\n     got %q", test.in, test.out, actual)
+		}
+	}
+}
+
+// chunkReader returns at most n bytes per Read, to exercise decoders whose
+// input is split at arbitrary points.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func randomData(n int) string {
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b)
+}
+
+func TestBase64Decoder(t *testing.T) {
+	// illegal characters and stray white space must be ignored, as de64 does
+	encoded := strings.Replace(e64(randomData(3*1024*1024), 76), "AB", "A !B", -1)
+
+	for _, n := range []int{7, 4096} {
+		decoded, err := ioutil.ReadAll(NewBase64Decoder(&chunkReader{strings.NewReader(encoded), n}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != de64(encoded) {
+			t.Errorf("incorrect streamed base64 decoding with %d-byte reads", n)
+		}
+	}
+}
+
+func TestQPDecoder(t *testing.T) {
+	encoded := eQP(randomData(2*1024*1024), false, false)
+
+	for _, n := range []int{7, 4096} {
+		decoded, err := ioutil.ReadAll(NewQPDecoder(&chunkReader{strings.NewReader(encoded), n}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != deQP(encoded, false) {
+			t.Errorf("incorrect streamed quoted-printable decoding with %d-byte reads", n)
+		}
+	}
+}
+
+func TestBase64Encoder(t *testing.T) {
+	data := randomData(100000)
+
+	for _, lineLength := range []int{0, 72, 76} {
+		// 54 bytes fill a 72-character line exactly; 55 leave one byte over
+		for _, size := range []int{0, 1, 2, 3, 54, 55, 57, 58, len(data)} {
+			for _, chunk := range []int{1, 7, 4096} {
+				var buf strings.Builder
+				w := NewBase64Encoder(&buf, lineLength)
+				for p := data[:size]; len(p) > 0; {
+					n := chunk
+					if n > len(p) {
+						n = len(p)
+					}
+					io.WriteString(w, p[:n])
+					p = p[n:]
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if buf.String() != e64(data[:size], lineLength) {
+					t.Errorf("incorrect streamed base64 encoding of %d bytes in %d-byte writes with line length %d", size, chunk, lineLength)
+				}
+				if e64Length(size, lineLength) != buf.Len() {
+					t.Errorf("incorrect e64Length(%d, %d): expected %d, got %d", size, lineLength, buf.Len(), e64Length(size, lineLength))
+				}
+			}
+		}
+	}
+}
+
+func TestExportedCTE(t *testing.T) {
+	inputs := []string{
+		"",
+		"hello",
+		"Grüße aus Köln\r\n",
+		"trailing space \r\nand = signs\r\n",
+		strings.Repeat("long line ", 20),
+		randomData(10000),
+	}
+
+	for _, in := range inputs {
+		for _, lineLength := range []int{0, 76} {
+			b64 := EncodeBase64([]byte(in), lineLength)
+			if b64 != e64(in, lineLength) {
+				t.Errorf("EncodeBase64 differs from e64 for %q", in)
+			}
+			if string(DecodeBase64(b64)) != de64(b64) || string(DecodeBase64(b64)) != in {
+				t.Errorf("DecodeBase64 differs from de64 for %q", in)
+			}
+		}
+
+		qp := EncodeQuotedPrintable([]byte(in))
+		if qp != eQP(in, false, false) {
+			t.Errorf("EncodeQuotedPrintable differs from eQP for %q", in)
+		}
+		if string(DecodeQuotedPrintable(qp)) != deQP(qp, false) {
+			t.Errorf("DecodeQuotedPrintable differs from deQP for %q", in)
+		}
+	}
+}
+
+func TestGuessLegacyCodec(t *testing.T) {
+	if len(iso88592) != 96 || len(windows1252) != 32 {
+		t.Fatalf("bad tables: %d, %d", len(iso88592), len(windows1252))
+	}
+
+	cases := []struct{ in, out string }{
+		// "Grüße aus Köln, ça va? Señor" in ISO-8859-1
+		{"Gr\xfc\xdfe aus K\xf6ln, \xe7a va? Se\xf1or", "iso-8859-1"},
+		// "“Smart quotes” – €5" in Windows-1252
+		{"\x93Smart quotes\x94 \x96 \x805", "windows-1252"},
+		// "Prix: 5 €" in ISO-8859-15
+		{"Prix: 5 \xa4", "iso-8859-15"},
+		// "Příliš žluťoučký kůň" in ISO-8859-2
+		{"P\xf8\xedli\xb9 \xbelu\xbbou\xe8k\xfd k\xf9\xf2", "iso-8859-2"},
+		// "日本語" in EUC-JP and Shift_JIS
+		{"\xc6\xfc\xcb\xdc\xb8\xec", "euc-jp"},
+		{"\x93\xfa\x96\x7b\x8c\xea", "shift_jis"},
+		// 0x81 is unassigned in Windows-1252, and not followed by a valid
+		// Shift_JIS trail byte
+		{"abc\x81", ""},
+		{"plain ASCII", ""},
+	}
+	for _, c := range cases {
+		if got := guessLegacyCodec(c.in); got != c.out {
+			t.Errorf("guessLegacyCodec(%q): expected %q, got %q", c.in, c.out, got)
+		}
+	}
+}
+
+func TestGuessHtmlCodecMetaCharset(t *testing.T) {
+	for _, meta := range []string{"<meta charset=\"windows-1251\">", "<META charset=windows-1251 />", "<meta charset='windows-1251'>"} {
+		body := "<html><head>" + meta + "</head>\r\n" +
+			"<body>\xcf\xf0\xe8\xe2\xe5\xf2, \xec\xe8\xf0!</body></html>\r\n"
+		c := guessHtmlCodec(body)
+		if c == nil || !strings.EqualFold(c.Name, "windows-1251") {
+			t.Errorf("guessHtmlCodec with %s: expected windows-1251, got %v", meta, c)
+		}
+	}
+}
+
+func TestDeQP(t *testing.T) {
+	cases := []struct {
+		in, out    string
+		underscore bool
+	}{
+		{"soft=\r\nbreak", "softbreak", false},
+		{"soft with padding=  \r\nbreak", "soft with paddingbreak", false},
+		{"one=0D=0Astill one=\r\n line\r\ntwo\nthree\r\n", "one\r\nstill one line\r\ntwo\r\nthree\r\n", false},
+		{"padded   \r\nline\t\nend  ", "padded\r\nline\r\nend  ", false},
+		{"a=3D_b c", "a=_b c", false},
+		{"a=3D_b", "a= b", true},
+		{"tail=", "tail", false},
+		{"tail=  ", "tail", false},
+		{"a=Z", "a=Z", false},
+		{"a=", "a", false},
+		{"=", "", false},
+	}
+	for _, c := range cases {
+		if got := string(DecodeQuotedPrintable(c.in)); !c.underscore && got != c.out {
+			t.Errorf("DecodeQuotedPrintable(%q): expected %q, got %q", c.in, c.out, got)
+		}
+		if got := deQP(c.in, c.underscore); got != c.out {
+			t.Errorf("deQP(%q, %v): expected %q, got %q", c.in, c.underscore, c.out, got)
+		}
+	}
+}
+
+func TestDeUueChecked(t *testing.T) {
+	full := "begin 644 cat.txt\r\n$8V%T(0``\r\n`\r\nend\r\n"
+	if s, err := deUueChecked(full); s != "cat!" || err != nil {
+		t.Errorf("deUueChecked(%q): expected \"cat!\" and no error, got %q, %v", full, s, err)
+	}
+
+	truncated := "begin 644 cat.txt\r\n$8V%T(0``\r\n"
+	if s, err := deUueChecked(truncated); s != "cat!" || err == nil {
+		t.Errorf("deUueChecked(%q): expected \"cat!\" and an error, got %q, %v", truncated, s, err)
+	}
+	if _, err := deUueChecked("$8V%T(0``\r\nend\r\n"); err == nil {
+		t.Error("expected an error for uuencoded data without a begin line")
+	}
+
+	msg, err := ReadMessage("From: a@example.com\r\n" +
+		"Date: Mon, 2 Nov 2015 10:00:00 -0800\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: x-uuencode\r\n" +
+		"\r\n" + truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Part.err == nil {
+		t.Error("expected an error on the truncated uuencoded part")
+	}
+	if msg.Data != "cat!" {
+		t.Errorf("expected the truncated data to be decoded, got %q", msg.Data)
+	}
+}
+
+func TestEncodeText(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"plain text", "plain text"},
+		{"Grüße aus Köln", "=?iso-8859-1?q?Gr=FC=DFe?= aus =?iso-8859-1?q?K=F6ln?="},
+		{"aus Köln Grüße", "aus =?iso-8859-1?q?K=F6ln_Gr=FC=DFe?="},
+		{"Schöne Grüße aus Köln", "=?iso-8859-1?q?Sch=F6ne_Gr=FC=DFe?= aus =?iso-8859-1?q?K=F6ln?="},
+		{"a ☺ b", "a =?utf-8?b?4pi6?= b"},
+		{"☺", "=?utf-8?b?4pi6?="},
+		{"two  spaces ü", "two  spaces =?iso-8859-1?q?=FC?="},
+		{"not =?us-ascii?q?encoded?=", "not =?us-ascii?b?PT91cy1hc2NpaT9xP2VuY29kZWQ/PQ==?="},
+	}
+	for _, c := range cases {
+		e := encodeText(c.in)
+		if e != c.out {
+			t.Errorf("encodeText(%q): expected %q, got %q", c.in, c.out, e)
+		}
+		if strings.Contains(e, "??=") {
+			t.Errorf("encodeText(%q) contains an empty encoded-word: %q", c.in, e)
+		}
+		if d := newParser(e).Text(); d != c.in {
+			t.Errorf("encodeText(%q) decodes as %q", c.in, d)
+		}
+	}
+}
+
+func TestEncodeWordLength(t *testing.T) {
+	for n := 0; n < 120; n++ {
+		for _, c := range []string{"é", "☺"} {
+			w := c + strings.Repeat("a", n)
+			e := encodeWord(w)
+			for _, ew := range strings.Fields(e) {
+				if len(ew) > 75 {
+					t.Errorf("encodeWord(%q) produced a %d-character encoded-word: %q", w, len(ew), ew)
+				}
+			}
+			if d := newParser(e).Text(); d != w {
+				t.Errorf("encodeWord(%q) decodes as %q", w, d)
+			}
+		}
+	}
+}
+
+func TestToCRLF(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"one\r\ntwo\r\n", "one\r\ntwo\r\n"},
+		{"one\ntwo\n", "one\r\ntwo\r\n"},
+		{"one\rtwo\r", "one\r\ntwo\r\n"},
+		{"one\r\r\ntwo", "one\r\ntwo\r\n"},
+		{"mixed\r\nlf\ncr\rcrcrlf\r\r\nend", "mixed\r\nlf\r\ncr\r\ncrcrlf\r\nend\r\n"},
+		{"\n\n", "\r\n\r\n"},
+		{"no line break", "no line break\r\n"},
+	}
+	for _, c := range cases {
+		if got := toCRLF(c.in); got != c.out {
+			t.Errorf("toCRLF(%q): expected %q, got %q", c.in, c.out, got)
+		}
+	}
+}
+
+func TestWrapHardBreaks(t *testing.T) {
+	long := strings.Repeat("0123456789", 20)
+
+	w := wrap(long, 78, "", " ", false, 0)
+	if w != long {
+		t.Errorf("wrap without hard breaks changed %q to %q", long, w)
+	}
+
+	// with an empty prefix, removing the CRLFs restores the text
+	w = wrap(long, 78, "", "", false, 78)
+	lines := strings.Split(w, "\r\n")
+	if len(lines) < 3 {
+		t.Errorf("wrap(%q) was not broken: %q", long, w)
+	}
+	for i, l := range lines {
+		if len(l) > 78 {
+			t.Errorf("wrap(%q) produced a %d-character line: %q", long, len(l), l)
+		} else if i < len(lines)-1 && len(l) < 78 {
+			t.Errorf("wrap(%q) broke a line at %d characters: %q", long, len(l), l)
+		}
+	}
+	if u := strings.Replace(w, "\r\n", "", -1); u != long {
+		t.Errorf("wrap(%q) unfolds as %q", long, u)
+	}
+
+	// a word within the hard limit is moved to a line of its own, but not
+	// broken
+	s := "short " + long
+	w = wrap(s, 78, "", " ", false, 998)
+	if w != "short\r\n "+long {
+		t.Errorf("wrap(%q) broke the word: %q", s, w)
+	}
+	if u := strings.Replace(w, "\r\n", "", -1); u != s {
+		t.Errorf("wrap(%q) unfolds as %q", s, u)
+	}
+
+	ew := "=?utf-8?q?" + strings.Repeat("x", 60) + "?="
+	w = wrap(ew, 40, "", " ", false, 40)
+	if w != ew {
+		t.Errorf("wrap broke the encoded-word %q: %q", ew, w)
+	}
+	w = wrap(ew, 40, "Subject: ", " ", false, 40)
+	if w != "Subject: "+ew {
+		t.Errorf("wrap broke the encoded-word %q after a prefix: %q", ew, w)
+	}
+
+	// text that only looks like an encoded-word is broken
+	for _, bogus := range []string{
+		"=?" + strings.Repeat("x", 100),
+		"=?utf-8?q?" + strings.Repeat("x", 70) + "?=",
+	} {
+		w = wrap(bogus, 40, "", " ", false, 40)
+		if w == bogus {
+			t.Errorf("wrap didn't break %q", bogus)
+		}
+	}
+
+	// this used to take time quadratic in the length of the line
+	huge := "=?" + strings.Repeat("x", 200000)
+	w = wrap(huge, 78, "Subject: ", " ", false, 998)
+	lines = strings.Split(w, "\r\n")
+	if len(lines) < 200 {
+		t.Errorf("wrap broke a huge line into only %d lines", len(lines))
+	}
+	for _, l := range lines {
+		if len(l) > 998 {
+			t.Errorf("wrap left a %d-character line", len(l))
+		}
+	}
+	if u := strings.Replace(w, "\r\n ", "", -1); u != "Subject: "+huge {
+		t.Error("wrap changed a huge line beginning with \"=?\"")
+	}
+
+	u := strings.Repeat("æ", 100)
+	w = wrap(u, 78, "", "", false, 78)
+	for _, l := range strings.Split(w, "\r\n") {
+		if !utf8.ValidString(l) {
+			t.Errorf("wrap(%q) split a character: %q", u, l)
+		}
+	}
+	if uw := strings.Replace(w, "\r\n", "", -1); uw != u {
+		t.Errorf("wrap(%q) unfolds as %q", u, uw)
+	}
+}
+
+func TestSubstringWriter(t *testing.T) {
+	cases := []struct {
+		writes []string
+		found  bool
+	}{
+		{[]string{"abc--xyz"}, true},
+		{[]string{"abc-", "-xy", "z"}, true},
+		{[]string{"-", "-", "x", "y", "z"}, true},
+		{[]string{"--xy", strings.Repeat("a", 100), "z"}, false},
+		{[]string{"--x", "yy", "z--xyz"}, true},
+		{[]string{"--xy"}, false},
+	}
+	for _, c := range cases {
+		sw := &substringWriter{s: "--xyz"}
+		for _, s := range c.writes {
+			io.WriteString(sw, s)
+		}
+		if sw.found != c.found {
+			t.Errorf("writing %q: expected found to be %v", c.writes, c.found)
+		}
+		if len(sw.tail) > 4 {
+			t.Errorf("writing %q kept %d bytes", c.writes, len(sw.tail))
+		}
+	}
+}